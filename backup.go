@@ -0,0 +1,278 @@
+package Bitcask
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const ManifestFileName = "backup.manifest"
+
+// Manifest describes a backup directory. Files lists every data and hint
+// file the store had when the backup was taken, and its HistoryFileName if
+// merge ever removed records. Copied is the subset stored in this
+// directory; the rest live in the backups it was chained from. Every backup
+// holds its own history file.
+type Manifest struct {
+	ID        string   `json:"id"`
+	Parent    string   `json:"parent,omitempty"`
+	MaxFileID uint32   `json:"max_file_id"`
+	Files     []string `json:"files"`
+	Copied    []string `json:"copied"`
+}
+
+// Backup writes a consistent copy of the store into dir, which Open can use
+// directly. Immutable files are hard linked when possible and copied otherwise.
+// dir is on the disk whatever Options.FileSystem the store uses.
+func (c *BitCask) Backup(dir string) error {
+	return c.backup(dir, nil)
+}
+
+// BackupIncremental writes into dir only the files created since the backup
+// in base was taken. Restore rebuilds the store from the whole chain.
+func (c *BitCask) BackupIncremental(dir, base string) error {
+	parent, err := ReadManifest(base)
+	if err != nil {
+		return err
+	}
+	return c.backup(dir, parent)
+}
+
+func (c *BitCask) backup(dir string, parent *Manifest) error {
+	files, floor, err := c.freezeFiles()
+	if err != nil {
+		return err
+	}
+	defer closeFiles(files)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	m := &Manifest{
+		ID: strconv.FormatInt(time.Now().UnixNano(), 10),
+	}
+	if parent != nil {
+		m.Parent = parent.ID
+		m.MaxFileID = parent.MaxFileID
+	}
+	for _, fp := range files {
+		if id := FileIDOf(fp.Name()); id > m.MaxFileID {
+			m.MaxFileID = id
+		}
+	}
+	for _, fp := range files {
+		name := filepath.Base(fp.Name())
+		m.Files = append(m.Files, name)
+		id := FileIDOf(name)
+		if parent != nil && id <= parent.MaxFileID {
+			continue
+		}
+		m.Copied = append(m.Copied, name)
+		// Open appends to the newest file, so it must not share an inode with ours
+		if _, ok := c.fs.(OSFS); ok && id != m.MaxFileID {
+			if err := os.Link(fp.Name(), dir+"/"+name); err == nil {
+				continue
+			}
+		}
+		if err := copyFile(fp, dir+"/"+name); err != nil {
+			return err
+		}
+	}
+	if floor > 0 {
+		if err := writeHistoryFloor(OSFS{}, dir, floor); err != nil {
+			return err
+		}
+		m.Files = append(m.Files, HistoryFileName)
+		m.Copied = append(m.Copied, HistoryFileName)
+	}
+	return WriteManifest(dir, m)
+}
+
+// Restore rebuilds a store in dir from a full backup followed by the chain of
+// incremental backups taken on top of it, oldest first.
+func Restore(dir string, backups ...string) error {
+	if len(backups) == 0 {
+		return fmt.Errorf("No backup to restore ")
+	}
+	source := make(map[string]string)
+	var last *Manifest
+	for i, b := range backups {
+		m, err := ReadManifest(b)
+		if err != nil {
+			return err
+		}
+		if i == 0 && m.Parent != "" {
+			return fmt.Errorf("Backup %s is incremental, need a full backup first ", b)
+		}
+		if i > 0 && m.Parent != last.ID {
+			return fmt.Errorf("Backup %s is not based on %s ", b, backups[i-1])
+		}
+		for _, name := range m.Copied {
+			source[name] = b + "/" + name
+		}
+		last = m
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, name := range last.Files {
+		src, ok := source[name]
+		if !ok {
+			return fmt.Errorf("File %s missing from backup chain ", name)
+		}
+		fp, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		err = copyFile(fp, dir+"/"+name)
+		fp.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ReadManifest(dir string) (*Manifest, error) {
+	buf, err := ioutil.ReadFile(dir + "/" + ManifestFileName)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(buf, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WriteManifest is the last step of a backup, so a directory without a
+// manifest is an interrupted one.
+func WriteManifest(dir string, m *Manifest) error {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := dir + "/" + ManifestFileName + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir+"/"+ManifestFileName)
+}
+
+// BackupTo streams a consistent copy of the store to w in tar format.
+func (c *BitCask) BackupTo(w io.Writer) error {
+	files, floor, err := c.freezeFiles()
+	if err != nil {
+		return err
+	}
+	defer closeFiles(files)
+
+	tw := tar.NewWriter(w)
+	for _, fp := range files {
+		stat, err := fp.Stat()
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    filepath.Base(fp.Name()),
+			Mode:    0644,
+			Size:    stat.Size(),
+			ModTime: stat.ModTime(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, io.NewSectionReader(fp, 0, stat.Size())); err != nil {
+			return err
+		}
+	}
+	if floor > 0 {
+		buf := []byte(strconv.FormatUint(floor, 10) + "\n")
+		hdr := &tar.Header{
+			Name:    HistoryFileName,
+			Mode:    0644,
+			Size:    int64(len(buf)),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// freezeFiles rotates the active file and opens every data and hint file
+// older than the new active one. The returned handles stay readable even if
+// merge removes the files afterwards. It also returns the history floor
+// that goes with them, see HistoryFileName.
+func (c *BitCask) freezeFiles() ([]File, uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// a replica can't rotate, its files must stay those of the leader
+	if c.readOnly {
+		return nil, 0, ReadOnlyErr
+	}
+	if c.writeFile.offset > 0 {
+		if err := RotateWriteableFile(c); err != nil {
+			return nil, 0, err
+		}
+	}
+	activeID := strconv.Itoa(int(c.writeFile.fileID))
+	dataFiles, err := ListDataFiles(c)
+	if err != nil {
+		return nil, 0, err
+	}
+	hintFiles, err := ListHintFiles(c)
+	if err != nil {
+		return nil, 0, err
+	}
+	var files []File
+	for _, name := range append(dataFiles, hintFiles...) {
+		if name == activeID+".data" || name == activeID+".hint" {
+			continue
+		}
+		fp, err := openRead(c.fs, c.dir+"/"+name)
+		if err != nil {
+			closeFiles(files)
+			return nil, 0, err
+		}
+		files = append(files, fp)
+	}
+	return files, c.discarded, nil
+}
+
+func copyFile(src File, dst string) error {
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fp, io.NewSectionReader(src, 0, stat.Size())); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+func closeFiles(files []File) {
+	for _, fp := range files {
+		fp.Close()
+	}
+}
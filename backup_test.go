@@ -0,0 +1,317 @@
+package Bitcask
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func testOptions() *Options {
+	return NewOptions(0, 0, -1, 0, true)
+}
+
+func openTest(t *testing.T, dir string) *BitCask {
+	t.Helper()
+	bc, err := Open(dir, testOptions())
+	if err != nil {
+		t.Fatalf("open %s: %v", dir, err)
+	}
+	return bc
+}
+
+func putTest(t *testing.T, bc *BitCask, kv ...string) {
+	t.Helper()
+	for i := 0; i+1 < len(kv); i += 2 {
+		if err := bc.Put([]byte(kv[i]), []byte(kv[i+1])); err != nil {
+			t.Fatalf("put %s: %v", kv[i], err)
+		}
+	}
+}
+
+// rotateTest makes the active file an old one, which merge takes.
+func rotateTest(t *testing.T, bc *BitCask) {
+	t.Helper()
+	bc.lock.Lock()
+	err := RotateWriteableFile(bc)
+	bc.lock.Unlock()
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+}
+
+// checkStore fails unless bc holds exactly want.
+func checkStore(t *testing.T, bc *BitCask, want map[string]string) {
+	t.Helper()
+	got := make(map[string]string)
+	err := bc.Fold(func(key, value []byte) error {
+		got[string(key)] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("fold: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("store holds %d keys, want %d: %v", len(got), len(want), got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("key %q holds %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestBackupOpens(t *testing.T) {
+	dir, backup := t.TempDir(), t.TempDir()
+	bc := openTest(t, dir)
+	putTest(t, bc, "a", "1", "b", "2", "c", "3")
+	if err := bc.Del([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.Backup(backup); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	// writes after the backup stay out of it
+	putTest(t, bc, "a", "changed", "d", "4")
+	bc.Close()
+
+	m, err := ReadManifest(backup)
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	if m.Parent != "" || len(m.Files) == 0 || len(m.Files) != len(m.Copied) {
+		t.Fatalf("full backup manifest %+v", m)
+	}
+	restored := openTest(t, backup)
+	defer restored.Close()
+	checkStore(t, restored, map[string]string{"a": "1", "c": "3"})
+	// the backup is a store of its own
+	putTest(t, restored, "e", "5")
+	checkStore(t, restored, map[string]string{"a": "1", "c": "3", "e": "5"})
+
+	bc = openTest(t, dir)
+	defer bc.Close()
+	checkStore(t, bc, map[string]string{"a": "changed", "c": "3", "d": "4"})
+}
+
+func TestBackupTo(t *testing.T) {
+	dir, restored := t.TempDir(), t.TempDir()
+	bc := openTest(t, dir)
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		k, v := fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i)
+		putTest(t, bc, k, v)
+		want[k] = v
+	}
+	var buf bytes.Buffer
+	if err := bc.BackupTo(&buf); err != nil {
+		t.Fatalf("backup to: %v", err)
+	}
+	bc.Close()
+
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read tar: %v", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read %s: %v", hdr.Name, err)
+		}
+		if err := ioutil.WriteFile(restored+"/"+hdr.Name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rc := openTest(t, restored)
+	defer rc.Close()
+	checkStore(t, rc, want)
+}
+
+func TestBackupReplicaFails(t *testing.T) {
+	dir := t.TempDir()
+	bc := openTest(t, dir)
+	bc.Close()
+	replica, err := OpenReplica(dir, testOptions())
+	if err != nil {
+		t.Fatalf("open replica: %v", err)
+	}
+	defer replica.Close()
+	if err := replica.Backup(t.TempDir()); err != ReadOnlyErr {
+		t.Fatalf("backup of a replica: %v, want %v", err, ReadOnlyErr)
+	}
+}
+
+func TestBackupIncrementalRestore(t *testing.T) {
+	dir, full, inc1, inc2 := t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir()
+	bc := openTest(t, dir)
+	defer bc.Close()
+	putTest(t, bc, "a", "1", "b", "2")
+	if err := bc.Backup(full); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	putTest(t, bc, "b", "changed", "c", "3")
+	if err := bc.BackupIncremental(inc1, full); err != nil {
+		t.Fatalf("incremental backup: %v", err)
+	}
+	if err := bc.Del([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	putTest(t, bc, "d", "4")
+	if err := bc.BackupIncremental(inc2, inc1); err != nil {
+		t.Fatalf("incremental backup: %v", err)
+	}
+
+	fm, _ := ReadManifest(full)
+	m, err := ReadManifest(inc1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Parent != fm.ID {
+		t.Fatalf("incremental parent %q, want %q", m.Parent, fm.ID)
+	}
+	for _, name := range m.Copied {
+		if FileIDOf(name) <= fm.MaxFileID {
+			t.Fatalf("incremental backup copied %s, already in its base", name)
+		}
+	}
+
+	steps := []struct {
+		chain []string
+		want  map[string]string
+	}{
+		{[]string{full}, map[string]string{"a": "1", "b": "2"}},
+		{[]string{full, inc1}, map[string]string{"a": "1", "b": "changed", "c": "3"}},
+		{[]string{full, inc1, inc2}, map[string]string{"b": "changed", "c": "3", "d": "4"}},
+	}
+	for i, s := range steps {
+		restored := t.TempDir()
+		if err := Restore(restored, s.chain...); err != nil {
+			t.Fatalf("restore %d: %v", i, err)
+		}
+		rc := openTest(t, restored)
+		checkStore(t, rc, s.want)
+		rc.Close()
+	}
+}
+
+func TestRestoreBrokenChain(t *testing.T) {
+	dir, full, inc1, inc2 := t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir()
+	bc := openTest(t, dir)
+	defer bc.Close()
+	putTest(t, bc, "a", "1")
+	if err := bc.Backup(full); err != nil {
+		t.Fatal(err)
+	}
+	putTest(t, bc, "b", "2")
+	if err := bc.BackupIncremental(inc1, full); err != nil {
+		t.Fatal(err)
+	}
+	putTest(t, bc, "c", "3")
+	if err := bc.BackupIncremental(inc2, inc1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Restore(t.TempDir()); err == nil {
+		t.Fatal("restore without backups succeeded")
+	}
+	if err := Restore(t.TempDir(), inc1, inc2); err == nil {
+		t.Fatal("restore from an incremental backup succeeded")
+	}
+	if err := Restore(t.TempDir(), full, inc2); err == nil {
+		t.Fatal("restore skipping a backup of the chain succeeded")
+	}
+	if err := bc.BackupIncremental(t.TempDir(), t.TempDir()); err == nil {
+		t.Fatal("incremental backup without a base manifest succeeded")
+	}
+}
+
+func TestBackupKeepsHistoryFloor(t *testing.T) {
+	dir, full, inc := t.TempDir(), t.TempDir(), t.TempDir()
+	opt := testOptions()
+	opt.MaxFileSize = 128
+	bc, err := Open(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	for i := 0; i < 20; i++ {
+		putTest(t, bc, fmt.Sprintf("k%d", i%5), fmt.Sprintf("v%d", i))
+	}
+	if err := NewMerge(bc, 0).Run(); err != nil {
+		t.Fatal(err)
+	}
+	last := bc.LastSeq()
+	if err := bc.Backup(full); err != nil {
+		t.Fatal(err)
+	}
+	putTest(t, bc, "k9", "new")
+	if err := NewMerge(bc, 0).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.BackupIncremental(inc, full); err != nil {
+		t.Fatal(err)
+	}
+	var tarball bytes.Buffer
+	if err := bc.BackupTo(&tarball); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restored store must not replay changes merge removed as if none were
+	check := func(name, dir string, floor uint64) {
+		t.Helper()
+		got, err := readHistoryFloor(OSFS{}, dir)
+		if err != nil || got != floor {
+			t.Fatalf("%s: history floor %d, %v, want %d", name, got, err, floor)
+		}
+		rc := openTest(t, dir)
+		defer rc.Close()
+		if err := rc.ChangesSince(0, func(e *Event) error { return nil }); err != HistoryUnavailableErr {
+			t.Fatalf("%s: changes since 0: %v", name, err)
+		}
+	}
+	fullFloor, _ := readHistoryFloor(OSFS{}, full)
+	if fullFloor == 0 || fullFloor > last {
+		t.Fatalf("full backup history floor %d, last seq %d", fullFloor, last)
+	}
+	check("full", full, fullFloor)
+	m, err := ReadManifest(inc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed bool
+	for _, name := range m.Copied {
+		listed = listed || name == HistoryFileName
+	}
+	if !listed {
+		t.Fatalf("incremental manifest copied %v", m.Copied)
+	}
+	floor, _ := readHistoryFloor(OSFS{}, dir)
+	restored := t.TempDir()
+	if err := Restore(restored, full, inc); err != nil {
+		t.Fatal(err)
+	}
+	check("restore", restored, floor)
+
+	untarred := t.TempDir()
+	tr := tar.NewReader(&tarball)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(tr)
+		if err := ioutil.WriteFile(untarred+"/"+hdr.Name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("tar", untarred, floor)
+}
@@ -0,0 +1,145 @@
+package Bitcask
+
+// Batch collects puts and deletes that Write applies atomically: readers see
+// either none or all of them, and after a crash Open restores either none or
+// all of them. Every record but the last is written with FlagBatch, so a
+// batch whose last record never reached the disk is dropped on load.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key   []byte
+	value []byte
+	meta  *Meta
+	del   bool
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+func (b *Batch) Put(key, value []byte) {
+	b.PutWithMeta(key, value, nil)
+}
+
+func (b *Batch) PutWithMeta(key, value []byte, meta *Meta) {
+	b.ops = append(b.ops, batchOp{key: key, value: value, meta: meta})
+}
+
+// Del deletes key when the batch is written. A key that does not exist is
+// not an error.
+func (b *Batch) Del(key []byte) {
+	b.ops = append(b.ops, batchOp{key: key, del: true})
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Write applies every operation of b in order.
+func (c *BitCask) Write(b *Batch) error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+	// encode up front so a failure leaves nothing written
+	values := make([][]byte, len(b.ops))
+	flags := make([]uint8, len(b.ops))
+	for i, op := range b.ops {
+		if err := checkKey(op.key); err != nil {
+			return err
+		}
+		if op.del {
+			flags[i] = FlagTombstone
+			continue
+		}
+		var err error
+		if values[i], flags[i], err = c.encodeValue(op.value, op.meta); err != nil {
+			return err
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.readOnly {
+		return ReadOnlyErr
+	}
+	if err := c.markStaleIndexes(); err != nil {
+		return err
+	}
+	// rotate up front so the whole batch lands in one file
+	if err := CheckWriteableFile(c); err != nil {
+		return err
+	}
+	start := c.writeFile.offset
+	entries := make([]Entry, len(b.ops))
+	var updates []indexUpdate
+	// the last op of each key so far, which the indexes must see
+	written := make(map[string]*batchOp)
+	for i := range b.ops {
+		if i < len(b.ops)-1 {
+			flags[i] |= FlagBatch
+		}
+		e, err := c.writeBatchOp(&b.ops[i], values[i], flags[i], written, &updates)
+		if err != nil {
+			if c.writeFile.offset != start {
+				closeUnfinishedBatch(c)
+			}
+			return err
+		}
+		entries[i] = e
+	}
+	applyIndexUpdates(updates)
+	for i, op := range b.ops {
+		if op.del {
+			c.keyDirs.Del(string(op.key))
+			c.publish(EventDel, op.key, nil, nil, &entries[i])
+			continue
+		}
+		c.keyDirs.Put(string(op.key), &entries[i])
+		c.publish(EventPut, op.key, op.value, op.meta, &entries[i])
+	}
+	return nil
+}
+
+// writeBatchOp is write for one op of a batch. The keydir doesn't show the
+// ops before it yet, written does.
+func (c *BitCask) writeBatchOp(op *batchOp, stored []byte, flags uint8, written map[string]*batchOp, updates *[]indexUpdate) (Entry, error) {
+	if len(c.indexes) == 0 {
+		return c.writeFile.WriteWithFlags(op.key, stored, flags)
+	}
+	var old []byte
+	var found bool
+	if prev, ok := written[string(op.key)]; ok {
+		old, found = prev.value, !prev.del
+	} else {
+		var err error
+		if old, found, err = c.indexedValue(op.key); err != nil {
+			return Entry{}, err
+		}
+	}
+	written[string(op.key)] = op
+	return c.writeIndexed(op.key, old, found, op.value, stored, flags, updates)
+}
+
+// MGet reads every key under one lock. Missing keys get a nil value.
+func (c *BitCask) MGet(keys [][]byte) ([][]byte, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		value, err := c.get(key)
+		if err == KeyNotFoundErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		values[i] = value
+	}
+	return values, nil
+}
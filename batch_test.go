@@ -0,0 +1,86 @@
+package Bitcask
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBatchWrite(t *testing.T) {
+	dir := t.TempDir()
+	bc := openTest(t, dir)
+	putTest(t, bc, "a", "1", "b", "2")
+
+	b := NewBatch()
+	b.Put([]byte("a"), []byte("x"))
+	b.Del([]byte("b"))
+	b.Put([]byte("c"), []byte("3"))
+	b.Put([]byte("c"), []byte("4"))
+	b.Del([]byte("missing"))
+	if err := bc.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "x", "c": "4"}
+	checkStore(t, bc, want)
+	if err := bc.Write(NewBatch()); err != nil {
+		t.Fatalf("empty batch: %v", err)
+	}
+	bc.Close()
+
+	bc = openTest(t, dir)
+	defer bc.Close()
+	checkStore(t, bc, want)
+}
+
+func TestBatchAtomicOnWriteError(t *testing.T) {
+	for _, torn := range []int{0, 5} {
+		fs := NewFaultFS(NewMemFS())
+		opt := testOptions()
+		opt.FileSystem = fs
+		bc, err := Open("/db", opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		putTest(t, bc, "a", "1", "b", "2")
+		want := map[string]string{"a": "1", "b": "2"}
+
+		// the third record of the batch fails to reach its file
+		fs.Inject(Fault{Op: OpWrite, Suffix: ".data", After: 2, Once: true, Torn: torn})
+		b := NewBatch()
+		b.Put([]byte("a"), []byte("x"))
+		b.Del([]byte("b"))
+		b.Put([]byte("c"), []byte("3"))
+		b.Put([]byte("d"), []byte("4"))
+		if err := bc.Write(b); !errors.Is(err, InjectedFaultErr) {
+			t.Fatalf("torn %d: batch write: %v", torn, err)
+		}
+		fs.Clear()
+		checkStore(t, bc, want)
+
+		// the part written stays an unfinished batch, which later writes
+		// don't complete
+		putTest(t, bc, "e", "5")
+		want["e"] = "5"
+		checkStore(t, bc, want)
+		bc.Close()
+
+		bc, err = Open("/db", opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStore(t, bc, want)
+		bc.Close()
+	}
+}
+
+func TestMGet(t *testing.T) {
+	bc := openTest(t, t.TempDir())
+	defer bc.Close()
+	putTest(t, bc, "a", "1", "c", "3")
+	values, err := bc.MGet([][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || string(values[0]) != "1" || values[1] != nil || string(values[2]) != "3" {
+		t.Fatalf("MGet = %q", values)
+	}
+}
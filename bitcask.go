@@ -2,86 +2,298 @@ package Bitcask
 
 import (
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"strconv"
-	"strings"
 	"sync"
+	"time"
 )
 
 type BitCask struct {
 	options   *Options
 	oldFiles  *DBFiles
-	lockFile  *os.File
+	lockFile  File
 	dir       string
+	fs        FileSystem
 	keyDirs   *KeyDirs
+	buckets   *buckets
+	indexes   map[string]IndexFunc
 	writeFile *DBFile
 	lock      *sync.RWMutex
+	watch     *watchHub
+	// discarded is the Seq of the newest record merge has removed
+	discarded uint64
+	// readOnly is set on replicas, whose files only the leader changes
+	readOnly bool
+	metrics  *metrics
+	// seal is nil unless Options.Encryption is set
+	seal *sealer
+	// indexesChecked is set once the first write marked the indexes not
+	// registered since Open stale
+	indexesChecked bool
 }
 
 var (
 	KeyNotFoundErr = fmt.Errorf("Key Not found ")
+	ReadOnlyErr    = fmt.Errorf("Store is a read-only replica ")
 )
 
 func (c *BitCask) Close() {
+	c.watch.closeAll()
 	c.oldFiles.Close()
 	c.writeFile.file.Close()
 	c.writeFile.hintFile.Close()
 	c.lockFile.Close()
-	err := os.Remove(c.dir + "/" + LockFileName)
+	err := c.fs.Remove(c.dir + "/" + LockFileName)
 	log.Printf("Remove %s/%s", c.dir, LockFileName)
 	if err != nil {
 		log.Fatalln(err)
 	}
 }
 
-func (c *BitCask) Put(key []byte, value []byte) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+// Sync flushes the active file and its hints to disk, so every write
+// acknowledged before it survives a crash. Rotated files are synced as they
+// are closed.
+func (c *BitCask) Sync() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 
-	CheckWriteableFile(c)
-	e, err := c.writeFile.Write(key, value)
-	if err != nil {
+	return c.sync()
+}
+
+func (c *BitCask) sync() error {
+	if err := c.writeFile.file.Sync(); err != nil {
 		return err
 	}
-	c.keyDirs.Put(string(key), &e)
+	return c.writeFile.hintFile.Sync()
+}
+
+func (c *BitCask) Put(key []byte, value []byte) error {
+	return c.PutWithMeta(key, value, nil)
+}
+
+// PutWithMeta stores meta together with value, replacing any previous meta.
+func (c *BitCask) PutWithMeta(key, value []byte, meta *Meta) error {
+	_, err := c.PutIf(key, value, meta, PutAlways)
+	return err
+}
+
+// checkKey rejects a key too large to store before anything is written.
+func checkKey(key []byte) error {
+	if len(key) > MaxKeySize {
+		return KeyTooLargeErr
+	}
 	return nil
 }
 
 func (c *BitCask) Get(key []byte) ([]byte, error) {
+	defer c.metrics.get.since(time.Now())
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.get(key)
+}
+
+// GetWithMeta returns the value of key and the meta stored with it.
+func (c *BitCask) GetWithMeta(key []byte) ([]byte, *Meta, error) {
+	defer c.metrics.get.since(time.Now())
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
-	e := c.keyDirs.Get(string(key))
+	return c.getWithMeta(key)
+}
+
+func (c *BitCask) get(key []byte) ([]byte, error) {
+	value, _, err := c.getWithMeta(key)
+	return value, err
+}
+
+func (c *BitCask) getWithMeta(key []byte) ([]byte, *Meta, error) {
+	value, meta, _, err := c.getEntry(key)
+	return value, meta, err
+}
+
+func (c *BitCask) getEntry(key []byte) ([]byte, *Meta, *Entry, error) {
+	return c.getEntryIn(c.keyDirs, key)
+}
+
+// getEntryIn is getEntry for the key of a record as stored in kd.
+func (c *BitCask) getEntryIn(kd *KeyDirs, key []byte) ([]byte, *Meta, *Entry, error) {
+	e := kd.Get(string(key))
 	if e == nil {
-		return nil, KeyNotFoundErr
+		return nil, nil, nil, KeyNotFoundErr
+	}
+	value, meta, err := c.readEntry(e)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if meta.Expired(time.Now()) {
+		return nil, nil, nil, KeyNotFoundErr
+	}
+	return value, meta, e, nil
+}
+
+// readEntry reads the value at e, whether expired or not.
+func (c *BitCask) readEntry(e *Entry) ([]byte, *Meta, error) {
+	f, err := c.GetFile(e.fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	stored, err := f.Read(e.valueOffset, e.valueSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e.flags&FlagEncrypted != 0 {
+		if stored, err = c.seal.open(stored); err != nil {
+			return nil, nil, err
+		}
+	}
+	return DecodeValue(stored, e.flags)
+}
+
+// Apply atomically replaces the value of key with op.Merge(current, operand)
+// and returns the new value. The meta of the key is kept.
+func (c *BitCask) Apply(key, operand []byte, op MergeOperator) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.readOnly {
+		return nil, ReadOnlyErr
+	}
+	existing, meta, err := c.getWithMeta(key)
+	if err != nil && err != KeyNotFoundErr {
+		return nil, err
+	}
+	value, err := op.Merge(existing, operand)
+	if err != nil {
+		return nil, err
 	}
-	fileID := e.fileID
-	f, err := c.GetFile(fileID)
-	if err != nil && os.IsNotExist(err) {
+	stored, flags, err := c.encodeValue(value, meta)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckWriteableFile(c); err != nil {
 		return nil, err
 	}
-	return f.Read(e.valueOffset, e.valueSize)
+	e, err := c.write(key, value, stored, flags)
+	if err != nil {
+		return nil, err
+	}
+	c.keyDirs.Put(string(key), &e)
+	c.publish(EventPut, key, value, meta, &e)
+	return value, nil
+}
+
+// Incr atomically adds delta to the integer stored at key and returns the result.
+func (c *BitCask) Incr(key []byte, delta int64) (int64, error) {
+	value, err := c.Apply(key, nil, IncrOperator{Delta: delta})
+	if err != nil {
+		return 0, err
+	}
+	return ParseInt(value)
 }
 
 func (c *BitCask) Del(key []byte) error {
+	defer c.metrics.del.since(time.Now())
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	if c.readOnly {
+		return ReadOnlyErr
+	}
 	if c.writeFile == nil {
 		return fmt.Errorf("No writeable file.")
 	}
-	e := c.keyDirs.Get(string(key))
-	if e == nil {
-		return KeyNotFoundErr
+	// an expired key is already gone for readers, merge drops it
+	if _, _, err := c.getWithMeta(key); err != nil {
+		return err
 	}
-	CheckWriteableFile(c)
-	err := c.writeFile.Del(key)
+	if err := CheckWriteableFile(c); err != nil {
+		return err
+	}
+	e, err := c.write(key, nil, nil, FlagTombstone)
 	if err != nil {
 		return err
 	}
 	c.keyDirs.Del(string(key))
+	c.publish(EventDel, key, nil, nil, &e)
+	return nil
+}
+
+// Keys returns every live key in sorted order.
+func (c *BitCask) Keys() [][]byte {
+	keys := c.keyDirs.Keys()
+	res := make([][]byte, len(keys))
+	for i, k := range keys {
+		res[i] = []byte(k)
+	}
+	return res
+}
+
+// Len returns the number of keys outside buckets, counting expired keys
+// until merge drops them.
+func (c *BitCask) Len() int {
+	return c.keyDirs.Len()
+}
+
+// Fold calls fn for every live key in sorted order, stopping at the first
+// error. Keys deleted while folding are skipped.
+func (c *BitCask) Fold(fn func(key, value []byte) error) error {
+	return c.fold(func(key []byte, e *Entry, value []byte, meta *Meta) error {
+		return fn(key, value)
+	})
+}
+
+// Scan is Fold restricted to keys starting with prefix.
+func (c *BitCask) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	return c.Range(prefix, nil, 0, fn)
+}
+
+// ListKeys returns, in sorted order, at most limit keys starting with prefix
+// that are not less than start. A limit <= 0 means no limit.
+func (c *BitCask) ListKeys(prefix, start []byte, limit int) [][]byte {
+	keys := c.keyDirs.Range(string(prefix), string(start), limit)
+	res := make([][]byte, len(keys))
+	for i, k := range keys {
+		res[i] = []byte(k)
+	}
+	return res
+}
+
+// Range is Fold over the keys ListKeys would return. Values are read one at
+// a time, so only the keys are held in memory.
+func (c *BitCask) Range(prefix, start []byte, limit int, fn func(key, value []byte) error) error {
+	return c.foldKeys(c.keyDirs.Range(string(prefix), string(start), limit), func(key []byte, e *Entry, value []byte, meta *Meta) error {
+		return fn(key, value)
+	})
+}
+
+func (c *BitCask) fold(fn func(key []byte, e *Entry, value []byte, meta *Meta) error) error {
+	return c.foldKeys(c.keyDirs.Keys(), fn)
+}
+
+func (c *BitCask) foldKeys(keys []string, fn func(key []byte, e *Entry, value []byte, meta *Meta) error) error {
+	return c.foldKeysIn(c.keyDirs, keys, fn)
+}
+
+func (c *BitCask) foldKeysIn(kd *KeyDirs, keys []string, fn func(key []byte, e *Entry, value []byte, meta *Meta) error) error {
+	for _, k := range keys {
+		c.lock.RLock()
+		value, meta, e, err := c.getEntryIn(kd, []byte(k))
+		c.lock.RUnlock()
+		if err == KeyNotFoundErr {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn([]byte(k), e, value, meta); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -93,25 +305,27 @@ func (c *BitCask) GetFile(fileID uint32) (*DBFile, error) {
 	if f != nil {
 		return f, nil
 	}
-	f, err := OpenDBFile(c.dir, int(fileID))
+	f, err := OpenDBFile(c.fs, c.dir, int(fileID))
 	if err != nil {
 		return nil, err
 	}
+	f.metrics = c.metrics
+	c.oldFiles.Put(fileID, f)
 	return f, nil
 }
 
-func (c *BitCask) ReadableFiles() ([]*os.File, error) {
+func (c *BitCask) ReadableFiles() ([]File, error) {
 	filterFileNames := []string{LockFileName}
-	fs, err := ListHintFiles(c)
+	hintFiles, err := ListHintFiles(c)
 	if err != nil {
 		return nil, err
 	}
-	files := make([]*os.File, 0, len(fs))
-	for _, filePath := range fs {
+	files := make([]File, 0, len(hintFiles))
+	for _, filePath := range hintFiles {
 		if HasSuffixs(filterFileNames, filePath) {
 			continue
 		}
-		fp, err := os.OpenFile(c.dir+"/"+filePath, os.O_RDONLY, 0755)
+		fp, err := openRead(c.fs, c.dir+"/"+filePath)
 		if err != nil {
 			return nil, err
 		}
@@ -123,105 +337,238 @@ func (c *BitCask) ReadableFiles() ([]*os.File, error) {
 	return files, nil
 }
 
-func (c *BitCask) ParseHint(files []*os.File) {
-	buf := make([]byte, HintHeaderSize, HintHeaderSize)
+// ParseHint loads the keydir from hint files in file ID order. Records of a
+// batch are held back until the record that ends it, and a batch that never
+// ended is dropped. A batch never spans files, so it returns whether the
+// last file ends with such a batch. A hint pointing past the end of its data
+// file fails it with a *RecordError.
+func (c *BitCask) ParseHint(files []File) (bool, error) {
+	type pendingHint struct {
+		fileID uint32
+		hint   *Hint
+	}
+	var pending []pendingHint
+	unfinished := false
+	apply := func(fileID uint32, h *Hint) {
+		if h.IsTombstone() {
+			c.load(h.Key, h.Flags, nil)
+			return
+		}
+		c.load(h.Key, h.Flags, &Entry{
+			fileID:      fileID,
+			valueSize:   h.ValueSize,
+			valueOffset: h.ValuePos,
+			timeStamp:   h.TimeStamp,
+			flags:       h.Flags,
+		})
+	}
 	for _, fp := range files {
-		offset := int64(0)
-		fileName := fp.Name()
-		i := strings.LastIndex(fileName, "/") + 1
-		j := strings.LastIndex(fileName, ".hint")
-		fileID, _ := strconv.ParseInt(fileName[i:j], 10, 32)
-		for {
-			n, err := fp.ReadAt(buf, offset)
-			offset += int64(n)
-			if err != nil && err != io.EOF {
-				panic(err)
-			}
-			if err == io.EOF {
-				break
-			}
-			if n != HintHeaderSize {
-				panic(fmt.Errorf("Hint header size error "))
-			}
-			tStamp, keySize, valueSize, valuePos := DecodeHint(buf)
-			if keySize+valueSize == 0 {
-				continue
+		fileID := FileIDOf(fp.Name())
+		stat, err := fp.Stat()
+		if err != nil {
+			return false, err
+		}
+		dataStat, err := c.fs.Stat(c.dir + "/" + strconv.Itoa(int(fileID)) + ".data")
+		if os.IsNotExist(err) {
+			// merge removed the data and crashed before its hints, which
+			// only point at records copied since
+			log.Printf("Skip %s, its data file is gone", fp.Name())
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		dataSize := uint64(dataStat.Size())
+		records := int64(0)
+		err = ReadHints(fp, stat.Size(), func(h *Hint) error {
+			records++
+			if start := uint64(HeaderSize + len(h.Key)); h.ValuePos < start {
+				return &RecordError{h.Offset, &SizeError{"key", uint64(len(h.Key)), h.ValuePos - HeaderSize}}
 			}
-			KeyBytes := make([]byte, keySize)
-			n, err = fp.ReadAt(KeyBytes, offset)
-			if err != nil && err != io.EOF {
-				panic(err)
+			if end := h.ValuePos + uint64(h.ValueSize); end > dataSize {
+				return &RecordError{h.Offset, &SizeError{"value end", end, dataSize}}
 			}
-			if err == io.EOF {
-				break
+			if h.Flags&FlagEncrypted != 0 {
+				key, err := c.seal.open(h.Key)
+				if err != nil {
+					return &RecordError{h.Offset, err}
+				}
+				// ReadHints still needs the size of the sealed key
+				plain := *h
+				plain.Key = key
+				h = &plain
 			}
-			if n != int(keySize) {
-				panic(fmt.Errorf("Key size error "))
+			if h.Flags&FlagBatch != 0 {
+				pending = append(pending, pendingHint{fileID, h})
+				return nil
 			}
-			key := string(KeyBytes)
-			e := &Entry{
-				fileID:      uint32(fileID),
-				valueSize:   valueSize,
-				valueOffset: valuePos,
-				timeStamp:   tStamp,
+			for _, p := range pending {
+				apply(p.fileID, p.hint)
 			}
-			offset += int64(keySize)
-			c.keyDirs.Put(key, e)
+			pending = nil
+			apply(fileID, h)
+			return nil
+		})
+		if err != nil {
+			return false, &os.PathError{Op: "parse hints", Path: fp.Name(), Err: err}
+		}
+		c.metrics.recorded(fileID, records)
+		if len(pending) > 0 {
+			log.Printf("Drop %d records of an unfinished batch in %s", len(pending), fp.Name())
 		}
+		unfinished = len(pending) > 0
+		pending = nil
 	}
+	c.buckets.prune()
+	return unfinished, nil
 }
 
+// put rewrites a record found by merge into the active file, unless the key
+// has been written or deleted since. value is the stored value, still
+// encoded as e.flags say. It is written encrypted with the current key, if
+// any.
 func (c *BitCask) put(key []byte, value []byte, e *Entry) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	CheckWriteableFile(c)
-	if !c.keyDirs.Compare(string(key), e) {
-		return fmt.Errorf("Compare error ")
+	kd := c.keyDirOf(key, e.flags)
+	if kd == nil {
+		// its bucket was dropped
+		return nil
+	}
+	old := kd.Get(string(key))
+	if old == nil || old.fileID != e.fileID || old.valueOffset != e.valueOffset {
+		return nil
+	}
+	if e.flags&FlagEncrypted != 0 {
+		var err error
+		if value, err = c.seal.open(value); err != nil {
+			return err
+		}
+	}
+	if err := CheckWriteableFile(c); err != nil {
+		return err
+	}
+	if old, meta, err := DecodeValue(value, e.flags); err == nil && meta.Expired(time.Now()) {
+		flags := FlagTombstone | FlagMerged | e.flags&FlagBucket
+		var entry Entry
+		if flags&FlagBucket == 0 && len(c.indexes) > 0 {
+			// the indexes must forget the key too
+			var updates []indexUpdate
+			start := c.writeFile.offset
+			if entry, err = c.writeIndexed(key, old, true, nil, nil, flags, &updates); err != nil {
+				if c.writeFile.offset != start {
+					closeUnfinishedBatch(c)
+				}
+				return err
+			}
+			applyIndexUpdates(updates)
+		} else if entry, err = c.writeFile.WriteWithFlags(key, nil, flags); err != nil {
+			return err
+		}
+		kd.Del(string(key))
+		// watchers may have seen the put, ChangesSince reports it too
+		if flags&FlagBucket != 0 {
+			c.publishBucket(EventDel, key, &entry)
+		} else {
+			c.publish(EventDel, key, nil, nil, &entry)
+		}
+		return nil
 	}
-	c.oldFiles.DelWithFileID(e.fileID)
-	e.fileID = c.writeFile.fileID
-	entry, err := c.writeFile.Write(key, value)
+	// the batch the record came from is complete, or it would not be loaded
+	entry, err := c.writeFile.WriteWithFlags(key, value, e.flags&^(FlagBatch|FlagEncrypted)|FlagMerged)
 	if err != nil {
 		return err
 	}
-	keyDirs.Put(string(key), &entry)
+	kd.Put(string(key), &entry)
 	return nil
 }
 
 func Open(dir string, opt *Options) (*BitCask, error) {
+	return open(dir, opt, false)
+}
+
+func open(dir string, opt *Options, readOnly bool) (*BitCask, error) {
 	if opt == nil {
 		opt = NewOptions(0, 0, -1, 60, true)
 	}
-	_, err := os.Stat(dir)
+	if opt.MaxFileSize > maxFileSizeLimit {
+		o := *opt
+		o.MaxFileSize = maxFileSizeLimit
+		opt = &o
+	}
+	if opt.Compression != nil {
+		// what it writes must be readable
+		if _, err := codecOf(opt.Compression.ID()); err != nil {
+			return nil, err
+		}
+	}
+	fs := opt.FileSystem
+	if fs == nil {
+		fs = OSFS{}
+	}
+	_, err := fs.Stat(dir)
 	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
 	if os.IsNotExist(err) {
-		err := os.Mkdir(dir, 0755)
+		err := fs.MkdirAll(dir, 0755)
 		if err != nil {
 			return nil, err
 		}
 	}
+	var seal *sealer
+	if opt.Encryption != nil {
+		if seal, err = newSealer(opt.Encryption); err != nil {
+			return nil, err
+		}
+	}
 	b := &BitCask{
 		options:  opt,
 		dir:      dir,
+		fs:       fs,
 		oldFiles: NewDBFiles(),
 		lock:     &sync.RWMutex{},
+		readOnly: readOnly,
+		metrics:  newMetrics(),
+		seal:     seal,
 	}
 
-	b.lockFile, err = LockFile(dir + "/" + LockFileName)
+	b.lockFile, err = LockFile(fs, dir+"/"+LockFileName)
 	if err != nil {
 		return nil, err
 	}
 	b.keyDirs = NewKeyDirs(dir)
+	b.buckets = newBuckets()
+	b.indexes = make(map[string]IndexFunc)
 
 	files, err := b.ReadableFiles()
 
-	b.ParseHint(files)
 	fileID, hintFile := LastFileInfo(files)
-	writeFile, fileID := SetWriteableFile(fileID, dir)
-	hintFile = SetHintFile(fileID, dir)
+	if fileID != 0 {
+		err = recoverDataFile(fs, dir, fileID)
+	}
+	unfinished := false
+	if err == nil {
+		unfinished, err = b.ParseHint(files)
+	}
+	var writeFile File
+	if err == nil {
+		writeFile, fileID, err = SetWriteableFile(fs, fileID, dir)
+	}
+	if err == nil {
+		if hintFile, err = SetHintFile(fs, fileID, dir); err != nil {
+			writeFile.Close()
+		}
+	}
+	if err != nil {
+		for _, fp := range files {
+			fp.Close()
+		}
+		b.lockFile.Close()
+		fs.Remove(dir + "/" + LockFileName)
+		return nil, err
+	}
 	CloseReadHintFile(files, fileID)
 	dataStat, _ := writeFile.Stat()
 	dbFile := &DBFile{
@@ -229,8 +576,22 @@ func Open(dir string, opt *Options) (*BitCask, error) {
 		fileID:   fileID,
 		offset:   uint64(dataStat.Size()),
 		hintFile: hintFile,
+		metrics:  b.metrics,
+		seal:     b.seal,
 	}
 	b.writeFile = dbFile
-	WritePID(b.lockFile, fileID)
+	if unfinished && !readOnly {
+		// records appended after the dropped batch would seem to end it
+		err = RotateWriteableFile(b)
+	}
+	b.watch = newWatchHub(SeqOf(b.writeFile.fileID, b.writeFile.offset))
+	if err == nil {
+		b.discarded, err = readHistoryFloor(fs, dir)
+	}
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	WritePID(b.lockFile, b.writeFile.fileID)
 	return b, nil
 }
@@ -0,0 +1,55 @@
+package Bitcask
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyTooLarge(t *testing.T) {
+	opt := testOptions()
+	opt.FileSystem = NewMemFS()
+	opt.Encryption = &StaticKeys{Current: 1, Keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+	bc, err := Open("/db", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := bc.Bucket("b")
+	big := bytes.Repeat([]byte{'k'}, MaxKeySize+1)
+	batch := NewBatch()
+	batch.Put([]byte("small"), []byte("v"))
+	batch.Put(big, []byte("v"))
+	writes := map[string]func() error{
+		"put":    func() error { return bc.Put(big, []byte("v")) },
+		"putif":  func() error { _, err := bc.PutIf(big, []byte("v"), nil, PutIfAbsent); return err },
+		"batch":  func() error { return bc.Write(batch) },
+		"incr":   func() error { _, err := bc.Incr(big, 1); return err },
+		"apply":  func() error { _, err := bc.Apply(big, []byte("v"), AppendOperator{}); return err },
+		"bucket": func() error { return bucket.Put(big, []byte("v")) },
+	}
+	for name, write := range writes {
+		if err := write(); err != KeyTooLargeErr {
+			t.Fatalf("%s of an oversized key: %v, want %v", name, err, KeyTooLargeErr)
+		}
+	}
+	if keys := bc.Keys(); len(keys) != 0 {
+		t.Fatalf("rejected writes stored %d keys", len(keys))
+	}
+
+	// the longest key fits even sealed in a bucket
+	longest := big[:MaxKeySize]
+	if err := bucket.Put(longest, []byte("v")); err != nil {
+		t.Fatalf("put of a key of MaxKeySize: %v", err)
+	}
+	bc.Close()
+	bc, err = Open("/db", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	if v, err := bc.Bucket("b").Get(longest); err != nil || string(v) != "v" {
+		t.Fatalf("get of a key of MaxKeySize after reopen: %q, %v", v, err)
+	}
+	if _, err := bc.Get([]byte("small")); err != KeyNotFoundErr {
+		t.Fatalf("rejected batch stored its other keys: %v", err)
+	}
+}
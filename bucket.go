@@ -0,0 +1,441 @@
+package Bitcask
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+var (
+	BucketNotFoundErr = fmt.Errorf("Bucket not found ")
+	BucketNameErr     = fmt.Errorf("Bucket name must not be empty or start with a zero byte ")
+)
+
+// A record of a bucket has FlagBucket set and its key stored as the uvarint
+// ID of the bucket followed by the key. The keys of bucket catalogID name
+// the others: the uvarint ID of a bucket followed by its name. Creating a
+// bucket writes its catalog key, dropping it deletes that key, which drops
+// every key of the bucket at once. IDs are not reused while records of a
+// dropped bucket remain.
+const catalogID = 0
+
+// Names starting with a zero byte are reserved for the buckets of indexes.
+func reservedBucket(name string) bool {
+	return len(name) > 0 && name[0] == 0
+}
+
+// Bucket is a namespace of keys within a store. Its keys don't clash with
+// those of the store or of other buckets, and dropping it deletes them all
+// with one record; merge then reclaims their space. Watch and ChangesSince
+// leave out the keys of buckets; Export writes them with the bucket name.
+type Bucket struct {
+	bc   *BitCask
+	name string
+}
+
+// BucketStats describes the keys of one bucket. KeyBytes is the length of
+// the keys, LiveBytes the size of their records.
+type BucketStats struct {
+	Name      string `json:"name"`
+	Keys      int    `json:"keys"`
+	KeyBytes  int64  `json:"key_bytes"`
+	LiveBytes int64  `json:"live_bytes"`
+}
+
+// buckets maps bucket names to IDs and each bucket to its keydir. The store
+// lock guards it.
+type buckets struct {
+	ids   map[string]uint32
+	names map[uint32]string
+	dirs  map[uint32]*KeyDirs
+	// next is the lowest ID no record uses
+	next uint32
+}
+
+func newBuckets() *buckets {
+	return &buckets{
+		ids:   make(map[string]uint32),
+		names: make(map[uint32]string),
+		dirs:  map[uint32]*KeyDirs{catalogID: NewKeyDirs("")},
+		next:  catalogID + 1,
+	}
+}
+
+func bucketKey(id uint32, key []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen32, binary.MaxVarintLen32+len(key))
+	n := binary.PutUvarint(buf, uint64(id))
+	return append(buf[:n], key...)
+}
+
+// catalogKey is the key naming the bucket id.
+func catalogKey(id uint32, name string) []byte {
+	return bucketKey(catalogID, bucketKey(id, []byte(name)))
+}
+
+func splitBucketKey(key []byte) (uint32, []byte, bool) {
+	id, n := binary.Uvarint(key)
+	if n <= 0 || id > math.MaxUint32 {
+		return 0, nil, false
+	}
+	return uint32(id), key[n:], true
+}
+
+func (bs *buckets) dir(id uint32) *KeyDirs {
+	kd, ok := bs.dirs[id]
+	if !ok {
+		kd = NewKeyDirs("")
+		bs.dirs[id] = kd
+	}
+	return kd
+}
+
+// add names the bucket id and returns whether it did. When a crash lost the
+// drop of a bucket and its name was taken again, the newer ID keeps it.
+func (bs *buckets) add(id uint32, name string) bool {
+	if old, ok := bs.ids[name]; ok && old != id {
+		if old > id {
+			return false
+		}
+		bs.dirs[catalogID].Del(string(catalogKey(old, name)))
+		bs.drop(old)
+	}
+	bs.ids[name] = id
+	bs.names[id] = name
+	bs.dir(id)
+	if id >= bs.next {
+		bs.next = id + 1
+	}
+	return true
+}
+
+func (bs *buckets) drop(id uint32) {
+	if kd, ok := bs.dirs[id]; ok {
+		// a Scan running meanwhile must not find the keys
+		kd.reset()
+	}
+	delete(bs.ids, bs.names[id])
+	delete(bs.names, id)
+	delete(bs.dirs, id)
+}
+
+// lookup returns the ID and keydir of the bucket name, or a nil keydir if
+// it does not exist.
+func (bs *buckets) lookup(name string) (uint32, *KeyDirs) {
+	id, ok := bs.ids[name]
+	if !ok {
+		return 0, nil
+	}
+	return id, bs.dirs[id]
+}
+
+// load returns the keydir of the record with the decrypted key, creating it
+// for buckets not named yet, and keeps the names in step with the catalog.
+// It returns nil for keys it can't split.
+func (bs *buckets) load(key []byte, tombstone bool) *KeyDirs {
+	id, rest, ok := splitBucketKey(key)
+	if !ok {
+		return nil
+	}
+	if id >= bs.next {
+		bs.next = id + 1
+	}
+	if id == catalogID {
+		bid, name, ok := splitBucketKey(rest)
+		if !ok || bid == catalogID {
+			return nil
+		}
+		if tombstone {
+			bs.drop(bid)
+		} else if !bs.add(bid, string(name)) {
+			return nil
+		}
+	}
+	return bs.dir(id)
+}
+
+// prune drops the keys of buckets the catalog doesn't name, left behind
+// when merge removed a bucket's catalog key before the bucket's records.
+func (bs *buckets) prune() {
+	for id, kd := range bs.dirs {
+		if _, ok := bs.names[id]; id == catalogID || ok {
+			continue
+		}
+		log.Printf("Drop %d keys of dropped bucket %d", kd.Len(), id)
+		delete(bs.dirs, id)
+	}
+}
+
+// delWithFileID is KeyDirs.DelWithFileID over every bucket.
+func (bs *buckets) delWithFileID(fileID uint32) int {
+	n := 0
+	for _, kd := range bs.dirs {
+		n += kd.DelWithFileID(fileID)
+	}
+	catalog := bs.dirs[catalogID]
+	for id, name := range bs.names {
+		if catalog.Get(string(catalogKey(id, name))) == nil {
+			bs.drop(id)
+		}
+	}
+	return n
+}
+
+// load adds a record loaded from the log to the keydir it belongs in. key
+// is decrypted and e is nil for a tombstone.
+func (c *BitCask) load(key []byte, flags uint8, e *Entry) {
+	kd := c.keyDirs
+	if flags&FlagBucket != 0 {
+		if kd = c.buckets.load(key, e == nil); kd == nil {
+			return
+		}
+	}
+	if e == nil {
+		kd.Del(string(key))
+	} else {
+		kd.Put(string(key), e)
+	}
+}
+
+// keyDirOf returns the keydir holding the decrypted key of a record with
+// flags, nil if its bucket was dropped.
+func (c *BitCask) keyDirOf(key []byte, flags uint8) *KeyDirs {
+	if flags&FlagBucket == 0 {
+		return c.keyDirs
+	}
+	id, _, ok := splitBucketKey(key)
+	if !ok {
+		return nil
+	}
+	return c.buckets.dirs[id]
+}
+
+// keyDirList returns the keydir of the store followed by those of the
+// buckets, the catalog first.
+func (c *BitCask) keyDirList() []*KeyDirs {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	ids := make([]uint32, 0, len(c.buckets.dirs))
+	for id := range c.buckets.dirs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	dirs := []*KeyDirs{c.keyDirs}
+	for _, id := range ids {
+		dirs = append(dirs, c.buckets.dirs[id])
+	}
+	return dirs
+}
+
+// Bucket returns the bucket name. It is created by its first Put.
+func (c *BitCask) Bucket(name string) *Bucket {
+	return &Bucket{bc: c, name: name}
+}
+
+// Buckets returns the names of every bucket in sorted order.
+func (c *BitCask) Buckets() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	names := make([]string, 0, len(c.buckets.ids))
+	for name := range c.buckets.ids {
+		if !reservedBucket(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DropBucket deletes the bucket name and every key in it.
+func (c *BitCask) DropBucket(name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.readOnly {
+		return ReadOnlyErr
+	}
+	if reservedBucket(name) {
+		return BucketNotFoundErr
+	}
+	return c.dropBucket(name)
+}
+
+func (c *BitCask) dropBucket(name string) error {
+	id, kd := c.buckets.lookup(name)
+	if kd == nil {
+		return BucketNotFoundErr
+	}
+	key := catalogKey(id, name)
+	if err := CheckWriteableFile(c); err != nil {
+		return err
+	}
+	e, err := c.writeFile.WriteWithFlags(key, nil, FlagTombstone|FlagBucket)
+	if err != nil {
+		return err
+	}
+	c.buckets.dirs[catalogID].Del(string(key))
+	c.buckets.drop(id)
+	c.publishBucket(EventDel, key, &e)
+	return nil
+}
+
+// bucketStats returns the stats of the bucket id, whose keydir is kd.
+func bucketStats(name string, id uint32, kd *KeyDirs) *BucketStats {
+	keys := kd.Len()
+	return &BucketStats{
+		Name:      name,
+		Keys:      keys,
+		KeyBytes:  kd.KeyBytes() - int64(keys*len(bucketKey(id, nil))),
+		LiveBytes: kd.LiveBytes(),
+	}
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// create returns the ID and keydir of the bucket, writing its catalog key
+// if it does not exist yet. It must be called under the store lock.
+func (b *Bucket) create() (uint32, *KeyDirs, error) {
+	c := b.bc
+	if b.name == "" || reservedBucket(b.name) {
+		return 0, nil, BucketNameErr
+	}
+	if id, kd := c.buckets.lookup(b.name); kd != nil {
+		return id, kd, nil
+	}
+	id := c.buckets.next
+	if err := CheckWriteableFile(c); err != nil {
+		return 0, nil, err
+	}
+	if err := c.nameBucket(id, b.name); err != nil {
+		return 0, nil, err
+	}
+	return id, c.buckets.dirs[id], nil
+}
+
+// nameBucket writes the catalog key naming the bucket id, which may end a
+// batch of its records.
+func (c *BitCask) nameBucket(id uint32, name string) error {
+	key := catalogKey(id, name)
+	e, err := c.writeFile.WriteWithFlags(key, nil, FlagBucket)
+	if err != nil {
+		return err
+	}
+	c.buckets.dirs[catalogID].Put(string(key), &e)
+	c.buckets.add(id, name)
+	c.publishBucket(EventPut, key, &e)
+	return nil
+}
+
+func (b *Bucket) Put(key, value []byte) error {
+	c := b.bc
+	defer c.metrics.put.since(time.Now())
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	stored, flags, err := c.encodeValue(value, nil)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.readOnly {
+		return ReadOnlyErr
+	}
+	id, kd, err := b.create()
+	if err != nil {
+		return err
+	}
+	key = bucketKey(id, key)
+	if err := CheckWriteableFile(c); err != nil {
+		return err
+	}
+	e, err := c.writeFile.WriteWithFlags(key, stored, flags|FlagBucket)
+	if err != nil {
+		return err
+	}
+	kd.Put(string(key), &e)
+	c.publishBucket(EventPut, key, &e)
+	return nil
+}
+
+func (b *Bucket) Get(key []byte) ([]byte, error) {
+	c := b.bc
+	defer c.metrics.get.since(time.Now())
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	id, kd := c.buckets.lookup(b.name)
+	if kd == nil {
+		return nil, KeyNotFoundErr
+	}
+	value, _, _, err := c.getEntryIn(kd, bucketKey(id, key))
+	return value, err
+}
+
+func (b *Bucket) Del(key []byte) error {
+	c := b.bc
+	defer c.metrics.del.since(time.Now())
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.readOnly {
+		return ReadOnlyErr
+	}
+	id, kd := c.buckets.lookup(b.name)
+	if kd == nil {
+		return KeyNotFoundErr
+	}
+	key = bucketKey(id, key)
+	if _, _, _, err := c.getEntryIn(kd, key); err != nil {
+		return err
+	}
+	if err := CheckWriteableFile(c); err != nil {
+		return err
+	}
+	e, err := c.writeFile.WriteWithFlags(key, nil, FlagTombstone|FlagBucket)
+	if err != nil {
+		return err
+	}
+	kd.Del(string(key))
+	c.publishBucket(EventDel, key, &e)
+	return nil
+}
+
+// Scan calls fn for every key of the bucket starting with prefix in sorted
+// order, stopping at the first error. Keys deleted while scanning are
+// skipped.
+func (b *Bucket) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	c := b.bc
+	c.lock.RLock()
+	id, kd := c.buckets.lookup(b.name)
+	c.lock.RUnlock()
+	if kd == nil {
+		return nil
+	}
+	start := bucketKey(id, nil)
+	keys := kd.Range(string(bucketKey(id, prefix)), "", 0)
+	return c.foldKeysIn(kd, keys, func(key []byte, e *Entry, value []byte, meta *Meta) error {
+		return fn(key[len(start):], value)
+	})
+}
+
+// Stats returns the BucketStats of the bucket, BucketNotFoundErr if it does
+// not exist.
+func (b *Bucket) Stats() (*BucketStats, error) {
+	c := b.bc
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	id, kd := c.buckets.lookup(b.name)
+	if kd == nil {
+		return nil, BucketNotFoundErr
+	}
+	return bucketStats(b.name, id, kd), nil
+}
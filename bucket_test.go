@@ -0,0 +1,146 @@
+package Bitcask
+
+import (
+	"reflect"
+	"testing"
+)
+
+// bucketMap returns every key of the bucket name and its value.
+func bucketMap(t *testing.T, bc *BitCask, name string) map[string]string {
+	t.Helper()
+	m := make(map[string]string)
+	err := bc.Bucket(name).Scan(nil, func(key, value []byte) error {
+		m[string(key)] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("scan %s: %v", name, err)
+	}
+	return m
+}
+
+func TestBucketIsolation(t *testing.T) {
+	dir := t.TempDir()
+	bc := openTest(t, dir)
+	a, b := bc.Bucket("a"), bc.Bucket("b")
+	putTest(t, bc, "k", "store")
+	for _, kv := range []struct {
+		bucket     *Bucket
+		key, value string
+	}{
+		{a, "k", "a"}, {a, "k2", "a2"}, {a, "other", "x"}, {b, "k", "b"},
+	} {
+		if err := kv.bucket.Put([]byte(kv.key), []byte(kv.value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Del([]byte("k2")); err != KeyNotFoundErr {
+		t.Fatalf("delete of a key of another bucket: %v", err)
+	}
+	if err := a.Del([]byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.Bucket("none").Get([]byte("k")); err != KeyNotFoundErr {
+		t.Fatalf("get from a missing bucket: %v", err)
+	}
+	for _, name := range []string{"", "\x00index:x"} {
+		if err := bc.Bucket(name).Put([]byte("k"), []byte("v")); err != BucketNameErr {
+			t.Fatalf("put in bucket %q: %v", name, err)
+		}
+	}
+
+	check := func() {
+		t.Helper()
+		checkStore(t, bc, map[string]string{"k": "store"})
+		if keys := bc.ListKeys(nil, nil, 0); len(keys) != 1 {
+			t.Fatalf("store lists %q", keys)
+		}
+		if got := bucketMap(t, bc, "a"); !reflect.DeepEqual(got, map[string]string{"k": "a", "k2": "a2"}) {
+			t.Fatalf("bucket a holds %v", got)
+		}
+		if got := bucketMap(t, bc, "b"); !reflect.DeepEqual(got, map[string]string{"k": "b"}) {
+			t.Fatalf("bucket b holds %v", got)
+		}
+		var scanned []string
+		bc.Bucket("a").Scan([]byte("k2"), func(key, value []byte) error {
+			scanned = append(scanned, string(key))
+			return nil
+		})
+		if !reflect.DeepEqual(scanned, []string{"k2"}) {
+			t.Fatalf("scan of a with prefix k2 returned %q", scanned)
+		}
+		if names := bc.Buckets(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+			t.Fatalf("buckets %q", names)
+		}
+	}
+	check()
+	bc.Close()
+	bc = openTest(t, dir)
+	defer bc.Close()
+	check()
+	rotateTest(t, bc)
+	if err := NewMerge(bc, 0).Run(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestDropBucket(t *testing.T) {
+	dir := t.TempDir()
+	bc := openTest(t, dir)
+	putTest(t, bc, "k", "store")
+	for i, name := range []string{"gone", "kept"} {
+		for _, key := range []string{"x", "y"} {
+			if err := bc.Bucket(name).Put([]byte(key), []byte{byte('0' + i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := bc.DropBucket("gone"); err != nil {
+		t.Fatalf("drop: %v", err)
+	}
+	if err := bc.DropBucket("gone"); err != BucketNotFoundErr {
+		t.Fatalf("drop twice: %v", err)
+	}
+	if err := bc.DropBucket("\x00index:x"); err != BucketNotFoundErr {
+		t.Fatalf("drop of a reserved bucket: %v", err)
+	}
+	check := func() {
+		t.Helper()
+		if names := bc.Buckets(); !reflect.DeepEqual(names, []string{"kept"}) {
+			t.Fatalf("buckets %q", names)
+		}
+		if _, err := bc.Bucket("gone").Get([]byte("x")); err != KeyNotFoundErr {
+			t.Fatalf("get from a dropped bucket: %v", err)
+		}
+		if got := bucketMap(t, bc, "kept"); len(got) != 2 {
+			t.Fatalf("bucket kept holds %v", got)
+		}
+		checkStore(t, bc, map[string]string{"k": "store"})
+	}
+	check()
+	bc.Close()
+	bc = openTest(t, dir)
+	defer bc.Close()
+	check()
+
+	// merge reclaims the records of the dropped bucket
+	rotateTest(t, bc)
+	before := statsOf(t, bc)
+	if err := NewMerge(bc, 0).Run(); err != nil {
+		t.Fatal(err)
+	}
+	after := statsOf(t, bc)
+	if after.DeadBytes != 0 || after.DataBytes >= before.DataBytes {
+		t.Fatalf("merge left %d of %d data bytes, %d dead", after.DataBytes, before.DataBytes, after.DeadBytes)
+	}
+	check()
+
+	// a bucket created again under the name starts empty
+	if err := bc.Bucket("gone").Put([]byte("z"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if got := bucketMap(t, bc, "gone"); !reflect.DeepEqual(got, map[string]string{"z": "new"}) {
+		t.Fatalf("recreated bucket holds %v", got)
+	}
+}
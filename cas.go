@@ -0,0 +1,56 @@
+package Bitcask
+
+import "time"
+
+// The version of a key is the sequence number of its record, see SeqOf. It
+// changes with every write of the key, and also when merge moves the
+// record, so a compare and swap may fail spuriously but never loses a
+// write.
+
+// GetWithVersion is GetWithMeta also returning the version of key.
+func (c *BitCask) GetWithVersion(key []byte) ([]byte, *Meta, uint64, error) {
+	defer c.metrics.get.since(time.Now())
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	value, meta, e, err := c.getEntry(key)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return value, meta, e.seq(key), nil
+}
+
+// PutIfVersion is PutWithMeta done only if key is still at version. It
+// returns whether the value was written, and KeyNotFoundErr if key is gone.
+func (c *BitCask) PutIfVersion(key, value []byte, meta *Meta, version uint64) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.readOnly {
+		return false, ReadOnlyErr
+	}
+	_, _, e, err := c.getEntry(key)
+	if err != nil {
+		return false, err
+	}
+	if e.seq(key) != version {
+		return false, nil
+	}
+	stored, flags, err := c.encodeValue(value, meta)
+	if err != nil {
+		return false, err
+	}
+	if err := CheckWriteableFile(c); err != nil {
+		return false, err
+	}
+	ne, err := c.write(key, value, stored, flags)
+	if err != nil {
+		return false, err
+	}
+	c.keyDirs.Put(string(key), &ne)
+	c.publish(EventPut, key, value, meta, &ne)
+	return true, nil
+}
@@ -0,0 +1,174 @@
+package Bitcask
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// HistoryFileName holds the Seq of the newest record merge has removed, see
+// ChangesSince.
+const HistoryFileName = "bitcask.history"
+
+// ChangesSince calls fn for every put and delete committed after seq, in
+// commit order, up to the last one committed when it was called. It reads
+// the data files, so unlike Watch it works across restarts and rotations.
+// A consumer saves the Seq of the last event it handled and passes it back
+// on the next call; 0 replays from the start.
+//
+// Merge removes old files together with the changes they held. When some
+// changes after seq are gone ChangesSince returns HistoryUnavailableErr, and
+// the consumer has to reload the current state, for example with Fold, and
+// continue from LastSeq. Records merge copied are not reported as changes,
+// the deletes it writes for expired keys are.
+func (c *BitCask) ChangesSince(seq uint64, fn func(e *Event) error) error {
+	files, sizes, err := c.changeFiles(seq)
+	if err != nil {
+		return err
+	}
+	defer closeFiles(files)
+	for i, fp := range files {
+		if err := replayFile(c.seal, fp, sizes[i], seq, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changeFiles opens the data files that may hold changes after seq. They
+// are opened under the lock, so a merge running meanwhile can't take them
+// away, and the active file is cut at its current end.
+func (c *BitCask) changeFiles(seq uint64) ([]File, []int64, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if seq < c.discarded {
+		return nil, nil, HistoryUnavailableErr
+	}
+	dataFiles, err := ListDataFiles(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	fromID, _ := SplitSeq(seq)
+	var files []File
+	var sizes []int64
+	for _, name := range dataFiles {
+		fileID := FileIDOf(name)
+		if fileID < fromID || fileID > c.writeFile.fileID {
+			continue
+		}
+		fp, err := openRead(c.fs, c.dir+"/"+name)
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, err
+		}
+		files = append(files, fp)
+		size := int64(c.writeFile.offset)
+		if fileID != c.writeFile.fileID {
+			stat, err := fp.Stat()
+			if err != nil {
+				closeFiles(files)
+				return nil, nil, err
+			}
+			size = stat.Size()
+		}
+		sizes = append(sizes, size)
+	}
+	return files, sizes, nil
+}
+
+// replayFile reports the changes after seq in one data file. Like ParseHint
+// it holds back the records of a batch until the batch ends, and drops a
+// batch the file ends in.
+func replayFile(seal *sealer, fp File, size int64, seq uint64, fn func(e *Event) error) error {
+	fileID := FileIDOf(fp.Name())
+	start := int64(0)
+	if id, offset := SplitSeq(seq); id == fileID {
+		// skip to seq when it starts a record, which it does unless it
+		// came from LastSeq on a store without changes
+		if _, err := ReadRecordAt(fp, size, int64(offset)); err == nil {
+			start = int64(offset)
+		}
+	}
+	var pending []*Event
+	err := ReadRecordsFrom(fp, size, start, func(rec *Record) error {
+		e, err := eventOf(seal, fileID, rec)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, e)
+		if rec.Flags&FlagBatch != 0 {
+			return nil
+		}
+		events := pending
+		pending = nil
+		for _, e := range events {
+			if e == nil || e.Seq <= seq {
+				continue
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		log.Printf("Skip %d records of an unfinished batch in %s", len(pending), fp.Name())
+	}
+	return nil
+}
+
+// eventOf returns the change rec made, or nil for records that are not a
+// change: merge copies and the old delete records without a key. Changes
+// within buckets are not reported either.
+//
+// A tombstone merge wrote for an expired key is a delete: merge writes it
+// before it removes the put, so a consumer that can still read it may
+// have seen that put.
+func eventOf(seal *sealer, fileID uint32, rec *Record) (*Event, error) {
+	if rec.Flags&FlagBucket != 0 || len(rec.Key) == 0 {
+		return nil, nil
+	}
+	if rec.Flags&FlagMerged != 0 && !rec.IsTombstone() {
+		return nil, nil
+	}
+	rec, err := seal.plain(rec)
+	if err != nil {
+		return nil, err
+	}
+	e := &Event{
+		Seq:  SeqOf(fileID, uint64(rec.Offset)),
+		Type: EventPut,
+		Key:  rec.Key,
+	}
+	if rec.IsTombstone() {
+		e.Type = EventDel
+		return e, nil
+	}
+	value, meta, err := DecodeValue(rec.Value, rec.Flags)
+	if err != nil {
+		return nil, &RecordError{rec.Offset, err}
+	}
+	e.Value = value
+	e.Meta = meta
+	return e, nil
+}
+
+func readHistoryFloor(fs FileSystem, dir string) (uint64, error) {
+	buf, err := readFile(fs, dir+"/"+HistoryFileName)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+}
+
+func writeHistoryFloor(fs FileSystem, dir string, seq uint64) error {
+	return writeFileAtomic(fs, dir+"/"+HistoryFileName, []byte(strconv.FormatUint(seq, 10)+"\n"))
+}
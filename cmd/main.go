@@ -2,47 +2,428 @@ package main
 
 import (
 	"Bitcask"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+var (
+	storagePath string
+	maxSize     uint64
+	compress    bool
+	keysPath    string
+	keyID       uint
+)
+
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"get", "key", "print the value of key", get},
+		{"put", "key [value]", "set key to value, read from stdin if omitted", put},
+		{"del", "key", "delete key", del},
+		{"scan", "[-prefix p] [-keys]", "print every key and value, optionally under a prefix", scan},
+		{"stats", "", "print key counts and data file sizes", stats},
+		{"merge", "", "merge old data files into the active one", merge},
+		{"verify", "", "check every record and hint, print a JSON report", verify},
+		{"repair", "[-force]", "salvage damaged data files and regenerate hints", repair},
+		{"dump", "[-format jsonl|binary] [-o file]", "export every key to file or stdout", dump},
+		{"load", "[-format jsonl|binary] [file]", "import keys from file or stdin", load},
+		{"inspect-file", "file", "decode every record of a .data or .hint file", inspectFile},
+	}
+}
+
 func main() {
-	os.RemoveAll("Storage")
-	bc, err := Bitcask.Open("Storage", nil)
+	log.SetFlags(0)
+	flag.StringVar(&storagePath, "s", "Storage", "data storage path")
+	flag.Uint64Var(&maxSize, "ms", 0, "single data file maxsize, 0 for the default")
+	flag.BoolVar(&compress, "z", false, "compress values written with flate")
+	flag.StringVar(&keysPath, "keys", os.Getenv("BITCASK_KEYS"), "file of encryption keys, one \"id hexkey\" per line (env BITCASK_KEYS)")
+	flag.UintVar(&keyID, "key-id", 0, "ID of the key new records are encrypted with, the highest if 0")
+	flag.Usage = usage
+	flag.Parse()
+
+	name := flag.Arg(0)
+	for _, c := range commands {
+		if c.name == name {
+			if err := c.run(flag.Args()[1:]); err != nil {
+				log.Fatalln(err)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s [-s path] [options] command [args]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-14s %-34s %s\n", c.name, c.args, c.usage)
+	}
+	fmt.Fprintln(w)
+	flag.PrintDefaults()
+}
+
+// withStore opens the store for the duration of fn. The store lock makes
+// this fail while a server or another command is using the directory.
+func withStore(fn func(bc *Bitcask.BitCask) error) error {
+	opt, err := storeOptions()
+	if err != nil {
+		return err
+	}
+	bc, err := Bitcask.Open(storagePath, opt)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s is in use: %s", storagePath, lockOwner())
+	}
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+	return fn(bc)
+}
+
+// storeOptions builds the Options of the store from the flags. Merge runs
+// only on request, as a command.
+func storeOptions() (*Bitcask.Options, error) {
+	opt := Bitcask.NewOptions(0, maxSize, -1, 0, true)
+	if compress {
+		opt.Compression = Bitcask.FlateCodec{}
+	}
+	if keysPath != "" {
+		keys, err := loadKeys(keysPath, uint32(keyID))
+		if err != nil {
+			return nil, err
+		}
+		opt.Encryption = keys
+	}
+	return opt, nil
+}
+
+// loadKeys reads a key file: one key ID and hex encoded AES key per line,
+// blank lines and lines starting with # skipped.
+func loadKeys(path string, current uint32) (*Bitcask.StaticKeys, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := &Bitcask.StaticKeys{Keys: make(map[uint32][]byte)}
+	for i, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"id hexkey\"", path, i+1)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("%s:%d: bad key id %q", path, i+1, fields[0])
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+		keys.Keys[uint32(id)] = key
+		if current == 0 && uint32(id) > keys.Current {
+			keys.Current = uint32(id)
+		}
+	}
+	if current != 0 {
+		keys.Current = current
+	}
+	if len(keys.Keys) == 0 {
+		return nil, fmt.Errorf("%s holds no keys", path)
+	}
+	return keys, nil
+}
+
+// lockOwner describes the process holding the lock file, or "" if unlocked.
+func lockOwner() string {
+	buf, err := ioutil.ReadFile(storagePath + "/" + Bitcask.LockFileName)
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(string(buf))
+	if len(fields) != 2 {
+		return Bitcask.LockFileName + " exists"
+	}
+	return fmt.Sprintf("locked by pid %s writing %s", fields[0], fields[1])
+}
+
+func needArgs(args []string, n int, name string) error {
+	if len(args) != n {
+		return fmt.Errorf("usage: %s", name)
+	}
+	return nil
+}
+
+func get(args []string) error {
+	if err := needArgs(args, 1, "get key"); err != nil {
+		return err
+	}
+	return withStore(func(bc *Bitcask.BitCask) error {
+		value, err := bc.Get([]byte(args[0]))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(value)
+		return err
+	})
+}
+
+func put(args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("usage: put key [value]")
+	}
+	var value []byte
+	if len(args) == 2 {
+		value = []byte(args[1])
+	} else {
+		var err error
+		value, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+	}
+	return withStore(func(bc *Bitcask.BitCask) error {
+		return bc.Put([]byte(args[0]), value)
+	})
+}
+
+func del(args []string) error {
+	if err := needArgs(args, 1, "del key"); err != nil {
+		return err
+	}
+	return withStore(func(bc *Bitcask.BitCask) error {
+		return bc.Del([]byte(args[0]))
+	})
+}
+
+func scan(args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "only keys starting with prefix")
+	keysOnly := fs.Bool("keys", false, "print keys only")
+	fs.Parse(args)
+
+	return withStore(func(bc *Bitcask.BitCask) error {
+		return bc.Scan([]byte(*prefix), func(key, value []byte) error {
+			if *keysOnly {
+				_, err := fmt.Printf("%s\n", key)
+				return err
+			}
+			_, err := fmt.Printf("%s\t%s\n", key, value)
+			return err
+		})
+	})
+}
+
+func stats(args []string) error {
+	return withStore(func(bc *Bitcask.BitCask) error {
+		s, err := bc.Stats()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("keys\t%d\n", s.Keys)
+		fmt.Printf("data_files\t%d\n", s.DataFiles)
+		fmt.Printf("data_bytes\t%d\n", s.DataBytes)
+		fmt.Printf("live_bytes\t%d\n", s.LiveBytes)
+		fmt.Printf("dead_bytes\t%d\n", s.DeadBytes)
+		fmt.Printf("keydir_bytes\t%d\n", s.KeydirBytes)
+		fmt.Printf("active_file\t%d.data\t%d\n", s.ActiveFileID, s.ActiveOffset)
+		for _, f := range s.Files {
+			fmt.Printf("file\t%d.data\t%d\t%.2f\t%d\t%s\n", f.ID, f.Size, f.LiveRatio, f.Records,
+				f.CreatedAt.Format(time.RFC3339))
+		}
+		return nil
+	})
+}
+
+func merge(args []string) error {
+	return withStore(func(bc *Bitcask.BitCask) error {
+		return Bitcask.NewMerge(bc, 0).Run()
+	})
+}
+
+func verify(args []string) error {
+	report, err := Bitcask.Verify(storagePath)
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(report, "", "  ")
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	k1 := []byte("key1")
-	v1 := []byte("val1")
+	fmt.Println(string(buf))
+	if !report.OK {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func repair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	force := fs.Bool("force", false, "repair even though the lock file exists, and remove it")
+	fs.Parse(args)
 
-	k2 := []byte("key2")
-	v2 := []byte("val2")
+	owner := lockOwner()
+	if owner != "" && !*force {
+		return fmt.Errorf("%s is in use: %s, use -force if that process is gone", storagePath, owner)
+	}
+	report, err := Bitcask.Repair(nil, storagePath)
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(buf))
+	if owner != "" {
+		return os.Remove(storagePath + "/" + Bitcask.LockFileName)
+	}
+	return nil
+}
 
-	bc.Put(k1, v1)
-	bc.Put(k2, v2)
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	format := fs.String("format", "jsonl", "dump format: jsonl or binary")
+	out := fs.String("o", "", "output file, stdout if empty")
+	fs.Parse(args)
 
-	v1, err = bc.Get(k1)
-	v2, err = bc.Get(k2)
-	log.Printf("key : %s, value : %s", string(k1), string(v1))
-	log.Printf("key : %s, value : %s", string(k2), string(v2))
+	f, err := Bitcask.ParseDumpFormat(*format)
+	if err != nil {
+		return err
+	}
+	// the output is only created once the store is open, and removed if the
+	// dump fails
+	return withStore(func(bc *Bitcask.BitCask) error {
+		if *out == "" {
+			return bc.Export(os.Stdout, f)
+		}
+		fp, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		err = bc.Export(fp, f)
+		if cerr := fp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(*out)
+		}
+		return err
+	})
+}
 
-	bc.Put(k1, []byte("another v1"))
-	bc.Del(k2)
-	v1, err = bc.Get(k1)
-	v2, err = bc.Get(k2)
-	log.Printf("key : %s, value : %s", string(k1), string(v1))
-	log.Printf("key : %s, value : %s", string(k2), string(v2))
+func load(args []string) error {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	format := fs.String("format", "jsonl", "dump format: jsonl or binary")
+	fs.Parse(args)
 
-	bc.Close()
+	f, err := Bitcask.ParseDumpFormat(*format)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if fs.Arg(0) != "" {
+		fp, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		r = fp
+	}
+	return withStore(func(bc *Bitcask.BitCask) error {
+		return bc.Import(r, f)
+	})
+}
 
-	bc, err = Bitcask.Open("Storage", nil)
+// inspectFile decodes records one header at a time instead of using
+// ReadRecords, so damaged records are printed rather than ending the scan.
+func inspectFile(args []string) error {
+	if err := needArgs(args, 1, "inspect-file file"); err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(args[0])
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	defer bc.Close()
+	switch {
+	case strings.HasSuffix(args[0], ".data"):
+		inspectData(buf)
+	case strings.HasSuffix(args[0], ".hint"):
+		inspectHint(buf)
+	default:
+		return fmt.Errorf("%s is neither a .data nor a .hint file", args[0])
+	}
+	return nil
+}
 
-	v1, err = bc.Get(k1)
-	v2, err = bc.Get(k2)
-	log.Printf("key : %s, value : %s", string(k1), string(v1))
-	log.Printf("key : %s, value : %s", string(k2), string(v2))
+func inspectData(buf []byte) {
+	fmt.Println("offset\ttstamp\tflags\tksz\tvsz\tcrc\tkey")
+	offset := 0
+	for offset+Bitcask.HeaderSize <= len(buf) {
+		header := buf[offset : offset+Bitcask.HeaderSize]
+		_, tStamp, keySize, valueSize, err := Bitcask.DecodeEntryHeader(header)
+		if err != nil {
+			fmt.Printf("%d\t%v\n", offset, err)
+			return
+		}
+		end := offset + Bitcask.HeaderSize + int(keySize) + int(valueSize)
+		if end > len(buf) {
+			fmt.Printf("%d\t%d\t%d\t%d\t%d\ttruncated\n", offset, tStamp, Bitcask.EntryFlags(header), keySize, valueSize)
+			return
+		}
+		crc := "ok"
+		if _, err := Bitcask.DecodeEntry(buf[offset:end]); err != nil {
+			crc = "BAD"
+		}
+		key := buf[offset+Bitcask.HeaderSize : offset+Bitcask.HeaderSize+int(keySize)]
+		fmt.Printf("%d\t%d\t%d\t%d\t%d\t%s\t%q\n", offset, tStamp, Bitcask.EntryFlags(header), keySize, valueSize, crc, key)
+		offset = end
+	}
+	if offset != len(buf) {
+		fmt.Printf("%d\t%d trailing bytes\n", offset, len(buf)-offset)
+	}
+}
+
+func inspectHint(buf []byte) {
+	fmt.Println("offset\ttstamp\tflags\tksz\tvsz\tvaluePos\tkey")
+	offset := 0
+	for offset+Bitcask.HintHeaderSize <= len(buf) {
+		header := buf[offset : offset+Bitcask.HintHeaderSize]
+		tStamp, keySize, valueSize, valuePos, err := Bitcask.DecodeHint(header)
+		if err != nil {
+			fmt.Printf("%d\t%v\n", offset, err)
+			return
+		}
+		end := offset + Bitcask.HintHeaderSize + int(keySize)
+		if end > len(buf) {
+			fmt.Printf("%d\t%d\t%d\t%d\t%d\t%d\ttruncated\n", offset, tStamp, Bitcask.HintFlags(header), keySize, valueSize, valuePos)
+			return
+		}
+		key := buf[offset+Bitcask.HintHeaderSize : end]
+		fmt.Printf("%d\t%d\t%d\t%d\t%d\t%d\t%q\n", offset, tStamp, Bitcask.HintFlags(header), keySize, valueSize, valuePos, key)
+		offset = end
+	}
+	if offset != len(buf) {
+		fmt.Printf("%d\t%d trailing bytes\n", offset, len(buf)-offset)
+	}
 }
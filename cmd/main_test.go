@@ -0,0 +1,177 @@
+package main
+
+import (
+	"Bitcask"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the tool instead of the tests when cli re-executes the test
+// binary.
+func TestMain(m *testing.M) {
+	if os.Getenv("BITCASK_CLI_TEST") == "1" {
+		os.Args = append([]string{"bitcask"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// cli runs the tool with args and stdin, returning its stdout, its stderr
+// and its exit code.
+func cli(t *testing.T, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "BITCASK_CLI_TEST=1", "BITCASK_KEYS=")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	code := 0
+	if exit, ok := err.(*exec.ExitError); ok {
+		code = exit.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), code
+}
+
+// run is cli failing unless the tool succeeds.
+func run(t *testing.T, stdin string, args ...string) string {
+	t.Helper()
+	stdout, stderr, code := cli(t, stdin, args...)
+	if code != 0 {
+		t.Fatalf("%q exited with %d: %s", args, code, stderr)
+	}
+	return stdout
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	run(t, "", "-s", dir, "put", "a", "1")
+	run(t, "from stdin", "-s", dir, "put", "b")
+	run(t, "", "-s", dir, "put", "c", "3")
+	run(t, "", "-s", dir, "del", "c")
+	if out := run(t, "", "-s", dir, "get", "b"); out != "from stdin" {
+		t.Fatalf("get b printed %q", out)
+	}
+	if _, stderr, code := cli(t, "", "-s", dir, "get", "c"); code != 1 || !strings.Contains(stderr, "Not found") {
+		t.Fatalf("get of a deleted key exited with %d: %s", code, stderr)
+	}
+	if out := run(t, "", "-s", dir, "scan"); out != "a\t1\nb\tfrom stdin\n" {
+		t.Fatalf("scan printed %q", out)
+	}
+	if out := run(t, "", "-s", dir, "scan", "-prefix", "b", "-keys"); out != "b\n" {
+		t.Fatalf("scan -prefix b -keys printed %q", out)
+	}
+	if out := run(t, "", "-s", dir, "stats"); !strings.HasPrefix(out, "keys\t2\n") {
+		t.Fatalf("stats printed %q", out)
+	}
+	run(t, "", "-s", dir, "merge")
+	if out := run(t, "", "-s", dir, "verify"); !strings.Contains(out, `"ok": true`) {
+		t.Fatalf("verify printed %q", out)
+	}
+	for _, args := range [][]string{{"nope"}, {"export"}, {}} {
+		if _, _, code := cli(t, "", append([]string{"-s", dir}, args...)...); code != 2 {
+			t.Fatalf("%q exited with %d", args, code)
+		}
+	}
+	if _, _, code := cli(t, "", "-s", dir, "get"); code != 1 {
+		t.Fatalf("get without a key exited with %d", code)
+	}
+}
+
+func TestDumpLoad(t *testing.T) {
+	dir := t.TempDir()
+	run(t, "", "-s", dir, "put", "a", "1")
+	run(t, "", "-s", dir, "put", "\xff", "binary")
+	for _, format := range []string{"jsonl", "binary"} {
+		out := filepath.Join(t.TempDir(), "dump")
+		run(t, "", "-s", dir, "dump", "-format", format, "-o", out)
+		restored := t.TempDir()
+		run(t, "", "-s", restored, "load", "-format", format, out)
+		if got := run(t, "", "-s", restored, "scan"); got != "a\t1\n\xff\tbinary\n" {
+			t.Fatalf("%s: restored store holds %q", format, got)
+		}
+		stdout := run(t, "", "-s", dir, "dump", "-format", format)
+		restored = t.TempDir()
+		run(t, stdout, "-s", restored, "load", "-format", format)
+		if got := run(t, "", "-s", restored, "get", "\xff"); got != "binary" {
+			t.Fatalf("%s: restored from stdin %q", format, got)
+		}
+	}
+}
+
+func TestDumpLockedStore(t *testing.T) {
+	dir := t.TempDir()
+	run(t, "", "-s", dir, "put", "a", "1")
+	bc, err := Bitcask.Open(dir, Bitcask.NewOptions(0, 0, -1, 0, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	out := filepath.Join(t.TempDir(), "dump")
+	_, stderr, code := cli(t, "", "-s", dir, "dump", "-o", out)
+	if code != 1 || !strings.Contains(stderr, "is in use: locked by pid") {
+		t.Fatalf("dump of a store in use exited with %d: %s", code, stderr)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("failed dump left %s behind: %v", out, err)
+	}
+}
+
+func TestStoreOptions(t *testing.T) {
+	dir := t.TempDir()
+	keys := filepath.Join(t.TempDir(), "keys")
+	err := ioutil.WriteFile(keys, []byte("# test keys\n1 "+strings.Repeat("01", 32)+"\n\n2 "+strings.Repeat("02", 16)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("compressible secret ", 100)
+	run(t, value, "-s", dir, "-z", "-keys", keys, "-ms", "4096", "put", "k")
+	files, _ := filepath.Glob(filepath.Join(dir, "*.data"))
+	for _, name := range files {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(buf, []byte("secret")) || len(buf) >= len(value) {
+			t.Fatalf("%s holds %d bytes, in the clear or uncompressed", name, len(buf))
+		}
+	}
+	if _, _, code := cli(t, "", "-s", dir, "get", "k"); code != 1 {
+		t.Fatalf("get without the keys exited with %d", code)
+	}
+	if got := run(t, "", "-s", dir, "-keys", keys, "-key-id", "1", "get", "k"); got != value {
+		t.Fatalf("get with the keys printed %d bytes", len(got))
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	write := func(s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# comment\n3 0102\n  7 ff00 \n")
+	keys, err := loadKeys(path, 0)
+	if err != nil || keys.Current != 7 || len(keys.Keys) != 2 || !bytes.Equal(keys.Keys[3], []byte{1, 2}) {
+		t.Fatalf("loaded %+v, %v", keys, err)
+	}
+	if keys, err := loadKeys(path, 3); err != nil || keys.Current != 3 {
+		t.Fatalf("loaded %+v, %v with key 3 current", keys, err)
+	}
+	for _, bad := range []string{"", "# only a comment\n", "0 0102\n", "1 zz\n", "1\n", "1 01 02\n"} {
+		write(bad)
+		if _, err := loadKeys(path, 0); err == nil {
+			t.Fatalf("loaded %q", bad)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package Bitcask
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+var UnknownCodecErr = fmt.Errorf("Unknown codec ")
+
+// Codec compresses values, see Options.Compression. Its ID is stored in the
+// flags of every record it compressed, so it must never change, and the
+// codec must be registered with RegisterCodec wherever such records are
+// read.
+type Codec interface {
+	// ID is between 1 and MaxCodecID.
+	ID() uint8
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+// MaxCodecID is the largest ID the record flags can hold.
+const MaxCodecID = 3
+
+var (
+	codecsLock = &sync.RWMutex{}
+	codecs     = map[uint8]Codec{}
+)
+
+func init() {
+	RegisterCodec(FlateCodec{})
+}
+
+// RegisterCodec makes the records c compressed readable. It panics if the
+// ID is out of range or taken by another codec.
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	id := c.ID()
+	if id == 0 || id > MaxCodecID {
+		panic(fmt.Sprintf("codec ID %d is not between 1 and %d", id, MaxCodecID))
+	}
+	if _, ok := codecs[id]; ok {
+		panic(fmt.Sprintf("codec ID %d is registered twice", id))
+	}
+	codecs[id] = c
+}
+
+func codecOf(id uint8) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	c, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("%vID %d", UnknownCodecErr, id)
+	}
+	return c, nil
+}
+
+// FlateCodec compresses with DEFLATE at Level, flate.DefaultCompression if
+// 0. It is registered as ID 1 whatever its Level.
+type FlateCodec struct {
+	Level int
+}
+
+func (FlateCodec) ID() uint8 {
+	return 1
+}
+
+// flateWriters pools writers by level, as each takes hundreds of KB.
+var flateWriters sync.Map
+
+func (c FlateCodec) Compress(src []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	var buf bytes.Buffer
+	p, _ := flateWriters.LoadOrStore(level, &sync.Pool{})
+	pool := p.(*sync.Pool)
+	w, _ := pool.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(&buf, level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&buf)
+	}
+	defer pool.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress fails with a *SizeError rather than inflate a value beyond
+// MaxValueSize.
+func (FlateCodec) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+
+	return readAllLimited(r, MaxValueSize)
+}
+
+func readAllLimited(r io.Reader, limit uint64) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(buf)) > limit {
+		return nil, &SizeError{"decompressed value", uint64(len(buf)), limit}
+	}
+	return buf, nil
+}
+
+// compress returns stored compressed with the codec of the options and the
+// flags saying so, or stored as is if it is short or doesn't shrink.
+func (c *BitCask) compress(stored []byte, flags uint8) ([]byte, uint8, error) {
+	codec := c.options.Compression
+	if codec == nil || len(stored) < c.options.CompressMinSize {
+		return stored, flags, nil
+	}
+	compressed, err := codec.Compress(stored)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(compressed) >= len(stored) {
+		return stored, flags, nil
+	}
+	return compressed, flags | codec.ID()<<codecShift, nil
+}
+
+// encodeValue is EncodeValue followed by compress.
+func (c *BitCask) encodeValue(value []byte, meta *Meta) ([]byte, uint8, error) {
+	stored, flags, err := EncodeValue(value, meta)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c.compress(stored, flags)
+}
+
+// decompress undoes what the codec in flags did to stored.
+func decompress(stored []byte, flags uint8) ([]byte, error) {
+	id := (flags & CodecFlags) >> codecShift
+	if id == 0 {
+		return stored, nil
+	}
+	codec, err := codecOf(id)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decompress(stored)
+}
@@ -0,0 +1,89 @@
+package Bitcask
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestFlateRoundTrip(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	for _, level := range []int{0, 1, 9} {
+		c := FlateCodec{Level: level}
+		for _, value := range [][]byte{{}, []byte("x"), bytes.Repeat([]byte("value"), 1000), random} {
+			compressed, err := c.Compress(value)
+			if err != nil {
+				t.Fatalf("level %d: compress: %v", level, err)
+			}
+			got, err := c.Decompress(compressed)
+			if err != nil || !bytes.Equal(got, value) {
+				t.Fatalf("level %d: round trip of %d bytes gave %d bytes, %v", level, len(value), len(got), err)
+			}
+		}
+	}
+	if _, err := readAllLimited(bytes.NewReader(make([]byte, 11)), 10); err == nil {
+		t.Fatal("read beyond the limit")
+	}
+}
+
+// otherCodec is never registered.
+type otherCodec struct{ FlateCodec }
+
+func (otherCodec) ID() uint8 {
+	return 2
+}
+
+func TestUnknownCodec(t *testing.T) {
+	opt := testOptions()
+	opt.Compression = otherCodec{}
+	if _, err := Open(t.TempDir(), opt); err == nil || !strings.HasPrefix(err.Error(), UnknownCodecErr.Error()) {
+		t.Fatalf("open with an unregistered codec: %v", err)
+	}
+	if _, err := decompress([]byte("x"), otherCodec{}.ID()<<codecShift); err == nil {
+		t.Fatal("decompressed with an unregistered codec")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	long := strings.Repeat("compressible ", 100)
+	want := map[string]string{"plain": long, "short": "v"}
+	bc := openTest(t, dir)
+	putTest(t, bc, "plain", long, "short", "v")
+	bc.Close()
+
+	// records written before compression was enabled stay readable
+	opt := testOptions()
+	opt.Compression = FlateCodec{}
+	bc, err := Open(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := statsOf(t, bc).DataBytes
+	putTest(t, bc, "compressed", long)
+	want["compressed"] = long
+	if grew := statsOf(t, bc).DataBytes - before; grew >= int64(len(long)) {
+		t.Fatalf("a %d byte value took %d bytes", len(long), grew)
+	}
+	meta := &Meta{ContentType: "text/plain", Flags: 7}
+	if err := bc.PutWithMeta([]byte("meta"), []byte(long), meta); err != nil {
+		t.Fatal(err)
+	}
+	if value, got, err := bc.GetWithMeta([]byte("meta")); err != nil || string(value) != long || *got != *meta {
+		t.Fatalf("meta of a compressed value %+v, %v", got, err)
+	}
+	bc.Del([]byte("meta"))
+	checkStore(t, bc, want)
+	bc.Close()
+
+	// and the compressed ones once it is disabled again, merged or not
+	bc = openTest(t, dir)
+	defer bc.Close()
+	checkStore(t, bc, want)
+	if err := NewMerge(bc, 0).Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkStore(t, bc, want)
+}
@@ -0,0 +1,627 @@
+package Bitcask
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// crashFS is a FileSystem that loses power on demand. Creating, removing
+// and renaming files is durable at once, as on a journaling file system,
+// but written data only reaches the disk when its file is synced. crash
+// returns what the disk holds after a power cut: data not yet synced is
+// dropped, cut short or partly applied out of order.
+type crashFS struct {
+	lock    *sync.Mutex
+	live    *MemFS
+	durable *MemFS
+	// pending holds the writes and truncates of each file since its last
+	// sync, in order
+	pending map[string][]pendingOp
+}
+
+type pendingOp struct {
+	off  int64
+	data []byte
+	// truncate makes the op a truncate to off
+	truncate bool
+}
+
+func newCrashFS(disk *MemFS) *crashFS {
+	return &crashFS{
+		lock:    &sync.Mutex{},
+		live:    disk.Clone(),
+		durable: disk.Clone(),
+		pending: make(map[string][]pendingOp),
+	}
+}
+
+func (fs *crashFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	f, err := fs.live.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_CREATE != 0 || flag&os.O_TRUNC != 0 {
+		// creating and truncating on open are metadata, durable at once
+		df, err := fs.durable.OpenFile(name, flag&^os.O_EXCL, perm)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		df.Close()
+		if flag&os.O_TRUNC != 0 {
+			delete(fs.pending, name)
+		}
+	}
+	return &crashFile{File: f, fs: fs, name: name}, nil
+}
+
+func (fs *crashFS) Stat(name string) (os.FileInfo, error) {
+	return fs.live.Stat(name)
+}
+
+func (fs *crashFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if err := fs.live.Remove(name); err != nil {
+		return err
+	}
+	fs.durable.Remove(name)
+	delete(fs.pending, name)
+	return nil
+}
+
+func (fs *crashFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if err := fs.live.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	fs.durable.Rename(oldpath, newpath)
+	fs.pending[newpath] = fs.pending[oldpath]
+	delete(fs.pending, oldpath)
+	return nil
+}
+
+func (fs *crashFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := fs.live.MkdirAll(path, perm); err != nil {
+		return err
+	}
+	return fs.durable.MkdirAll(path, perm)
+}
+
+func (fs *crashFS) ReadDirNames(dir string) ([]string, error) {
+	return fs.live.ReadDirNames(dir)
+}
+
+// crash returns the disk after a power cut now. fs must not be used after.
+func (fs *crashFS) crash(rnd *rand.Rand) *MemFS {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	disk := fs.durable.Clone()
+	names := make([]string, 0, len(fs.pending))
+	for name := range fs.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ops := fs.pending[name]
+		switch rnd.Intn(3) {
+		case 0:
+			// nothing reached the disk
+			ops = nil
+		case 1:
+			// a prefix did, the last op of it torn
+			ops = append([]pendingOp{}, ops[:rnd.Intn(len(ops)+1)]...)
+			if n := len(ops); n > 0 && !ops[n-1].truncate {
+				ops[n-1].data = ops[n-1].data[:rnd.Intn(len(ops[n-1].data)+1)]
+			}
+		case 2:
+			// any subset did, in any order
+			var some []pendingOp
+			for _, i := range rnd.Perm(len(ops)) {
+				if rnd.Intn(2) == 0 {
+					some = append(some, ops[i])
+				}
+			}
+			ops = some
+		}
+		f, err := disk.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			continue
+		}
+		for _, op := range ops {
+			applyOp(f, op)
+		}
+		f.Close()
+	}
+	return disk
+}
+
+func applyOp(f File, op pendingOp) {
+	if op.truncate {
+		f.Truncate(op.off)
+	} else {
+		f.WriteAt(op.data, op.off)
+	}
+}
+
+type crashFile struct {
+	File
+	fs     *crashFS
+	name   string
+	offset int64
+}
+
+func (f *crashFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *crashFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	n, err := f.File.WriteAt(p, off)
+	if n > 0 {
+		op := pendingOp{off: off, data: append([]byte{}, p[:n]...)}
+		f.fs.pending[f.name] = append(f.fs.pending[f.name], op)
+	}
+	return n, err
+}
+
+func (f *crashFile) Truncate(size int64) error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.File.Truncate(size); err != nil {
+		return err
+	}
+	f.fs.pending[f.name] = append(f.fs.pending[f.name], pendingOp{off: size, truncate: true})
+	return nil
+}
+
+func (f *crashFile) Sync() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	df, err := f.fs.durable.OpenFile(f.name, os.O_RDWR, 0)
+	if err != nil {
+		// removed since it was opened
+		return nil
+	}
+	defer df.Close()
+	for _, op := range f.fs.pending[f.name] {
+		applyOp(df, op)
+	}
+	delete(f.fs.pending, f.name)
+	return nil
+}
+
+// crashModel tracks what a key may hold after a crash: the value it had at
+// the last sync, or any value written since. Absent stands for a deleted
+// key.
+type crashModel struct {
+	synced  map[string]string
+	current map[string]string
+	since   map[string]map[string]bool
+}
+
+const absent = "\x00absent"
+
+func newCrashModel(state map[string]string) *crashModel {
+	m := &crashModel{
+		synced:  make(map[string]string),
+		current: make(map[string]string),
+		since:   make(map[string]map[string]bool),
+	}
+	for k, v := range state {
+		m.synced[k] = v
+		m.current[k] = v
+	}
+	return m
+}
+
+func (m *crashModel) get(key string) string {
+	if v, ok := m.current[key]; ok {
+		return v
+	}
+	return absent
+}
+
+func (m *crashModel) wrote(key, value string) {
+	if value == absent {
+		delete(m.current, key)
+	} else {
+		m.current[key] = value
+	}
+	m.maybe(key, value)
+}
+
+// maybe records a write that failed, which may still be found after a
+// crash.
+func (m *crashModel) maybe(key, value string) {
+	if m.since[key] == nil {
+		m.since[key] = make(map[string]bool)
+	}
+	m.since[key][value] = true
+}
+
+func (m *crashModel) sync() {
+	m.synced = make(map[string]string)
+	for k, v := range m.current {
+		m.synced[k] = v
+	}
+	m.since = make(map[string]map[string]bool)
+}
+
+// allowed says whether key may hold value after a crash.
+func (m *crashModel) allowed(key, value string) bool {
+	synced, ok := m.synced[key]
+	if !ok {
+		synced = absent
+	}
+	return value == synced || m.since[key][value]
+}
+
+const crashDir = "/db"
+
+const crashKeys = 24
+
+// crashBuckets are where keys go, "" standing for outside any bucket. The
+// model names a key of a bucket bucket/key.
+var crashBuckets = []string{"", "x", "y"}
+
+// crashIndex finds a value under the generation that wrote it, and every
+// value under "all".
+func crashIndex(key, value []byte) [][]byte {
+	gen := value[:bytes.IndexByte(value, '-')]
+	return [][]byte{gen, []byte("all")}
+}
+
+// checkIndex checks that the index lists exactly the keys outside buckets
+// holding a term.
+func checkIndex(bc *BitCask) error {
+	want := make(map[string][]string)
+	for _, name := range crashNames() {
+		if strings.Contains(name, "/") {
+			continue
+		}
+		value, err := bc.Get([]byte(name))
+		if err == KeyNotFoundErr {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, term := range crashIndex([]byte(name), value) {
+			want[string(term)] = append(want[string(term)], name)
+		}
+	}
+	for _, term := range []string{"0", "1", "2", "3", "all"} {
+		keys, err := bc.Index("gen").Get([]byte(term))
+		if err != nil {
+			return fmt.Errorf("index %s: %v", term, err)
+		}
+		var got []string
+		for _, k := range keys {
+			got = append(got, string(k))
+		}
+		sort.Strings(want[term])
+		if strings.Join(got, ",") != strings.Join(want[term], ",") {
+			return fmt.Errorf("index %s lists %v, want %v", term, got, want[term])
+		}
+	}
+	return nil
+}
+
+func crashNames() []string {
+	var names []string
+	for _, b := range crashBuckets {
+		for i := 0; i < crashKeys; i++ {
+			names = append(names, crashName(b, fmt.Sprintf("key-%d", i)))
+		}
+	}
+	return names
+}
+
+func crashName(bucket, key string) string {
+	if bucket == "" {
+		return key
+	}
+	return bucket + "/" + key
+}
+
+func crashGet(bc *BitCask, name string) ([]byte, error) {
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		return bc.Bucket(name[:i]).Get([]byte(name[i+1:]))
+	}
+	return bc.Get([]byte(name))
+}
+
+// crashList returns the names of every key the store lists.
+func crashList(bc *BitCask) (map[string]bool, error) {
+	names := make(map[string]bool)
+	for _, k := range bc.Keys() {
+		names[string(k)] = true
+	}
+	for _, b := range crashBuckets[1:] {
+		err := bc.Bucket(b).Scan(nil, func(key, value []byte) error {
+			names[crashName(b, string(key))] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// runCrash drives a random workload over a few power cuts, checking after
+// each that the store reopens with nothing synced lost and nothing deleted
+// back. It returns the first violation.
+//
+// The disk may also go bad partway through a generation: syncs fail, or a
+// write fails and what it left can't be cut off. A sync that fails loses
+// nothing acknowledged, while a write that fails may or may not be found
+// after the crash, which follows it at once.
+func runCrash(seed int64) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	rnd := rand.New(rand.NewSource(seed))
+	disk := NewMemFS()
+	model := newCrashModel(nil)
+	keys := &StaticKeys{Keys: map[uint32][]byte{
+		1: bytes.Repeat([]byte{1}, 16),
+		2: bytes.Repeat([]byte{2}, 32),
+	}}
+	for gen := 0; gen < 4; gen++ {
+		cfs := newCrashFS(disk)
+		fs := NewFaultFS(cfs)
+		opt := NewOptions(0, uint64(256+rnd.Intn(2048)), -1, 0, true)
+		opt.FileSystem = fs
+		if rnd.Intn(2) == 0 {
+			opt.Compression = FlateCodec{}
+			opt.CompressMinSize = 16
+		}
+		// once encrypted, always: a store can't read records without keys
+		if keys.Current != 0 || rnd.Intn(2) == 0 {
+			keys.Current = uint32(1 + rnd.Intn(2))
+			opt.Encryption = keys
+		}
+		bc, err := Open(crashDir, opt)
+		if err != nil {
+			return fmt.Errorf("gen %d: open: %v", gen, err)
+		}
+		if err := bc.RegisterIndex("gen", crashIndex); err != nil {
+			return fmt.Errorf("gen %d: register index: %v", gen, err)
+		}
+		if err := checkCrash(bc, model); err != nil {
+			return fmt.Errorf("gen %d: %v", gen, err)
+		}
+		// what the store holds now is on disk, whether synced or not
+		model = newCrashModel(storeState(bc))
+
+		switch rnd.Intn(4) {
+		case 0:
+			fs.Inject(Fault{Op: OpSync, After: rnd.Intn(40), Once: rnd.Intn(2) == 0})
+		case 1:
+			suffix := []string{".data", ".hint"}[rnd.Intn(2)]
+			fs.Inject(Fault{Op: OpWrite, Suffix: suffix, After: rnd.Intn(200), Torn: rnd.Intn(24), Once: true})
+			fs.Inject(Fault{Op: OpTruncate, Suffix: ".data"})
+		}
+		injected := func(err error) bool {
+			return errors.Is(err, InjectedFaultErr)
+		}
+
+		// set when the index is left half dropped or half built
+		unindexed := false
+		ops := 20 + rnd.Intn(300)
+	workload:
+		for i := 0; i < ops; i++ {
+			bucket := crashBuckets[rnd.Intn(len(crashBuckets))]
+			key := fmt.Sprintf("key-%d", rnd.Intn(crashKeys))
+			name := crashName(bucket, key)
+			switch n := rnd.Intn(100); {
+			case n < 60:
+				value := fmt.Sprintf("%d-%d-%d-%s", gen, i, rnd.Int63(), make([]byte, rnd.Intn(64)))
+				put := bc.Put
+				if bucket != "" {
+					put = bc.Bucket(bucket).Put
+				}
+				if err := put([]byte(key), []byte(value)); injected(err) {
+					model.maybe(name, value)
+					break workload
+				} else if err != nil {
+					return fmt.Errorf("gen %d: put %s: %v", gen, name, err)
+				}
+				model.wrote(name, value)
+			case n < 78:
+				del := bc.Del
+				if bucket != "" {
+					del = bc.Bucket(bucket).Del
+				}
+				err := del([]byte(key))
+				if err == KeyNotFoundErr && model.get(name) == absent {
+					continue
+				}
+				if injected(err) {
+					model.maybe(name, absent)
+					break workload
+				}
+				if err != nil {
+					return fmt.Errorf("gen %d: del %s: %v", gen, name, err)
+				}
+				model.wrote(name, absent)
+			case n < 80:
+				if bucket == "" {
+					continue
+				}
+				err := bc.DropBucket(bucket)
+				if injected(err) {
+					for _, name := range crashNames() {
+						if strings.HasPrefix(name, bucket+"/") {
+							model.maybe(name, absent)
+						}
+					}
+					break workload
+				}
+				if err != nil && err != BucketNotFoundErr {
+					return fmt.Errorf("gen %d: drop %s: %v", gen, bucket, err)
+				}
+				for _, name := range crashNames() {
+					if strings.HasPrefix(name, bucket+"/") && model.get(name) != absent {
+						if err == BucketNotFoundErr {
+							return fmt.Errorf("gen %d: drop %s: bucket not found, holding %s", gen, bucket, name)
+						}
+						model.wrote(name, absent)
+					}
+				}
+			case n < 93:
+				if err := bc.Sync(); injected(err) {
+					continue
+				} else if err != nil {
+					return fmt.Errorf("gen %d: sync: %v", gen, err)
+				}
+				model.sync()
+			case n < 96:
+				bc.lock.Lock()
+				err := RotateWriteableFile(bc)
+				bc.lock.Unlock()
+				if err != nil && !injected(err) {
+					return fmt.Errorf("gen %d: rotate: %v", gen, err)
+				}
+			case n < 97:
+				if err := bc.DropIndex("gen"); injected(err) {
+					unindexed = true
+					break workload
+				} else if err != nil {
+					return fmt.Errorf("gen %d: drop index: %v", gen, err)
+				}
+				if err := bc.RegisterIndex("gen", crashIndex); injected(err) {
+					unindexed = true
+					break workload
+				} else if err != nil {
+					return fmt.Errorf("gen %d: register index: %v", gen, err)
+				}
+			default:
+				if err := NewMerge(bc, 0).Run(); err != nil && !injected(err) {
+					return fmt.Errorf("gen %d: merge: %v", gen, err)
+				}
+			}
+		}
+		// the live state must match before the power cut too
+		if err := checkCurrent(bc, model); err != nil {
+			return fmt.Errorf("gen %d: before crash: %v", gen, err)
+		}
+		if err := checkIndex(bc); err != nil && !unindexed {
+			return fmt.Errorf("gen %d: before crash: %v", gen, err)
+		}
+
+		disk = cfs.crash(rnd)
+		// the lock of the crashed process is left behind for the operator
+		disk.Remove(crashDir + "/" + LockFileName)
+	}
+	return nil
+}
+
+func storeState(bc *BitCask) map[string]string {
+	state := make(map[string]string)
+	for _, name := range crashNames() {
+		v, err := crashGet(bc, name)
+		if err == nil {
+			state[name] = string(v)
+		}
+	}
+	return state
+}
+
+func checkCrash(bc *BitCask, model *crashModel) error {
+	if err := checkIndex(bc); err != nil {
+		return err
+	}
+	keys, err := crashList(bc)
+	if err != nil {
+		return err
+	}
+	for _, key := range crashNames() {
+		value, err := crashGet(bc, key)
+		got := string(value)
+		if err == KeyNotFoundErr {
+			got = absent
+		} else if err != nil {
+			return fmt.Errorf("get %s: %v", key, err)
+		}
+		if (got != absent) != keys[key] {
+			return fmt.Errorf("%s is %q but listed %v", key, got, keys[key])
+		}
+		if model.allowed(key, got) {
+			continue
+		}
+		if got == absent {
+			return fmt.Errorf("lost synced %s = %q", key, model.synced[key])
+		}
+		if _, ok := model.synced[key]; !ok {
+			return fmt.Errorf("deleted %s is back as %q", key, got)
+		}
+		return fmt.Errorf("%s is %q, synced %q", key, got, model.synced[key])
+	}
+	return nil
+}
+
+func checkCurrent(bc *BitCask, model *crashModel) error {
+	for _, key := range crashNames() {
+		value, err := crashGet(bc, key)
+		got := string(value)
+		if err == KeyNotFoundErr {
+			got = absent
+		} else if err != nil {
+			return fmt.Errorf("get %s: %v", key, err)
+		}
+		if want := model.get(key); got != want {
+			return fmt.Errorf("%s is %q, want %q", key, got, want)
+		}
+	}
+	return nil
+}
+
+func TestCrashConsistency(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	seeds := 300
+	if testing.Short() {
+		seeds = 30
+	}
+	for seed := int64(0); seed < int64(seeds); seed++ {
+		if err := runCrash(seed); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+	}
+}
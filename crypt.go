@@ -0,0 +1,160 @@
+package Bitcask
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+var (
+	NoKeyProviderErr = fmt.Errorf("Record is encrypted but no key provider is set ")
+	DecryptErr       = fmt.Errorf("Decrypt error ")
+)
+
+// KeyProvider supplies the keys that encrypt records at rest, see
+// Options.Encryption. Keys are AES keys of 16, 24 or 32 bytes, and an ID
+// must always stand for the same key.
+type KeyProvider interface {
+	// CurrentKey returns the key new records are encrypted with.
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key returns the key records encrypted under id need.
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider holding its keys in memory. To rotate keys,
+// add a key and make it Current. Merge rewrites every file but the active
+// one with it, so the old key is no longer needed after the active file
+// rotated and merge ran.
+type StaticKeys struct {
+	Keys    map[uint32][]byte
+	Current uint32
+}
+
+func (k *StaticKeys) CurrentKey() (uint32, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k *StaticKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("No key with ID %d ", id)
+	}
+	return key, nil
+}
+
+// sealOverhead is what sealing adds to a field: the key ID, the nonce and
+// the GCM tag.
+const sealOverhead = 4 + 12 + 16
+
+// sealer encrypts the key and value of records with AES-GCM. A sealed
+// field is keyID(4) nonce(12) ciphertext tag(16), so every record names
+// the key it needs. Empty fields stay empty.
+type sealer struct {
+	keys  KeyProvider
+	aeads *sync.Map
+}
+
+func newSealer(keys KeyProvider) (*sealer, error) {
+	s := &sealer{keys: keys, aeads: &sync.Map{}}
+	// fail at open rather than at the first write
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.aead(id, key); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sealer) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	if aead, ok := s.aeads.Load(id); ok {
+		return aead.(cipher.AEAD), nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s.aeads.Store(id, aead)
+	return aead, nil
+}
+
+func (s *sealer) seal(plain []byte) ([]byte, error) {
+	if len(plain) == 0 {
+		return plain, nil
+	}
+	id, key, err := s.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := s.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4+aead.NonceSize(), len(plain)+sealOverhead)
+	binary.LittleEndian.PutUint32(buf, id)
+	if _, err := rand.Read(buf[4:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(buf, buf[4:], plain, nil), nil
+}
+
+// open undoes seal. A nil sealer fails with NoKeyProviderErr.
+func (s *sealer) open(sealed []byte) ([]byte, error) {
+	if len(sealed) == 0 {
+		return sealed, nil
+	}
+	if s == nil {
+		return nil, NoKeyProviderErr
+	}
+	if len(sealed) < sealOverhead {
+		return nil, DecryptErr
+	}
+	id := binary.LittleEndian.Uint32(sealed)
+	var aead cipher.AEAD
+	if a, ok := s.aeads.Load(id); ok {
+		aead = a.(cipher.AEAD)
+	} else {
+		key, err := s.keys.Key(id)
+		if err != nil {
+			return nil, err
+		}
+		if aead, err = s.aead(id, key); err != nil {
+			return nil, err
+		}
+	}
+	plain, err := aead.Open(nil, sealed[4:16], sealed[16:], nil)
+	if err != nil {
+		return nil, DecryptErr
+	}
+	return plain, nil
+}
+
+// plain returns rec with its key and value decrypted and FlagEncrypted
+// cleared, or rec itself if it is not encrypted. Offsets within the file
+// must still be taken from rec.
+func (s *sealer) plain(rec *Record) (*Record, error) {
+	if rec.Flags&FlagEncrypted == 0 {
+		return rec, nil
+	}
+	key, err := s.open(rec.Key)
+	if err != nil {
+		return nil, &RecordError{rec.Offset, err}
+	}
+	value, err := s.open(rec.Value)
+	if err != nil {
+		return nil, &RecordError{rec.Offset, err}
+	}
+	p := *rec
+	p.Key, p.Value = key, value
+	p.Flags &^= FlagEncrypted
+	return &p, nil
+}
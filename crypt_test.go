@@ -0,0 +1,92 @@
+package Bitcask
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openKeys(dir string, current uint32, ids ...uint32) (*BitCask, error) {
+	keys := &StaticKeys{Keys: make(map[uint32][]byte), Current: current}
+	for _, id := range ids {
+		keys.Keys[id] = bytes.Repeat([]byte{byte(id)}, 32)
+	}
+	opt := testOptions()
+	opt.Encryption = keys
+	return Open(dir, opt)
+}
+
+// dataContains reports whether any data file of dir holds s.
+func dataContains(t *testing.T, dir, s string) bool {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.data"))
+	if err != nil || len(names) == 0 {
+		t.Fatalf("data files of %s: %v, %v", dir, names, err)
+	}
+	for _, name := range names {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(buf, []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	bc, err := openKeys(dir, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTest(t, bc, "secret-key", "secret-value", "b", "2")
+	bc.Close()
+	if dataContains(t, dir, "secret") {
+		t.Fatal("data files hold a plain key or value")
+	}
+
+	// without the key its records need, a store can't be read
+	if bc, err := openKeys(dir, 2, 2); err == nil {
+		_, err = bc.Get([]byte("secret-key"))
+		bc.Close()
+		if err == nil || !strings.Contains(err.Error(), "No key with ID 1") {
+			t.Fatalf("get without key 1: %v", err)
+		}
+	} else if !strings.Contains(err.Error(), "No key with ID 1") {
+		t.Fatalf("open without key 1: %v", err)
+	}
+	if _, err := Open(dir, testOptions()); err == nil || !strings.Contains(err.Error(), NoKeyProviderErr.Error()) {
+		t.Fatalf("open without a key provider: %v", err)
+	}
+
+	// rotate to key 2; merge seals the old records with it
+	bc, err = openKeys(dir, 2, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTest(t, bc, "c", "3")
+	want := map[string]string{"secret-key": "secret-value", "b": "2", "c": "3"}
+	checkStore(t, bc, want)
+	// the active file, still holding records sealed with key 1, must be
+	// rotated for merge to take them
+	rotateTest(t, bc)
+	if err := NewMerge(bc, 0).Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkStore(t, bc, want)
+	bc.Close()
+	if dataContains(t, dir, "secret") {
+		t.Fatal("merged data files hold a plain key or value")
+	}
+
+	bc, err = openKeys(dir, 2, 2)
+	if err != nil {
+		t.Fatalf("open with key 2 only after merge: %v", err)
+	}
+	defer bc.Close()
+	checkStore(t, bc, want)
+}
@@ -3,44 +3,134 @@ package Bitcask
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
 )
 
 // Header crc32:tStamp:ksz:valueSz(4:4:4:4)
 // HintHeader tStamp:ksz:valueSz：valuePos(4:4:4:8)
+// The top byte of ksz holds record flags, so keys are limited to 16M.
 
-var CRC32Error = errors.New("Check CRC32 sum error")
+const (
+	// FlagTombstone marks a record that deletes its key.
+	FlagTombstone = 1 << 0
+	// FlagMeta marks a value that starts with encoded Meta.
+	FlagMeta = 1 << 1
+	// FlagBatch marks a record of a batch that is followed by more of it.
+	FlagBatch = 1 << 2
+	// FlagMerged marks a record merge copied from an older file, not a change.
+	FlagMerged = 1 << 3
+	// CodecFlags holds the ID of the Codec that compressed the value, 0 if
+	// it is stored as is.
+	CodecFlags = MaxCodecID << codecShift
+	// FlagBucket marks a record whose key starts with the uvarint ID of its
+	// Bucket.
+	FlagBucket = 1 << 6
+	// FlagEncrypted marks a record whose key and value are sealed, see
+	// KeyProvider. Its hint holds the same sealed key.
+	FlagEncrypted = 1 << 7
 
+	// KnownFlags is every flag bit this version writes.
+	KnownFlags = FlagTombstone | FlagMeta | FlagBatch | FlagMerged | CodecFlags | FlagBucket | FlagEncrypted
+
+	codecShift  = 4
+	flagShift   = 24
+	KeySizeMask = 1<<flagShift - 1
+)
+
+var (
+	CRC32Error     = errors.New("Check CRC32 sum error")
+	KeyTooLargeErr = fmt.Errorf("Key too large ")
+)
+
+// MaxKeySize is the longest key a write takes. Stored, a key may gain the
+// uvarint ID of its Bucket and the seal overhead, and must still fit in ksz.
+const MaxKeySize = KeySizeMask - binary.MaxVarintLen32 - sealOverhead
+
+// MaxValueSize bounds the value size a record or hint may claim, as a value
+// must fit in a data file.
+const MaxValueSize = maxFileSizeLimit
+
+// maxOffset bounds offsets in a data file, which a Seq holds in 32 bits.
+const maxOffset = 1 << 32
+
+// SizeError reports a size field that can't be right: Size is more than
+// the Limit of what holds it or of what any record may take.
+type SizeError struct {
+	Field string
+	Size  uint64
+	Limit uint64
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("%s size %d exceeds %d", e.Field, e.Size, e.Limit)
+}
+
+// PackKeySize stores flags in the top byte of a key size, which must be no
+// more than KeySizeMask.
+func PackKeySize(flags uint8, keySize uint32) uint32 {
+	return uint32(flags)<<flagShift | keySize&KeySizeMask
+}
+
+func UnpackKeySize(packed uint32) (uint8, uint32) {
+	return uint8(packed >> flagShift), packed & KeySizeMask
+}
+
+// EncodeEntry accepts a keySize packed with PackKeySize.
 func EncodeEntry(tStamp, keySize, valueSize uint32, key, value []byte) []byte {
-	bufSize := HeaderSize + keySize + valueSize
-	buf := make([]byte, bufSize)
+	_, kSize := UnpackKeySize(keySize)
+	buf := make([]byte, HeaderSize+kSize+valueSize)
 	binary.LittleEndian.PutUint32(buf[4:8], tStamp)
 	binary.LittleEndian.PutUint32(buf[8:12], keySize)
 	binary.LittleEndian.PutUint32(buf[12:16], valueSize)
-	copy(buf[HeaderSize:(HeaderSize+keySize)], key)
-	copy(buf[(HeaderSize+keySize):(HeaderSize+keySize+valueSize)], value)
+	copy(buf[HeaderSize:(HeaderSize+kSize)], key)
+	copy(buf[(HeaderSize+kSize):(HeaderSize+kSize+valueSize)], value)
 	crc32Sum := crc32.ChecksumIEEE(buf[4:])
 	binary.LittleEndian.PutUint32(buf[0:4], crc32Sum)
 	return buf
 }
 
-func DecodeEntryHeader(buf []byte) (uint32, uint32, uint32, uint32) {
+// DecodeEntryHeader returns the key size without flags, see EntryFlags. It
+// fails with a *SizeError if buf is shorter than a header or the value size
+// is more than MaxValueSize.
+func DecodeEntryHeader(buf []byte) (uint32, uint32, uint32, uint32, error) {
+	if len(buf) < HeaderSize {
+		return 0, 0, 0, 0, &SizeError{"header", HeaderSize, uint64(len(buf))}
+	}
 	crc32Sum := binary.LittleEndian.Uint32(buf[:4])
 	tStamp := binary.LittleEndian.Uint32(buf[4:8])
-	keySize := binary.LittleEndian.Uint32(buf[8:12])
+	keySize := binary.LittleEndian.Uint32(buf[8:12]) & KeySizeMask
 	valueSize := binary.LittleEndian.Uint32(buf[12:HeaderSize])
-	return crc32Sum, tStamp, keySize, valueSize
+	if valueSize > MaxValueSize {
+		return 0, 0, 0, 0, &SizeError{"value", uint64(valueSize), MaxValueSize}
+	}
+	return crc32Sum, tStamp, keySize, valueSize, nil
+}
+
+// EntryFlags returns no flags if buf is shorter than a header.
+func EntryFlags(buf []byte) uint8 {
+	if len(buf) < HeaderSize {
+		return 0
+	}
+	flags, _ := UnpackKeySize(binary.LittleEndian.Uint32(buf[8:12]))
+	return flags
 }
 
+// DecodeEntry returns the value of the record buf starts with.
 func DecodeEntry(buf []byte) ([]byte, error) {
-	crc32Sum := binary.LittleEndian.Uint32(buf[:4])
-	keySize := binary.LittleEndian.Uint32(buf[8:12])
-	valueSize := binary.LittleEndian.Uint32(buf[12:HeaderSize])
-	if crc32.ChecksumIEEE(buf[4:]) != crc32Sum {
+	crc32Sum, _, keySize, valueSize, err := DecodeEntryHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	end := uint64(HeaderSize) + uint64(keySize) + uint64(valueSize)
+	if end > uint64(len(buf)) {
+		return nil, &SizeError{"record", end, uint64(len(buf))}
+	}
+	if crc32.ChecksumIEEE(buf[4:end]) != crc32Sum {
 		return nil, CRC32Error
 	}
 	value := make([]byte, valueSize)
-	copy(value, buf[(HeaderSize+keySize):(HeaderSize+keySize+valueSize)])
+	copy(value, buf[HeaderSize+keySize:end])
 	return value, nil
 }
 
@@ -54,10 +144,31 @@ func EncodeHint(tStamp, keySize, valueSize uint32, valuePos uint64, key []byte)
 	return buf
 }
 
-func DecodeHint(buf []byte) (uint32, uint32, uint32, uint64) {
+// DecodeHint returns the key size without flags, see HintFlags. It fails
+// with a *SizeError if buf is shorter than a hint header or the value it
+// points at can't be in a data file.
+func DecodeHint(buf []byte) (uint32, uint32, uint32, uint64, error) {
+	if len(buf) < HintHeaderSize {
+		return 0, 0, 0, 0, &SizeError{"hint header", HintHeaderSize, uint64(len(buf))}
+	}
 	tStamp := binary.LittleEndian.Uint32(buf[:4])
-	keySize := binary.LittleEndian.Uint32(buf[4:8])
+	keySize := binary.LittleEndian.Uint32(buf[4:8]) & KeySizeMask
 	valueSize := binary.LittleEndian.Uint32(buf[8:12])
 	valuePos := binary.LittleEndian.Uint64(buf[12:HintHeaderSize])
-	return tStamp, keySize, valueSize, valuePos
+	if valueSize > MaxValueSize {
+		return 0, 0, 0, 0, &SizeError{"value", uint64(valueSize), MaxValueSize}
+	}
+	if valuePos > maxOffset || valuePos+uint64(valueSize) > maxOffset {
+		return 0, 0, 0, 0, &SizeError{"value position", valuePos, maxOffset}
+	}
+	return tStamp, keySize, valueSize, valuePos, nil
+}
+
+// HintFlags returns no flags if buf is shorter than a hint header.
+func HintFlags(buf []byte) uint8 {
+	if len(buf) < HintHeaderSize {
+		return 0
+	}
+	flags, _ := UnpackKeySize(binary.LittleEndian.Uint32(buf[4:8]))
+	return flags
 }
@@ -7,6 +7,7 @@ type Entry struct {
 	valueSize   uint32
 	valueOffset uint64
 	timeStamp   uint32
+	flags       uint8
 }
 
 func (e *Entry) toString() string {
@@ -14,6 +15,19 @@ func (e *Entry) toString() string {
 		e.timeStamp, e.fileID, e.valueSize, e.valueOffset)
 }
 
+// seq returns the sequence number of the record of key at e.
+func (e *Entry) seq(key []byte) uint64 {
+	return SeqOf(e.fileID, e.valueOffset-uint64(HeaderSize+e.keySize(len(key))))
+}
+
+// keySize is the size a key of n bytes takes in the record at e.
+func (e *Entry) keySize(n int) int {
+	if e.flags&FlagEncrypted != 0 && n > 0 {
+		return n + sealOverhead
+	}
+	return n
+}
+
 func (e *Entry) IsNewer(that *Entry) bool {
 	if e.timeStamp == that.timeStamp {
 		if e.fileID == that.fileID {
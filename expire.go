@@ -0,0 +1,89 @@
+package Bitcask
+
+import "time"
+
+// PutCond is the condition under which PutIf writes.
+type PutCond int
+
+const (
+	PutAlways PutCond = iota
+	PutIfAbsent
+	PutIfExists
+)
+
+// PutIf is PutWithMeta done only if cond holds, checked under the same lock
+// as the write. It returns whether the value was written.
+func (c *BitCask) PutIf(key, value []byte, meta *Meta, cond PutCond) (bool, error) {
+	defer c.metrics.put.since(time.Now())
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.readOnly {
+		return false, ReadOnlyErr
+	}
+	if cond != PutAlways {
+		_, _, err := c.getWithMeta(key)
+		if err != nil && err != KeyNotFoundErr {
+			return false, err
+		}
+		if exists := err == nil; exists != (cond == PutIfExists) {
+			return false, nil
+		}
+	}
+	stored, flags, err := c.encodeValue(value, meta)
+	if err != nil {
+		return false, err
+	}
+	if err := CheckWriteableFile(c); err != nil {
+		return false, err
+	}
+	e, err := c.write(key, value, stored, flags)
+	if err != nil {
+		return false, err
+	}
+	c.keyDirs.Put(string(key), &e)
+	c.publish(EventPut, key, value, meta, &e)
+	return true, nil
+}
+
+// Expire sets when key expires, keeping its value and other meta. A zero
+// at removes the expiry and a time already past deletes the key.
+func (c *BitCask) Expire(key []byte, at time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.readOnly {
+		return ReadOnlyErr
+	}
+	value, meta, err := c.getWithMeta(key)
+	if err != nil {
+		return err
+	}
+	if err := CheckWriteableFile(c); err != nil {
+		return err
+	}
+	if !at.IsZero() && !at.After(time.Now()) {
+		e, err := c.write(key, nil, nil, FlagTombstone)
+		if err != nil {
+			return err
+		}
+		c.keyDirs.Del(string(key))
+		c.publish(EventDel, key, nil, nil, &e)
+		return nil
+	}
+	meta.ExpiresAt = at
+	stored, flags, err := c.encodeValue(value, meta)
+	if err != nil {
+		return err
+	}
+	e, err := c.write(key, value, stored, flags)
+	if err != nil {
+		return err
+	}
+	c.keyDirs.Put(string(key), &e)
+	c.publish(EventPut, key, value, meta, &e)
+	return nil
+}
@@ -0,0 +1,212 @@
+package Bitcask
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+type DumpFormat int
+
+const (
+	// JSONLines writes one JSON object per line with base64 keys and values.
+	JSONLines DumpFormat = iota
+	// BinaryDump writes DumpMagic followed by length-prefixed records
+	// tStamp:expiresAt:ksz:valueSz:bucketSz(4:4:4:4:4):bucket:key:value.
+	BinaryDump
+)
+
+const (
+	DumpMagic        = "BCDUMP1\n"
+	DumpHeaderSize   = 20
+	dumpMaxFieldSize = 1 << 30
+)
+
+var DumpFormatErr = fmt.Errorf("Unknown dump format ")
+
+func ParseDumpFormat(name string) (DumpFormat, error) {
+	switch name {
+	case "jsonl", "json":
+		return JSONLines, nil
+	case "binary", "bin":
+		return BinaryDump, nil
+	}
+	return 0, DumpFormatErr
+}
+
+// DumpRecord is one key as written by Export. ExpiresAt is a unix timestamp,
+// zero when the key never expires. Bucket is empty for keys outside buckets.
+type DumpRecord struct {
+	Bucket    string `json:"bucket,omitempty"`
+	Key       []byte `json:"key"`
+	Value     []byte `json:"value"`
+	TimeStamp uint32 `json:"timestamp"`
+	ExpiresAt uint32 `json:"expires_at,omitempty"`
+}
+
+// Export writes every live key to w in the given format, those of buckets
+// after the others along with their bucket name.
+func (c *BitCask) Export(w io.Writer, format DumpFormat) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	switch format {
+	case JSONLines:
+	case BinaryDump:
+		if _, err := bw.WriteString(DumpMagic); err != nil {
+			return err
+		}
+	default:
+		return DumpFormatErr
+	}
+	write := func(bucket string, key []byte, e *Entry, value []byte, meta *Meta) error {
+		r := &DumpRecord{
+			Bucket:    bucket,
+			Key:       key,
+			Value:     value,
+			TimeStamp: e.timeStamp,
+		}
+		if !meta.ExpiresAt.IsZero() {
+			r.ExpiresAt = uint32(meta.ExpiresAt.Unix())
+		}
+		if format == JSONLines {
+			return enc.Encode(r)
+		}
+		_, err := bw.Write(EncodeDumpRecord(r))
+		return err
+	}
+	err := c.fold(func(key []byte, e *Entry, value []byte, meta *Meta) error {
+		return write("", key, e, value, meta)
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range c.Buckets() {
+		c.lock.RLock()
+		id, kd := c.buckets.lookup(name)
+		c.lock.RUnlock()
+		if kd == nil {
+			// dropped meanwhile
+			continue
+		}
+		prefix := len(bucketKey(id, nil))
+		err := c.foldKeysIn(kd, kd.Keys(), func(key []byte, e *Entry, value []byte, meta *Meta) error {
+			return write(name, key[prefix:], e, value, meta)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Import puts every record read from r. Records that already expired are
+// skipped; the others are stored with the current time as their timestamp
+// and keep their expiry. Records of a bucket are put in the bucket of that
+// name, created if needed.
+func (c *BitCask) Import(r io.Reader, format DumpFormat) error {
+	br := bufio.NewReader(r)
+	var next func() (*DumpRecord, error)
+	switch format {
+	case JSONLines:
+		dec := json.NewDecoder(br)
+		next = func() (*DumpRecord, error) {
+			rec := &DumpRecord{}
+			if err := dec.Decode(rec); err != nil {
+				return nil, err
+			}
+			return rec, nil
+		}
+	case BinaryDump:
+		magic := make([]byte, len(DumpMagic))
+		if _, err := io.ReadFull(br, magic); err != nil {
+			return err
+		}
+		if !bytes.Equal(magic, []byte(DumpMagic)) {
+			return DumpFormatErr
+		}
+		next = func() (*DumpRecord, error) {
+			return DecodeDumpRecord(br)
+		}
+	default:
+		return DumpFormatErr
+	}
+
+	now := uint32(time.Now().Unix())
+	for {
+		rec, err := next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rec.ExpiresAt != 0 && rec.ExpiresAt <= now {
+			continue
+		}
+		if rec.Bucket != "" {
+			// buckets hold no meta, so no expiry
+			if err := c.Bucket(rec.Bucket).Put(rec.Key, rec.Value); err != nil {
+				return err
+			}
+			continue
+		}
+		meta := &Meta{}
+		if rec.ExpiresAt != 0 {
+			meta.ExpiresAt = time.Unix(int64(rec.ExpiresAt), 0)
+		}
+		if err := c.PutWithMeta(rec.Key, rec.Value, meta); err != nil {
+			return err
+		}
+	}
+}
+
+func EncodeDumpRecord(r *DumpRecord) []byte {
+	keySize := uint32(len(r.Key))
+	valueSize := uint32(len(r.Value))
+	bucketSize := uint32(len(r.Bucket))
+	buf := make([]byte, DumpHeaderSize+bucketSize+keySize+valueSize)
+	binary.LittleEndian.PutUint32(buf[0:4], r.TimeStamp)
+	binary.LittleEndian.PutUint32(buf[4:8], r.ExpiresAt)
+	binary.LittleEndian.PutUint32(buf[8:12], keySize)
+	binary.LittleEndian.PutUint32(buf[12:16], valueSize)
+	binary.LittleEndian.PutUint32(buf[16:20], bucketSize)
+	n := copy(buf[DumpHeaderSize:], r.Bucket)
+	copy(buf[DumpHeaderSize+n:], r.Key)
+	copy(buf[DumpHeaderSize+n+int(keySize):], r.Value)
+	return buf
+}
+
+func DecodeDumpRecord(r io.Reader) (*DumpRecord, error) {
+	buf := make([]byte, DumpHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	keySize := binary.LittleEndian.Uint32(buf[8:12])
+	valueSize := binary.LittleEndian.Uint32(buf[12:16])
+	bucketSize := binary.LittleEndian.Uint32(buf[16:20])
+	if keySize > dumpMaxFieldSize {
+		return nil, &SizeError{"dump key", uint64(keySize), dumpMaxFieldSize}
+	}
+	if valueSize > dumpMaxFieldSize {
+		return nil, &SizeError{"dump value", uint64(valueSize), dumpMaxFieldSize}
+	}
+	if bucketSize > dumpMaxFieldSize {
+		return nil, &SizeError{"dump bucket", uint64(bucketSize), dumpMaxFieldSize}
+	}
+	data, err := ReadN(r, int64(bucketSize)+int64(keySize)+int64(valueSize))
+	if err != nil {
+		return nil, err
+	}
+	kv := data[bucketSize:]
+	return &DumpRecord{
+		Bucket:    string(data[:bucketSize]),
+		TimeStamp: binary.LittleEndian.Uint32(buf[0:4]),
+		ExpiresAt: binary.LittleEndian.Uint32(buf[4:8]),
+		Key:       kv[:keySize],
+		Value:     kv[keySize:],
+	}, nil
+}
@@ -0,0 +1,136 @@
+package Bitcask
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, format := range []DumpFormat{JSONLines, BinaryDump} {
+		bc := openTest(t, t.TempDir())
+		putTest(t, bc, "a", "1", "b", "", "\xff\x00binary", "\x00\x01\x02")
+		if err := bc.PutWithMeta([]byte("ttl"), []byte("soon"), &Meta{ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+		putTest(t, bc, "gone", "x")
+		if err := bc.Del([]byte("gone")); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := bc.Export(&buf, format); err != nil {
+			t.Fatalf("format %d: export: %v", format, err)
+		}
+		bc.Close()
+
+		ic := openTest(t, t.TempDir())
+		if err := ic.Import(bytes.NewReader(buf.Bytes()), format); err != nil {
+			t.Fatalf("format %d: import: %v", format, err)
+		}
+		checkStore(t, ic, map[string]string{
+			"a": "1", "b": "", "\xff\x00binary": "\x00\x01\x02", "ttl": "soon",
+		})
+		_, meta, err := ic.GetWithMeta([]byte("ttl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !meta.ExpiresAt.Equal(expiresAt) {
+			t.Fatalf("format %d: imported expiry %v, want %v", format, meta.ExpiresAt, expiresAt)
+		}
+		// a dump read in the wrong format is rejected, not imported as garbage
+		if format == JSONLines {
+			if err := ic.Import(bytes.NewReader(buf.Bytes()), BinaryDump); err != DumpFormatErr {
+				t.Fatalf("json dump imported as binary: %v", err)
+			}
+		}
+		ic.Close()
+	}
+}
+
+func TestExportBuckets(t *testing.T) {
+	for _, format := range []DumpFormat{JSONLines, BinaryDump} {
+		bc := openTest(t, t.TempDir())
+		putTest(t, bc, "k", "store")
+		for _, name := range []string{"a", "b", "dropped"} {
+			if err := bc.Bucket(name).Put([]byte("k"), []byte(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := bc.Bucket("a").Put([]byte("\xff"), []byte("binary")); err != nil {
+			t.Fatal(err)
+		}
+		if err := bc.DropBucket("dropped"); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := bc.Export(&buf, format); err != nil {
+			t.Fatalf("format %d: export: %v", format, err)
+		}
+		bc.Close()
+
+		ic := openTest(t, t.TempDir())
+		if err := ic.Import(&buf, format); err != nil {
+			t.Fatalf("format %d: import: %v", format, err)
+		}
+		checkStore(t, ic, map[string]string{"k": "store"})
+		if names := ic.Buckets(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+			t.Fatalf("format %d: imported buckets %q", format, names)
+		}
+		if got := bucketMap(t, ic, "a"); !reflect.DeepEqual(got, map[string]string{"k": "a", "\xff": "binary"}) {
+			t.Fatalf("format %d: bucket a holds %v", format, got)
+		}
+		if got := bucketMap(t, ic, "b"); !reflect.DeepEqual(got, map[string]string{"k": "b"}) {
+			t.Fatalf("format %d: bucket b holds %v", format, got)
+		}
+		ic.Close()
+	}
+}
+
+func TestImportSkipsExpired(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(DumpMagic)
+	buf.Write(EncodeDumpRecord(&DumpRecord{Key: []byte("old"), Value: []byte("x"), TimeStamp: 1, ExpiresAt: 2}))
+	buf.Write(EncodeDumpRecord(&DumpRecord{Key: []byte("new"), Value: []byte("y"), TimeStamp: 1}))
+
+	bc := openTest(t, t.TempDir())
+	defer bc.Close()
+	if err := bc.Import(&buf, BinaryDump); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	checkStore(t, bc, map[string]string{"new": "y"})
+}
+
+func TestParseDumpFormat(t *testing.T) {
+	for name, want := range map[string]DumpFormat{"jsonl": JSONLines, "json": JSONLines, "binary": BinaryDump, "bin": BinaryDump} {
+		if f, err := ParseDumpFormat(name); err != nil || f != want {
+			t.Fatalf("ParseDumpFormat(%q) = %d, %v", name, f, err)
+		}
+	}
+	if _, err := ParseDumpFormat("xml"); err != DumpFormatErr {
+		t.Fatalf("ParseDumpFormat(xml): %v", err)
+	}
+}
+
+// TestExportIgnoresExpirySecs checks that keys without an expiry of their
+// own are exported without one, as the store never expires them.
+func TestExportIgnoresExpirySecs(t *testing.T) {
+	opt := testOptions()
+	opt.ExpirySecs = 1
+	bc, err := Open(t.TempDir(), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	putTest(t, bc, "a", "1")
+	var buf bytes.Buffer
+	if err := bc.Export(&buf, BinaryDump); err != nil {
+		t.Fatal(err)
+	}
+	buf.Next(len(DumpMagic))
+	rec, err := DecodeDumpRecord(&buf)
+	if err != nil || rec.ExpiresAt != 0 {
+		t.Fatalf("exported %+v, %v", rec, err)
+	}
+}
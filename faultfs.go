@@ -0,0 +1,196 @@
+package Bitcask
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var InjectedFaultErr = fmt.Errorf("Injected fault ")
+
+// Op is a FileSystem operation a Fault can fail.
+type Op int
+
+const (
+	OpOpen Op = iota
+	OpWrite
+	OpSync
+	OpTruncate
+	OpRemove
+	OpRename
+)
+
+// Fault describes which operations of a FaultFS fail and how.
+type Fault struct {
+	Op Op
+	// Suffix limits the fault to files whose name ends with it, for
+	// example ".hint". Empty matches every file.
+	Suffix string
+	// After lets that many matching operations succeed before the first
+	// failure.
+	After int
+	// Err is what failed operations return, InjectedFaultErr if nil.
+	Err error
+	// Torn makes a failed write store its first Torn bytes anyway, as a
+	// crash in the middle of it would.
+	Torn int
+	// Once fails a single operation. Otherwise every matching operation
+	// from the first failure on fails, as on a dead disk.
+	Once bool
+
+	seen  int
+	fired int
+}
+
+// FaultFS passes every operation to another FileSystem, except those an
+// injected Fault fails.
+type FaultFS struct {
+	fs     FileSystem
+	lock   *sync.Mutex
+	faults []*Fault
+}
+
+func NewFaultFS(fs FileSystem) *FaultFS {
+	return &FaultFS{fs: fs, lock: &sync.Mutex{}}
+}
+
+// Inject adds a fault, which applies to operations from now on.
+func (fs *FaultFS) Inject(f Fault) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.faults = append(fs.faults, &f)
+}
+
+// Clear removes every fault.
+func (fs *FaultFS) Clear() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.faults = nil
+}
+
+// Failures counts the operations failed so far by the current faults.
+func (fs *FaultFS) Failures() int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n := 0
+	for _, f := range fs.faults {
+		n += f.fired
+	}
+	return n
+}
+
+// fault returns the fault failing op on name, if any.
+func (fs *FaultFS) fault(op Op, name string) *Fault {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	for _, f := range fs.faults {
+		if f.Op != op || !strings.HasSuffix(name, f.Suffix) {
+			continue
+		}
+		f.seen++
+		if f.seen <= f.After || f.Once && f.fired > 0 {
+			continue
+		}
+		f.fired++
+		return f
+	}
+	return nil
+}
+
+func (f *Fault) err(op, name string) error {
+	err := f.Err
+	if err == nil {
+		err = InjectedFaultErr
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if f := fs.fault(OpOpen, name); f != nil {
+		return nil, f.err("open", name)
+	}
+	file, err := fs.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: fs}, nil
+}
+
+func (fs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	return fs.fs.Stat(name)
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	if f := fs.fault(OpRemove, name); f != nil {
+		return f.err("remove", name)
+	}
+	return fs.fs.Remove(name)
+}
+
+func (fs *FaultFS) Rename(oldpath, newpath string) error {
+	if f := fs.fault(OpRename, oldpath); f != nil {
+		return f.err("rename", oldpath)
+	}
+	return fs.fs.Rename(oldpath, newpath)
+}
+
+func (fs *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	return fs.fs.MkdirAll(path, perm)
+}
+
+func (fs *FaultFS) ReadDirNames(dir string) ([]string, error) {
+	return fs.fs.ReadDirNames(dir)
+}
+
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if fault := f.fs.fault(OpWrite, f.Name()); fault != nil {
+		n := 0
+		if torn := fault.torn(p); len(torn) > 0 {
+			n, _ = f.File.Write(torn)
+		}
+		return n, fault.err("write", f.Name())
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if fault := f.fs.fault(OpWrite, f.Name()); fault != nil {
+		n := 0
+		if torn := fault.torn(p); len(torn) > 0 {
+			n, _ = f.File.WriteAt(torn, off)
+		}
+		return n, fault.err("write", f.Name())
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *Fault) torn(p []byte) []byte {
+	if f.Torn < len(p) {
+		return p[:f.Torn]
+	}
+	return p
+}
+
+func (f *faultFile) Sync() error {
+	if fault := f.fs.fault(OpSync, f.Name()); fault != nil {
+		return fault.err("sync", f.Name())
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if fault := f.fs.fault(OpTruncate, f.Name()); fault != nil {
+		return fault.err("truncate", f.Name())
+	}
+	return f.File.Truncate(size)
+}
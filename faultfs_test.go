@@ -0,0 +1,142 @@
+package Bitcask
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestFaultFSOnceAndSticky(t *testing.T) {
+	for _, once := range []bool{true, false} {
+		fs := NewFaultFS(NewMemFS())
+		f, err := fs.OpenFile("/f.data", os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs.Inject(Fault{Op: OpSync, Suffix: ".data", After: 1, Once: once})
+
+		var errs []error
+		for i := 0; i < 4; i++ {
+			errs = append(errs, f.Sync())
+		}
+		if errs[0] != nil || !errors.Is(errs[1], InjectedFaultErr) {
+			t.Fatalf("once %v: syncs failed with %v", once, errs)
+		}
+		for _, err := range errs[2:] {
+			if once && err != nil || !once && !errors.Is(err, InjectedFaultErr) {
+				t.Fatalf("once %v: syncs failed with %v", once, errs)
+			}
+		}
+		if want := map[bool]int{true: 1, false: 3}[once]; fs.Failures() != want {
+			t.Fatalf("once %v: %d failures, want %d", once, fs.Failures(), want)
+		}
+
+		// other files and operations pass
+		g, err := fs.OpenFile("/f.hint", os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Sync(); err != nil {
+			t.Fatalf("once %v: sync of another file: %v", once, err)
+		}
+		if err := f.Truncate(0); err != nil {
+			t.Fatalf("once %v: truncate: %v", once, err)
+		}
+
+		fs.Clear()
+		if err := f.Sync(); err != nil || fs.Failures() != 0 {
+			t.Fatalf("once %v: sync after Clear: %v", once, err)
+		}
+	}
+}
+
+func TestFaultFSTornWrite(t *testing.T) {
+	mem := NewMemFS()
+	fs := NewFaultFS(mem)
+	f, err := fs.OpenFile("/f", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom := errors.New("disk full")
+	fs.Inject(Fault{Op: OpWrite, Torn: 3, Err: custom, Once: true})
+	if n, err := f.WriteAt([]byte("abcdef"), 0); n != 3 || !errors.Is(err, custom) {
+		t.Fatalf("torn write: %d, %v", n, err)
+	}
+	if got := readMem(t, mem, "/f"); got != "abc" {
+		t.Fatalf("torn write stored %q", got)
+	}
+}
+
+func TestAppendNotCutOff(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	opt := testOptions()
+	opt.FileSystem = fs
+	bc, err := Open("/db", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTest(t, bc, "a", "1")
+
+	// the write is torn and what it left can't be cut off
+	fs.Inject(Fault{Op: OpWrite, Suffix: ".data", Torn: 5, Once: true})
+	fs.Inject(Fault{Op: OpTruncate, Suffix: ".data"})
+	var torn *TornAppendError
+	if err := bc.Put([]byte("b"), []byte("2")); !errors.As(err, &torn) || !errors.Is(err, InjectedFaultErr) {
+		t.Fatalf("put: %v", err)
+	}
+	fs.Clear()
+	// nothing more goes after the tail
+	if err := bc.Put([]byte("c"), []byte("3")); !errors.As(err, &torn) {
+		t.Fatalf("put after a torn append: %v", err)
+	}
+	bc.Close()
+
+	bc, err = Open("/db", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTest(t, bc, "c", "3")
+	checkStore(t, bc, map[string]string{"a": "1", "c": "3"})
+
+	// a record whose hint failed and that could not be cut off is whole,
+	// Open keeps it
+	fs.Inject(Fault{Op: OpWrite, Suffix: ".hint", Once: true})
+	fs.Inject(Fault{Op: OpTruncate, Suffix: ".data"})
+	if err := bc.Put([]byte("d"), []byte("4")); !errors.As(err, &torn) {
+		t.Fatalf("put with a failed hint: %v", err)
+	}
+	fs.Clear()
+	bc.Close()
+	bc, err = Open("/db", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	checkStore(t, bc, map[string]string{"a": "1", "c": "3", "d": "4"})
+}
+
+func TestRotateSyncFails(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	opt := testOptions()
+	opt.FileSystem = fs
+	bc, err := Open("/db", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	putTest(t, bc, "a", "1")
+
+	fs.Inject(Fault{Op: OpSync, Once: true})
+	active := bc.writeFile
+	bc.lock.Lock()
+	err = RotateWriteableFile(bc)
+	bc.lock.Unlock()
+	if !errors.Is(err, InjectedFaultErr) || bc.writeFile != active {
+		t.Fatalf("rotate with a failed sync: %v", err)
+	}
+	// the active file stays usable
+	putTest(t, bc, "b", "2")
+	rotateTest(t, bc)
+	putTest(t, bc, "c", "3")
+	checkStore(t, bc, map[string]string{"a": "1", "b": "2", "c": "3"})
+}
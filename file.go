@@ -15,18 +15,26 @@ const (
 )
 
 type DBFile struct {
-	file     *os.File
+	file     File
 	fileID   uint32
 	offset   uint64
-	hintFile *os.File
+	hintFile File
+	metrics  *metrics
+	// seal encrypts what WriteWithFlags writes, if set
+	seal *sealer
+	// torn is the error that left the file with a tail no record may
+	// follow: a *TornAppendError, whose part Open cuts off, or a failed
+	// rotation after an unfinished batch, see closeUnfinishedBatch. Nothing
+	// more is written to it.
+	torn error
 }
 
 func NewDBFile() *DBFile {
 	return &DBFile{}
 }
 
-func OpenDBFile(dir string, tStamp int) (*DBFile, error) {
-	f, err := os.OpenFile(dir+"/"+strconv.Itoa(tStamp)+".data", os.O_RDONLY, os.ModePerm)
+func OpenDBFile(fs FileSystem, dir string, tStamp int) (*DBFile, error) {
+	f, err := fs.OpenFile(dir+"/"+strconv.Itoa(tStamp)+".data", os.O_RDONLY, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
@@ -40,55 +48,88 @@ func OpenDBFile(dir string, tStamp int) (*DBFile, error) {
 
 func (f *DBFile) Read(offset uint64, length uint32) ([]byte, error) {
 	data := make([]byte, length)
-	f.file.Seek(int64(offset), 0)
-	_, err := f.file.Read(data)
+	_, err := f.file.ReadAt(data, int64(offset))
 	if err != nil {
 		return nil, err
 	}
+	f.metrics.read(len(data))
 	return data, nil
 }
 
 func (f *DBFile) Write(key, value []byte) (Entry, error) {
-	timeStamp := uint32(time.Now().Unix())
-	keySize := uint32(len(key))
+	return f.WriteWithFlags(key, value, 0)
+}
+
+// WriteWithFlags appends a record whose value is already encoded as flags
+// say, encrypting its key and value if the file has a sealer.
+func (f *DBFile) WriteWithFlags(key, value []byte, flags uint8) (Entry, error) {
+	if f.seal != nil {
+		var err error
+		if key, err = f.seal.seal(key); err != nil {
+			return Entry{}, err
+		}
+		if value, err = f.seal.seal(value); err != nil {
+			return Entry{}, err
+		}
+		flags |= FlagEncrypted
+	}
+	return f.writeRecord(uint32(time.Now().Unix()), key, value, flags)
+}
+
+// writeRecord appends a record with the given timestamp and its hint, key
+// and value written as they are.
+func (f *DBFile) writeRecord(timeStamp uint32, key, value []byte, flags uint8) (Entry, error) {
+	if f.torn != nil {
+		return Entry{}, f.torn
+	}
+	if len(key) > KeySizeMask {
+		return Entry{}, KeyTooLargeErr
+	}
+	keySize := PackKeySize(flags, uint32(len(key)))
 	valueSize := uint32(len(value))
 	entry := EncodeEntry(timeStamp, keySize, valueSize, key, value)
-	valueOffset := f.offset + uint64(HeaderSize+keySize)
-	_, err := AppendToFile(f.file, entry)
-	if err != nil {
-		panic(err)
+	valueOffset := f.offset + uint64(HeaderSize+len(key))
+	if _, err := AppendToFile(f.file, entry); err != nil {
+		if _, ok := err.(*TornAppendError); ok {
+			f.torn = err
+		}
+		return Entry{}, err
 	}
 	hint := EncodeHint(timeStamp, keySize, valueSize, valueOffset, key)
-	_, err = AppendToFile(f.hintFile, hint)
-	if err != nil {
-		panic(err)
+	if err := f.appendHint(hint); err != nil {
+		return Entry{}, err
 	}
-	f.offset += uint64(HeaderSize + keySize + valueSize)
+	f.offset += uint64(len(entry))
+	f.metrics.wrote(len(entry))
+	f.metrics.recorded(f.fileID, 1)
 	return Entry{
 		fileID:      f.fileID,
 		valueSize:   valueSize,
 		valueOffset: valueOffset,
 		timeStamp:   timeStamp,
+		flags:       flags,
 	}, nil
 }
 
-func (f *DBFile) Del(key []byte) error {
-	timeStamp := uint32(time.Now().Unix())
-	keySize := uint32(0)
-	valueSize := uint32(0)
-	entry := EncodeEntry(timeStamp, keySize, valueSize, key, nil)
-	valueOffset := f.offset + uint64(HeaderSize+keySize)
-	_, err := AppendToFile(f.file, entry)
-	if err != nil {
-		panic(err)
+// appendHint appends the hint of the record just appended, or cuts the
+// record off again if it can't, so no record outlives its hint.
+func (f *DBFile) appendHint(hint []byte) error {
+	_, err := AppendToFile(f.hintFile, hint)
+	if err == nil {
+		return nil
 	}
-	hint := EncodeHint(timeStamp, keySize, valueSize, valueOffset, key)
-	_, err = AppendToFile(f.hintFile, hint)
-	if err != nil {
-		panic(err)
+	if terr := f.file.Truncate(int64(f.offset)); terr != nil {
+		err = &TornAppendError{err, terr}
 	}
-	f.offset += uint64(HeaderSize + keySize + valueSize)
-	return nil
+	if _, ok := err.(*TornAppendError); ok {
+		f.torn = err
+	}
+	return err
+}
+
+func (f *DBFile) Del(key []byte) error {
+	_, err := f.WriteWithFlags(key, nil, FlagTombstone)
+	return err
 }
 
 type DBFiles struct {
@@ -118,13 +159,30 @@ func (fs *DBFiles) Put(fileID uint32, file *DBFile) {
 	fs.files[fileID] = file
 }
 
+// OpenFiles counts the file handles held.
+func (fs *DBFiles) OpenFiles() int {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
+	n := 0
+	for _, f := range fs.files {
+		n++
+		if f.hintFile != nil {
+			n++
+		}
+	}
+	return n
+}
+
 func (fs *DBFiles) Close() {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
 
 	for _, f := range fs.files {
 		f.file.Close()
-		f.hintFile.Close()
+		if f.hintFile != nil {
+			f.hintFile.Close()
+		}
 	}
 }
 
@@ -137,8 +195,10 @@ func (fs *DBFiles) DelWithFileID(fileID uint32) error {
 		if err := bf.file.Close(); err != nil {
 			return err
 		}
-		if err := bf.hintFile.Close(); err != nil {
-			return err
+		if bf.hintFile != nil {
+			if err := bf.hintFile.Close(); err != nil {
+				return err
+			}
 		}
 		bf.offset = 0
 	}
@@ -0,0 +1,108 @@
+package Bitcask
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// File is an open file of a FileSystem. *os.File is one.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FileSystem is where a store keeps its files, set by Options.FileSystem.
+// Errors must satisfy os.IsNotExist and os.IsExist as those of package os
+// do.
+type FileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	MkdirAll(path string, perm os.FileMode) error
+	// ReadDirNames returns the names of the entries of dir, in no
+	// particular order.
+	ReadDirNames(dir string) ([]string, error)
+}
+
+// OSFS is the FileSystem of the operating system.
+type OSFS struct{}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// not a nil File holding a nil *os.File
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSFS) ReadDirNames(dir string) ([]string, error) {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return fp.Readdirnames(-1)
+}
+
+func openRead(fs FileSystem, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func readFile(fs FileSystem, name string) ([]byte, error) {
+	fp, err := openRead(fs, name)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return ioutil.ReadAll(fp)
+}
+
+// writeFileAtomic replaces name with data, so readers see either the old
+// or the new content.
+func writeFileAtomic(fs FileSystem, name string, data []byte) error {
+	tmp := name + ".tmp"
+	fp, err := fs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(tmp, name)
+}
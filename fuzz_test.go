@@ -0,0 +1,273 @@
+package Bitcask
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func seedRecords() [][]byte {
+	meta, flags, _ := EncodeValue([]byte("v"), &Meta{ContentType: "text/plain", ExpiresAt: time.Unix(1<<31, 0)})
+	compressed, _ := FlateCodec{}.Compress(bytes.Repeat([]byte("value"), 20))
+	catalog, key := catalogKey(1, "b"), bucketKey(1, []byte("k"))
+	return [][]byte{
+		EncodeEntry(6, PackKeySize(FlagBucket, uint32(len(catalog))), 0, catalog, nil),
+		EncodeEntry(7, PackKeySize(FlagBucket, uint32(len(key))), 1, key, []byte("v")),
+		EncodeEntry(5, PackKeySize(FlateCodec{}.ID()<<codecShift, 1), uint32(len(compressed)), []byte("z"), compressed),
+		EncodeEntry(1, PackKeySize(0, 3), 5, []byte("key"), []byte("value")),
+		EncodeEntry(2, PackKeySize(FlagTombstone, 3), 0, []byte("key"), nil),
+		EncodeEntry(3, PackKeySize(flags, 1), uint32(len(meta)), []byte("m"), meta),
+		EncodeEntry(4, PackKeySize(FlagBatch, 1), 1, []byte("b"), []byte("1")),
+		EncodeEntry(0, 0, 0, nil, nil),
+	}
+}
+
+func seedHints() [][]byte {
+	return [][]byte{
+		EncodeHint(1, PackKeySize(0, 3), 5, HeaderSize+3, []byte("key")),
+		EncodeHint(2, PackKeySize(FlagTombstone, 3), 0, 24+HeaderSize+3, []byte("key")),
+		EncodeHint(3, PackKeySize(FlagBatch, 1), 1, HeaderSize+1, []byte("b")),
+		EncodeHint(0, 0, 0, 0, nil),
+	}
+}
+
+func FuzzDecodeEntryHeader(f *testing.F) {
+	for _, rec := range seedRecords() {
+		f.Add(rec)
+	}
+	f.Add([]byte{1, 2, 3})
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		_, _, _, valueSize, err := DecodeEntryHeader(buf)
+		if err != nil {
+			if _, ok := err.(*SizeError); !ok {
+				t.Fatalf("error %T %v", err, err)
+			}
+			return
+		}
+		if len(buf) < HeaderSize || valueSize > MaxValueSize {
+			t.Fatalf("accepted %d bytes with value size %d", len(buf), valueSize)
+		}
+		EntryFlags(buf)
+	})
+}
+
+func FuzzDecodeEntry(f *testing.F) {
+	for _, rec := range seedRecords() {
+		f.Add(rec)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		value, err := DecodeEntry(buf)
+		if err != nil {
+			return
+		}
+		_, tStamp, keySize, valueSize, _ := DecodeEntryHeader(buf)
+		end := HeaderSize + keySize + valueSize
+		packed := PackKeySize(EntryFlags(buf), keySize)
+		if enc := EncodeEntry(tStamp, packed, valueSize, buf[HeaderSize:HeaderSize+keySize], value); !bytes.Equal(enc, buf[:end]) {
+			t.Fatalf("decoded %x, encodes back as %x", buf[:end], enc)
+		}
+	})
+}
+
+func FuzzDecodeHint(f *testing.F) {
+	for _, hint := range seedHints() {
+		f.Add(hint)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		_, _, valueSize, valuePos, err := DecodeHint(buf)
+		if err != nil {
+			if _, ok := err.(*SizeError); !ok {
+				t.Fatalf("error %T %v", err, err)
+			}
+			return
+		}
+		if len(buf) < HintHeaderSize || valuePos+uint64(valueSize) > maxOffset {
+			t.Fatalf("accepted %d bytes with value at %d+%d", len(buf), valuePos, valueSize)
+		}
+		HintFlags(buf)
+	})
+}
+
+// FuzzReadRecords checks that the file and stream decoders agree and that
+// whatever they accept encodes back to the same bytes.
+func FuzzReadRecords(f *testing.F) {
+	f.Add(bytes.Join(seedRecords(), nil))
+	for _, rec := range seedRecords() {
+		f.Add(rec)
+		f.Add(rec[:len(rec)-1])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var recs []*Record
+		err := ReadRecords(bytes.NewReader(data), int64(len(data)), func(rec *Record) error {
+			recs = append(recs, rec)
+			return nil
+		})
+		if _, ok := err.(*RecordError); err != nil && !ok {
+			t.Fatalf("error %T %v", err, err)
+		}
+		for _, rec := range recs {
+			packed := PackKeySize(rec.Flags, uint32(len(rec.Key)))
+			enc := EncodeEntry(rec.TimeStamp, packed, uint32(len(rec.Value)), rec.Key, rec.Value)
+			if !bytes.Equal(enc, data[rec.Offset:rec.Offset+rec.Size()]) {
+				t.Fatalf("record at %d encodes back as %x", rec.Offset, enc)
+			}
+		}
+
+		r := bytes.NewReader(data)
+		offset := int64(0)
+		for i := 0; ; i++ {
+			rec, serr := DecodeRecord(r, offset)
+			if serr == io.EOF {
+				if err != nil || i != len(recs) {
+					t.Fatalf("stream ended after %d records, file had %d and %v", i, len(recs), err)
+				}
+				return
+			}
+			if serr != nil {
+				if _, ok := serr.(*RecordError); !ok {
+					t.Fatalf("stream error %T %v", serr, serr)
+				}
+				if err == nil || i != len(recs) {
+					t.Fatalf("stream failed after %d records with %v, file had %d and %v", i, serr, len(recs), err)
+				}
+				return
+			}
+			if i >= len(recs) || rec.Offset != recs[i].Offset || !bytes.Equal(rec.Value, recs[i].Value) {
+				t.Fatalf("stream record %d at %d differs from the file", i, offset)
+			}
+			offset += rec.Size()
+		}
+	})
+}
+
+func FuzzReadHints(f *testing.F) {
+	f.Add(bytes.Join(seedHints(), nil))
+	for _, hint := range seedHints() {
+		f.Add(hint)
+		f.Add(hint[:len(hint)-1])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		err := ReadHints(bytes.NewReader(data), int64(len(data)), func(h *Hint) error {
+			if h.Offset+h.Size() > int64(len(data)) {
+				t.Fatalf("hint at %d runs past the end", h.Offset)
+			}
+			return nil
+		})
+		if _, ok := err.(*RecordError); err != nil && !ok {
+			t.Fatalf("error %T %v", err, err)
+		}
+	})
+}
+
+func FuzzDecodeValue(f *testing.F) {
+	for _, rec := range seedRecords() {
+		f.Add(rec[HeaderSize:], EntryFlags(rec))
+	}
+	f.Fuzz(func(t *testing.T, stored []byte, flags uint8) {
+		value, meta, err := DecodeValue(stored, flags)
+		if err != nil {
+			return
+		}
+		if flags&(FlagMeta|CodecFlags) == 0 && !bytes.Equal(value, stored) {
+			t.Fatalf("value without meta changed")
+		}
+		meta.Expired(time.Now())
+	})
+}
+
+func FuzzDecodeDumpRecord(f *testing.F) {
+	f.Add(EncodeDumpRecord(&DumpRecord{TimeStamp: 1, Key: []byte("key"), Value: []byte("value")}))
+	f.Add(EncodeDumpRecord(&DumpRecord{TimeStamp: 1, ExpiresAt: 2, Key: []byte("k")}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rec, err := DecodeDumpRecord(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if enc := EncodeDumpRecord(rec); !bytes.Equal(enc, data[:len(enc)]) {
+			t.Fatalf("dump record encodes back as %x", enc)
+		}
+	})
+}
+
+// FuzzOpen opens a store whose older file has fuzzed hints and whose active
+// file has fuzzed data. Open may refuse it, but must not panic, and every
+// key it loads must be readable or fail with an error.
+func FuzzOpen(f *testing.F) {
+	data := bytes.Join(seedRecords(), nil)
+	hints := EncodeHint(1, PackKeySize(0, 3), 5, HeaderSize+3, []byte("key"))
+	f.Add(data, hints, data)
+	f.Add(data, seedHints()[1], data[:len(data)-3])
+	f.Add([]byte{}, []byte{}, []byte{})
+	if sealedData, sealedHints, err := sealedFiles(); err != nil {
+		f.Fatal(err)
+	} else {
+		f.Add(sealedData, sealedHints, sealedData)
+	}
+	f.Fuzz(func(t *testing.T, oldData, oldHints, activeData []byte) {
+		log.SetOutput(ioutil.Discard)
+		defer log.SetOutput(os.Stderr)
+
+		fs := NewMemFS()
+		fs.MkdirAll("/db", 0755)
+		for name, content := range map[string][]byte{
+			"/db/1.data": oldData,
+			"/db/1.hint": oldHints,
+			"/db/2.data": activeData,
+			"/db/2.hint": nil,
+		} {
+			fp, _ := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+			fp.Write(content)
+			fp.Close()
+		}
+		opt := NewOptions(0, 0, -1, 0, true)
+		opt.FileSystem = fs
+		opt.Encryption = fuzzKeys
+		bc, err := Open("/db", opt)
+		if err != nil {
+			return
+		}
+		defer bc.Close()
+		for _, key := range bc.Keys() {
+			bc.Get(key)
+		}
+		for _, name := range bc.Buckets() {
+			bc.Bucket(name).Scan(nil, func(key, value []byte) error {
+				return nil
+			})
+		}
+	})
+}
+
+var fuzzKeys = &StaticKeys{Keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 16)}, Current: 1}
+
+// sealedFiles returns the data and hint file of a store holding an
+// encrypted record.
+func sealedFiles() ([]byte, []byte, error) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	fs := NewMemFS()
+	opt := NewOptions(0, 0, -1, 0, true)
+	opt.FileSystem = fs
+	opt.Encryption = fuzzKeys
+	bc, err := Open("/db", opt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := bc.Put([]byte("key"), []byte("value")); err != nil {
+		return nil, nil, err
+	}
+	name := "/db/" + strconv.Itoa(int(bc.writeFile.fileID))
+	bc.Close()
+	data, err := readFile(fs, name+".data")
+	if err != nil {
+		return nil, nil, err
+	}
+	hints, err := readFile(fs, name+".hint")
+	return data, hints, err
+}
@@ -2,11 +2,9 @@ package main
 
 import (
 	"Bitcask"
+	"Bitcask/httpapi"
 	"context"
 	"flag"
-	"fmt"
-	"github.com/gorilla/mux"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -21,7 +19,9 @@ var (
 	merged      bool
 	interval    int64
 	maxSize     uint64
-	bc          *Bitcask.BitCask
+	prefix      string
+	leader      string
+	compress    bool
 )
 
 func main() {
@@ -29,14 +29,24 @@ func main() {
 	flag.StringVar(&storagePath, "s", "Storage", "data storage path")
 	flag.BoolVar(&merged, "m", true, "true: open file merge; false: not open file merge ")
 	flag.Int64Var(&interval, "t", 3600, "interval for file merging")
-	flag.Uint64Var(&maxSize, "ms", 1<<32, "single data file maxsize")
+	flag.Uint64Var(&maxSize, "ms", 1<<31, "single data file maxsize")
+	flag.StringVar(&prefix, "prefix", "", "path prefix the api is served under")
+	flag.StringVar(&leader, "leader", "", "serve a read-only replica of the bitcask http api at this url")
+	flag.BoolVar(&compress, "z", false, "compress values with flate")
 	flag.Parse()
 
 	opt := &Bitcask.Options{
-		MaxFileSize: maxSize,
+		MaxFileSize:     maxSize,
+		CompressMinSize: 256,
 	}
-	var err error
-	bc, err = Bitcask.Open(storagePath, opt)
+	if compress {
+		opt.Compression = Bitcask.FlateCodec{}
+	}
+	open := Bitcask.Open
+	if leader != "" {
+		open = Bitcask.OpenReplica
+	}
+	bc, err := open(storagePath, opt)
 
 	if err != nil {
 		log.Fatalln(err)
@@ -48,21 +58,25 @@ func main() {
 			debug.PrintStack()
 		}
 	}()
+	var follower *httpapi.Follower
+	if leader != "" {
+		// the leader merges, its replicas follow
+		merged = false
+		follower = httpapi.NewFollower(bc, leader, httpapi.FollowerOptions{})
+		follower.Start()
+		log.Println("Replicate from : ", leader)
+	}
 	if merged {
 		mergeWorker := Bitcask.NewMerge(bc, interval)
 		mergeWorker.Start()
 		defer mergeWorker.Stop()
 	}
 
-	r := mux.NewRouter()
-	r.HandleFunc("/{key}", Get).Methods("GET")
-	r.HandleFunc("/{key}", Del).Methods("DELETE")
-	r.HandleFunc("/{key}", Put).Methods("POST")
 	log.Println("Bitcask listen at : ", addr)
 
 	s := &http.Server{
 		Addr:    addr,
-		Handler: r,
+		Handler: httpapi.NewHandler(bc, httpapi.HandlerOptions{Prefix: prefix, Follower: follower}),
 	}
 
 	go func() {
@@ -71,11 +85,14 @@ func main() {
 		}
 	}()
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	<-quit
 
 	log.Println("Shutdown Server ...")
+	if follower != nil {
+		follower.Stop()
+	}
 	bc.Close()
 	log.Println("Close the db ...")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -86,65 +103,3 @@ func main() {
 
 	log.Println("Server exiting")
 }
-
-func Put(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	key := vars["key"]
-	if len(key) <= 0 {
-		writer.Write([]byte(fmt.Sprintf("Key : %s is invalid", key)))
-		return
-	}
-	value, err := ioutil.ReadAll(request.Body)
-	if err != nil {
-		log.Fatalln(err)
-		writer.WriteHeader(500)
-		return
-	}
-	bc.Put([]byte(key), value)
-	writer.Write([]byte("Success!"))
-	writer.WriteHeader(200)
-}
-
-func Del(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	key := vars["key"]
-	if len(key) <= 0 {
-		writer.Write([]byte(fmt.Sprintf("Key : %s is invalid", key)))
-		return
-	}
-	err := bc.Del([]byte(key))
-	if err != nil && err != Bitcask.KeyNotFoundErr {
-		writer.Write([]byte(err.Error()))
-		writer.WriteHeader(500)
-		return
-	}
-	if err == Bitcask.KeyNotFoundErr {
-		writer.Write([]byte(err.Error()))
-		writer.WriteHeader(404)
-		return
-	}
-	writer.Write([]byte("Success"))
-	writer.WriteHeader(200)
-}
-
-func Get(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	key := vars["key"]
-	if len(key) <= 0 {
-		writer.Write([]byte(fmt.Sprintf("Key : %s is invalid", key)))
-		return
-	}
-	value, err := bc.Get([]byte(key))
-	if err != nil && err != Bitcask.KeyNotFoundErr {
-		writer.Write([]byte(err.Error()))
-		writer.WriteHeader(500)
-		return
-	}
-	if err == Bitcask.KeyNotFoundErr {
-		writer.Write([]byte(err.Error()))
-		writer.WriteHeader(404)
-		return
-	}
-	writer.Write(value)
-	writer.WriteHeader(200)
-}
@@ -0,0 +1,212 @@
+package httpapi
+
+import (
+	"Bitcask"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"unicode/utf8"
+)
+
+const (
+	defaultMaxBatchBytes = 8 << 20
+	defaultMaxBatchOps   = 1000
+
+	// a binary batch is a sequence of op:ksz:valueSz(1:4:4):key:value
+	batchOpHeaderSize = 9
+	batchOpPut        = 'P'
+	batchOpDel        = 'D'
+)
+
+type batchRequest struct {
+	Ops []batchRequestOp `json:"ops"`
+}
+
+// batchRequestOp is one put or delete. A put value is given either as the
+// string Value or as ValueBase64.
+type batchRequestOp struct {
+	Op          string  `json:"op"`
+	Key         string  `json:"key"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 []byte  `json:"value_base64,omitempty"`
+	ContentType string  `json:"content_type,omitempty"`
+}
+
+type batchResponse struct {
+	Applied int `json:"applied"`
+}
+
+type mgetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type mgetResult struct {
+	Key         string `json:"key"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 []byte `json:"value_base64,omitempty"`
+	Missing     bool   `json:"missing,omitempty"`
+}
+
+type mgetResponse struct {
+	Results []mgetResult `json:"results"`
+}
+
+// readBody reads the request body, writing a 413 or 400 and returning nil
+// when it is longer than h.maxBatchBytes or can't be read.
+func (h *handler) readBody(writer http.ResponseWriter, request *http.Request) []byte {
+	tooLarge := fmt.Errorf("Body exceeds %d bytes", h.maxBatchBytes)
+	if request.ContentLength > h.maxBatchBytes {
+		writeError(writer, http.StatusRequestEntityTooLarge, tooLarge)
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, h.maxBatchBytes+1))
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return nil
+	}
+	if int64(len(body)) > h.maxBatchBytes {
+		writeError(writer, http.StatusRequestEntityTooLarge, tooLarge)
+		return nil
+	}
+	return body
+}
+
+// batch applies every operation of the body atomically. The body is JSON
+// ({"ops": [...]}) unless the Content-Type is application/octet-stream, in
+// which case it is the binary format described by batchOpHeaderSize.
+func (h *handler) batch(writer http.ResponseWriter, request *http.Request) {
+	body := h.readBody(writer, request)
+	if body == nil {
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	var b *Bitcask.Batch
+	var err error
+	if mediaType == "application/octet-stream" {
+		b, err = h.decodeBinaryBatch(body)
+	} else {
+		b, err = h.decodeJSONBatch(body)
+	}
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+	if err := h.bc.Write(b); err != nil {
+		writeError(writer, statusOf(err), err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(batchResponse{Applied: b.Len()})
+}
+
+func (h *handler) decodeJSONBatch(body []byte) (*Bitcask.Batch, error) {
+	req := &batchRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	if len(req.Ops) > h.maxBatchOps {
+		return nil, fmt.Errorf("Batch has %d ops, limit is %d", len(req.Ops), h.maxBatchOps)
+	}
+	b := Bitcask.NewBatch()
+	for i, op := range req.Ops {
+		if len(op.Key) == 0 || len(op.Key) > Bitcask.MaxKeySize {
+			return nil, fmt.Errorf("Op %d : key is invalid", i)
+		}
+		switch op.Op {
+		case "put":
+			value := op.ValueBase64
+			if op.Value != nil {
+				value = []byte(*op.Value)
+			}
+			if value == nil {
+				value = []byte{}
+			}
+			b.PutWithMeta([]byte(op.Key), value, &Bitcask.Meta{ContentType: op.ContentType})
+		case "delete", "del":
+			b.Del([]byte(op.Key))
+		default:
+			return nil, fmt.Errorf("Op %d : %q is not put or delete", i, op.Op)
+		}
+	}
+	return b, nil
+}
+
+func (h *handler) decodeBinaryBatch(body []byte) (*Bitcask.Batch, error) {
+	b := Bitcask.NewBatch()
+	for len(body) > 0 {
+		if b.Len() == h.maxBatchOps {
+			return nil, fmt.Errorf("Batch has more than %d ops", h.maxBatchOps)
+		}
+		if len(body) < batchOpHeaderSize {
+			return nil, io.ErrUnexpectedEOF
+		}
+		op := body[0]
+		keySize := uint64(binary.LittleEndian.Uint32(body[1:5]))
+		valueSize := uint64(binary.LittleEndian.Uint32(body[5:9]))
+		if uint64(len(body)-batchOpHeaderSize) < keySize+valueSize {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if keySize == 0 || keySize > Bitcask.MaxKeySize {
+			return nil, fmt.Errorf("Op %d : key is invalid", b.Len())
+		}
+		key := body[batchOpHeaderSize : batchOpHeaderSize+keySize]
+		value := body[batchOpHeaderSize+keySize : batchOpHeaderSize+keySize+valueSize]
+		switch op {
+		case batchOpPut:
+			b.Put(key, value)
+		case batchOpDel:
+			b.Del(key)
+		default:
+			return nil, fmt.Errorf("Op %d : %q is not P or D", b.Len(), op)
+		}
+		body = body[batchOpHeaderSize+keySize+valueSize:]
+	}
+	return b, nil
+}
+
+// mget returns the values of {"keys": [...]} in request order, all read at
+// the same point in time.
+func (h *handler) mget(writer http.ResponseWriter, request *http.Request) {
+	body := h.readBody(writer, request)
+	if body == nil {
+		return
+	}
+	req := &mgetRequest{}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(req); err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Keys) > h.maxBatchOps {
+		writeError(writer, http.StatusBadRequest, fmt.Errorf("Request has %d keys, limit is %d", len(req.Keys), h.maxBatchOps))
+		return
+	}
+	keys := make([][]byte, len(req.Keys))
+	for i, k := range req.Keys {
+		keys[i] = []byte(k)
+	}
+	values, err := h.bc.MGet(keys)
+	if err != nil {
+		writeError(writer, statusOf(err), err)
+		return
+	}
+	resp := mgetResponse{Results: make([]mgetResult, len(keys))}
+	for i, value := range values {
+		r := mgetResult{Key: req.Keys[i]}
+		switch {
+		case value == nil:
+			r.Missing = true
+		case utf8.Valid(value):
+			r.Value = string(value)
+		default:
+			r.ValueBase64 = value
+		}
+		resp.Results[i] = r
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(resp)
+}
@@ -0,0 +1,218 @@
+package httpapi
+
+import (
+	"Bitcask"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultContentType = "application/octet-stream"
+
+type HandlerOptions struct {
+	// Prefix is the path the API is mounted under, for example "/kv".
+	// Empty mounts it at the root.
+	Prefix string
+	// MaxBatchBytes limits the body of /_batch and /_mget, 8M if zero.
+	MaxBatchBytes int64
+	// MaxBatchOps limits the operations of /_batch and keys of /_mget,
+	// 1000 if zero.
+	MaxBatchOps int
+	// Follower, if bc is a replica, is reported by /_repl/status.
+	Follower *Follower
+}
+
+type handler struct {
+	bc            *Bitcask.BitCask
+	maxBatchBytes int64
+	maxBatchOps   int
+	follower      *Follower
+}
+
+// NewHandler returns the HTTP API for bc, ready to be mounted in any server.
+//
+//	GET    /{key}        value with the Content-Type it was stored with
+//	HEAD   /{key}        existence, Content-Length and Content-Type
+//	PUT    /{key}        store the body, keeping its Content-Type
+//	POST   /{key}        same as PUT
+//	DELETE /{key}        delete
+//	POST   /{key}/incr   add ?delta= (default 1) to an integer value
+//	GET    /keys         page of keys, see listKeys
+//	GET    /scan         keys and values as JSON Lines, see scan
+//	POST   /_batch       apply puts and deletes atomically, see batch
+//	POST   /_mget        read many keys at once, see mget
+//	GET    /_watch       changes as Server-Sent Events or long-poll, see watch
+//	GET    /_changes     changes replayed from the data files, see changes
+//	GET    /_repl/state  data files for a follower to copy, see replState
+//	GET    /_repl/files/{id}  raw records of a data file, see replFile
+//	GET    /_repl/status replication lag, when serving a Follower's replica
+//	GET    /_stats       state of the store and its data files, see stats
+//	GET    /metrics      Prometheus metrics, see metrics
+//
+// /keys and /scan take prefix, start, limit and cursor query parameters,
+// /keys also encoding.
+//
+// Errors are returned as {"error": "..."} with a matching status code.
+func NewHandler(bc *Bitcask.BitCask, opt HandlerOptions) http.Handler {
+	h := &handler{
+		bc:            bc,
+		maxBatchBytes: opt.MaxBatchBytes,
+		maxBatchOps:   opt.MaxBatchOps,
+		follower:      opt.Follower,
+	}
+	if h.maxBatchBytes <= 0 {
+		h.maxBatchBytes = defaultMaxBatchBytes
+	}
+	if h.maxBatchOps <= 0 {
+		h.maxBatchOps = defaultMaxBatchOps
+	}
+	root := mux.NewRouter()
+	r := root
+	if prefix := strings.TrimSuffix(opt.Prefix, "/"); prefix != "" {
+		r = root.PathPrefix(prefix).Subrouter()
+	}
+	r.HandleFunc("/_batch", h.batch).Methods("POST")
+	r.HandleFunc("/_mget", h.mget).Methods("POST")
+	r.HandleFunc("/keys", h.listKeys).Methods("GET")
+	r.HandleFunc("/scan", h.scan).Methods("GET")
+	r.HandleFunc("/_watch", h.watch).Methods("GET")
+	r.HandleFunc("/_changes", h.changes).Methods("GET")
+	r.HandleFunc("/_repl/state", h.replState).Methods("GET")
+	r.HandleFunc("/_repl/files/{id:[0-9]+}", h.replFile).Methods("GET")
+	if h.follower != nil {
+		r.HandleFunc("/_repl/status", h.replStatus).Methods("GET")
+	}
+	r.HandleFunc("/_stats", h.stats).Methods("GET")
+	r.HandleFunc("/metrics", h.metrics).Methods("GET")
+	r.HandleFunc("/{key}", h.get).Methods("GET", "HEAD")
+	r.HandleFunc("/{key}", h.del).Methods("DELETE")
+	r.HandleFunc("/{key}", h.put).Methods("PUT", "POST")
+	r.HandleFunc("/{key}/incr", h.incr).Methods("POST")
+	root.NotFoundHandler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writeError(writer, http.StatusNotFound, fmt.Errorf("No route for %s", request.URL.Path))
+	})
+	root.MethodNotAllowedHandler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writeError(writer, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", request.Method))
+	})
+	return root
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+// writeError sends err as a JSON body. Headers must not have been written.
+func writeError(writer http.ResponseWriter, code int, err error) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(code)
+	json.NewEncoder(writer).Encode(errorBody{Error: strings.TrimSpace(err.Error())})
+}
+
+// statusOf maps store errors to HTTP status codes.
+func statusOf(err error) int {
+	switch err {
+	case Bitcask.KeyNotFoundErr:
+		return http.StatusNotFound
+	case Bitcask.NotIntegerErr, Bitcask.OverflowErr:
+		return http.StatusConflict
+	case Bitcask.HistoryUnavailableErr:
+		return http.StatusGone
+	case Bitcask.ReadOnlyErr:
+		return http.StatusForbidden
+	case Bitcask.DataFileNotFoundErr:
+		return http.StatusNotFound
+	case Bitcask.KeyTooLargeErr, Bitcask.MetaSizeErr:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// keyOf returns the key of the request, or writes a 400 and returns nil.
+func keyOf(writer http.ResponseWriter, request *http.Request) []byte {
+	key := mux.Vars(request)["key"]
+	if len(key) == 0 || len(key) > Bitcask.MaxKeySize {
+		writeError(writer, http.StatusBadRequest, fmt.Errorf("Key : %.64s is invalid", key))
+		return nil
+	}
+	return []byte(key)
+}
+
+func (h *handler) put(writer http.ResponseWriter, request *http.Request) {
+	key := keyOf(writer, request)
+	if key == nil {
+		return
+	}
+	value, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+	meta := &Bitcask.Meta{ContentType: request.Header.Get("Content-Type")}
+	if err := h.bc.PutWithMeta(key, value, meta); err != nil {
+		writeError(writer, statusOf(err), err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) del(writer http.ResponseWriter, request *http.Request) {
+	key := keyOf(writer, request)
+	if key == nil {
+		return
+	}
+	if err := h.bc.Del(key); err != nil {
+		writeError(writer, statusOf(err), err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) get(writer http.ResponseWriter, request *http.Request) {
+	key := keyOf(writer, request)
+	if key == nil {
+		return
+	}
+	value, meta, err := h.bc.GetWithMeta(key)
+	if err != nil {
+		writeError(writer, statusOf(err), err)
+		return
+	}
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	writer.Header().Set("Content-Type", contentType)
+	writer.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	writer.WriteHeader(http.StatusOK)
+	if request.Method != "HEAD" {
+		writer.Write(value)
+	}
+}
+
+func (h *handler) incr(writer http.ResponseWriter, request *http.Request) {
+	key := keyOf(writer, request)
+	if key == nil {
+		return
+	}
+	delta := int64(1)
+	if d := request.URL.Query().Get("delta"); d != "" {
+		var err error
+		delta, err = strconv.ParseInt(d, 10, 64)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, fmt.Errorf("Delta : %s is invalid", d))
+			return
+		}
+	}
+	n, err := h.bc.Incr(key, delta)
+	if err != nil {
+		writeError(writer, statusOf(err), err)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writer.Write([]byte(strconv.FormatInt(n, 10)))
+}
@@ -0,0 +1,125 @@
+package httpapi
+
+import (
+	"Bitcask"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func openTest(t *testing.T) *Bitcask.BitCask {
+	t.Helper()
+	bc, err := Bitcask.Open(t.TempDir(), Bitcask.NewOptions(0, 0, -1, 0, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(bc.Close)
+	return bc
+}
+
+// do serves one request and returns the response, failing unless its
+// status is code.
+func do(t *testing.T, h http.Handler, method, target, body string, code int) *http.Response {
+	t.Helper()
+	var req *http.Request
+	if body == "" {
+		req = httptest.NewRequest(method, target, nil)
+	} else {
+		req = httptest.NewRequest(method, target, strings.NewReader(body))
+	}
+	if method == "PUT" || method == "POST" {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	resp := w.Result()
+	if resp.StatusCode != code {
+		buf, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("%s %s: status %d, want %d: %s", method, target, resp.StatusCode, code, buf)
+	}
+	return resp
+}
+
+func bodyOf(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestHandlerStatusCodes(t *testing.T) {
+	h := NewHandler(openTest(t), HandlerOptions{})
+
+	do(t, h, "PUT", "/a", "hello", http.StatusNoContent)
+	resp := do(t, h, "GET", "/a", "", http.StatusOK)
+	if body := bodyOf(t, resp); body != "hello" {
+		t.Fatalf("GET /a = %q", body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain" {
+		t.Fatalf("GET /a Content-Type %q", ct)
+	}
+	resp = do(t, h, "HEAD", "/a", "", http.StatusOK)
+	if resp.Header.Get("Content-Length") != "5" || bodyOf(t, resp) != "" {
+		t.Fatalf("HEAD /a headers %v", resp.Header)
+	}
+	do(t, h, "POST", "/b", "posted", http.StatusNoContent)
+
+	resp = do(t, h, "GET", "/missing", "", http.StatusNotFound)
+	var e errorBody
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+		t.Fatalf("404 body is not a JSON error: %v", err)
+	}
+	do(t, h, "HEAD", "/missing", "", http.StatusNotFound)
+	do(t, h, "DELETE", "/missing", "", http.StatusNotFound)
+	do(t, h, "DELETE", "/a", "", http.StatusNoContent)
+	do(t, h, "GET", "/a", "", http.StatusNotFound)
+
+	resp = do(t, h, "POST", "/n/incr?delta=5", "", http.StatusOK)
+	if body := bodyOf(t, resp); body != "5" {
+		t.Fatalf("incr = %q", body)
+	}
+	do(t, h, "POST", "/n/incr?delta=x", "", http.StatusBadRequest)
+	do(t, h, "POST", "/b/incr", "", http.StatusConflict)
+
+	req := httptest.NewRequest("PUT", "/c", strings.NewReader("x"))
+	req.Header.Set("Content-Type", strings.Repeat("x", 1<<16))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("PUT with an oversized Content-Type: status %d", w.Code)
+	}
+
+	do(t, h, "PATCH", "/b", "", http.StatusMethodNotAllowed)
+	do(t, h, "GET", "/b/c/d", "", http.StatusNotFound)
+}
+
+func TestHandlerPrefix(t *testing.T) {
+	h := NewHandler(openTest(t), HandlerOptions{Prefix: "/kv/"})
+	do(t, h, "PUT", "/kv/a", "1", http.StatusNoContent)
+	do(t, h, "GET", "/kv/a", "", http.StatusOK)
+	do(t, h, "GET", "/a", "", http.StatusNotFound)
+}
+
+func TestHandlerReplicaReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	bc, err := Bitcask.Open(dir, Bitcask.NewOptions(0, 0, -1, 0, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.Put([]byte("a"), []byte("1"))
+	bc.Close()
+	replica, err := Bitcask.OpenReplica(dir, Bitcask.NewOptions(0, 0, -1, 0, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	h := NewHandler(replica, HandlerOptions{})
+	do(t, h, "GET", "/a", "", http.StatusOK)
+	do(t, h, "PUT", "/a", "2", http.StatusForbidden)
+	do(t, h, "DELETE", "/a", "", http.StatusForbidden)
+}
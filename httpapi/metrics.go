@@ -0,0 +1,106 @@
+package httpapi
+
+import (
+	"Bitcask"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type statsBody struct {
+	*Bitcask.Stats
+	Replication *FollowerStatus `json:"replication,omitempty"`
+}
+
+// stats serves Bitcask.Stats as JSON, with the replication status when
+// serving a Follower's replica.
+func (h *handler) stats(writer http.ResponseWriter, request *http.Request) {
+	stats, err := h.bc.Stats()
+	if err != nil {
+		writeError(writer, statusOf(err), err)
+		return
+	}
+	body := statsBody{Stats: stats}
+	if h.follower != nil {
+		status := h.follower.Status()
+		body.Replication = &status
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(body)
+}
+
+// metrics serves Bitcask.Stats in the Prometheus text format, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+func (h *handler) metrics(writer http.ResponseWriter, request *http.Request) {
+	stats, err := h.bc.Stats()
+	if err != nil {
+		writeError(writer, statusOf(err), err)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w := bufio.NewWriter(writer)
+	defer w.Flush()
+
+	gauge(w, "bitcask_keys", "Number of live keys.", float64(stats.Keys))
+	gauge(w, "bitcask_data_files", "Number of data files.", float64(stats.DataFiles))
+	gauge(w, "bitcask_data_bytes", "Size of the data files.", float64(stats.DataBytes))
+	gauge(w, "bitcask_live_bytes", "Size of the current records of the live keys.", float64(stats.LiveBytes))
+	gauge(w, "bitcask_dead_bytes", "Size of the records merge can drop.", float64(stats.DeadBytes))
+	counter(w, "bitcask_written_bytes_total", "Bytes of records written to data files.", stats.BytesWritten)
+	counter(w, "bitcask_read_bytes_total", "Bytes of values read from data files.", stats.BytesRead)
+	counter(w, "bitcask_file_rotations_total", "Times the active data file was full and replaced.", stats.Rotations)
+
+	name := "bitcask_operation_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of gets, puts and deletes.\n# TYPE %s histogram\n", name, name)
+	histogram(w, name, `op="get"`, stats.Get)
+	histogram(w, name, `op="put"`, stats.Put)
+	histogram(w, name, `op="del"`, stats.Del)
+
+	name = "bitcask_merge_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Duration of merge runs.\n# TYPE %s histogram\n", name, name)
+	histogram(w, name, "", stats.Merge)
+	counter(w, "bitcask_merge_errors_total", "Merge runs that failed.", stats.MergeErrors)
+
+	if h.follower != nil {
+		status := h.follower.Status()
+		gauge(w, "bitcask_replication_lag_bytes", "Bytes the leader has and the replica not yet.", float64(status.LagBytes))
+		gauge(w, "bitcask_replication_lag_seconds", "Time since the replica last had every record of the leader.", status.LagSeconds)
+	}
+}
+
+func gauge(w *bufio.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+func counter(w *bufio.Writer, name, help string, v uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
+
+// histogram writes the samples of h, whose buckets Prometheus wants
+// cumulative. labels are added to every sample.
+func histogram(w *bufio.Writer, name, labels string, h Bitcask.Histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	n := uint64(0)
+	for i, count := range h.Counts {
+		n += count
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = formatFloat(h.Bounds[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, le, n)
+	}
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.Sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, n)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,128 @@
+package httpapi
+
+import (
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var (
+	helpLine   = regexp.MustCompile(`^# HELP ([a-z_]+) \S.*$`)
+	typeLine   = regexp.MustCompile(`^# TYPE ([a-z_]+) (counter|gauge|histogram)$`)
+	sampleLine = regexp.MustCompile(`^([a-z_]+)(\{[^}]*\})? (\S+)$`)
+)
+
+// family returns the metric a sample belongs to, given the types declared.
+func family(name string, types map[string]string) string {
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		base := strings.TrimSuffix(name, suffix)
+		if base != name && types[base] == "histogram" {
+			return base
+		}
+	}
+	return name
+}
+
+func TestMetricsFormat(t *testing.T) {
+	h := NewHandler(openTest(t), HandlerOptions{})
+	do(t, h, "PUT", "/a", "1", http.StatusNoContent)
+	do(t, h, "PUT", "/b", "2", http.StatusNoContent)
+	do(t, h, "PUT", "/c", "3", http.StatusNoContent)
+	do(t, h, "GET", "/a", "", http.StatusOK)
+	do(t, h, "GET", "/missing", "", http.StatusNotFound)
+	do(t, h, "DELETE", "/c", "", http.StatusNoContent)
+
+	resp := do(t, h, "GET", "/metrics", "", http.StatusOK)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	body := bodyOf(t, resp)
+	if !strings.HasSuffix(body, "\n") {
+		t.Fatal("metrics don't end with a newline")
+	}
+
+	helps, types := make(map[string]bool), make(map[string]string)
+	samples := make(map[string]float64)
+	// the le bounds and cumulative counts of each histogram, in order
+	bounds := make(map[string][]float64)
+	buckets := make(map[string][]float64)
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if m := helpLine.FindStringSubmatch(line); m != nil {
+			if helps[m[1]] {
+				t.Fatalf("HELP of %s repeated", m[1])
+			}
+			helps[m[1]] = true
+			continue
+		}
+		if m := typeLine.FindStringSubmatch(line); m != nil {
+			if types[m[1]] != "" || !helps[m[1]] {
+				t.Fatalf("TYPE of %s repeated or without HELP", m[1])
+			}
+			types[m[1]] = m[2]
+			continue
+		}
+		m := sampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("malformed line %q", line)
+		}
+		name, labels := m[1], m[2]
+		v, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Fatalf("value of %q: %v", line, err)
+		}
+		if types[family(name, types)] == "" {
+			t.Fatalf("sample %q before the TYPE of its metric", line)
+		}
+		if !strings.HasSuffix(name, "_bucket") {
+			samples[name+labels] = v
+			continue
+		}
+		i := strings.Index(labels, `le="`)
+		if i < 0 {
+			t.Fatalf("bucket without le: %q", line)
+		}
+		le, err := strconv.ParseFloat(strings.TrimSuffix(labels[i+4:], `"}`), 64)
+		if err != nil {
+			t.Fatalf("le of %q: %v", line, err)
+		}
+		series := name + "{" + strings.TrimSuffix(labels[1:i], ",") + "}"
+		bounds[series] = append(bounds[series], le)
+		buckets[series] = append(buckets[series], v)
+	}
+
+	for series, les := range bounds {
+		counts := buckets[series]
+		for i := 1; i < len(les); i++ {
+			if les[i] <= les[i-1] || counts[i] < counts[i-1] {
+				t.Fatalf("%s buckets not ascending and cumulative: %v %v", series, les, counts)
+			}
+		}
+		if !math.IsInf(les[len(les)-1], 1) {
+			t.Fatalf("%s has no +Inf bucket", series)
+		}
+	}
+	for op, n := range map[string]float64{"get": 2, "put": 3, "del": 1} {
+		labels := `{op="` + op + `"}`
+		inf := buckets["bitcask_operation_duration_seconds_bucket"+labels]
+		if len(inf) == 0 || inf[len(inf)-1] != n || samples["bitcask_operation_duration_seconds_count"+labels] != n {
+			t.Fatalf("%s histogram counts %v, want %v", op, inf, n)
+		}
+		if _, ok := samples["bitcask_operation_duration_seconds_sum"+labels]; !ok {
+			t.Fatalf("%s histogram has no sum", op)
+		}
+	}
+	if n := samples["bitcask_merge_duration_seconds_count"]; n != 0 {
+		t.Fatalf("merge count %v", n)
+	}
+	if samples["bitcask_keys"] != 2 || samples["bitcask_written_bytes_total"] == 0 {
+		t.Fatalf("samples %v", samples)
+	}
+	for name, typ := range types {
+		if typ == "counter" && !strings.HasSuffix(name, "_total") {
+			t.Fatalf("counter %s not named _total", name)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package httpapi
+
+import (
+	"Bitcask"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultReplRetry = time.Second
+	defaultReplWait  = 30 * time.Second
+	maxReplWait      = 60 * time.Second
+)
+
+// replState returns the data files a follower has to copy, see
+// Bitcask.ReplicaState.
+func (h *handler) replState(writer http.ResponseWriter, request *http.Request) {
+	state, err := h.bc.ReplicaState()
+	if err != nil {
+		writeError(writer, statusOf(err), err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(state)
+}
+
+// replFile sends the raw records of a data file from ?offset= on. With
+// ?wait=seconds and nothing to send yet it first waits for new records.
+func (h *handler) replFile(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(request)["id"], 10, 32)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, fmt.Errorf("File ID : %s is invalid", mux.Vars(request)["id"]))
+		return
+	}
+	q := request.URL.Query()
+	offset := int64(0)
+	if o := q.Get("offset"); o != "" {
+		offset, err = strconv.ParseInt(o, 10, 64)
+		if err != nil || offset < 0 {
+			writeError(writer, http.StatusBadRequest, fmt.Errorf("Offset : %s is invalid", o))
+			return
+		}
+	}
+	if w := q.Get("wait"); w != "" {
+		n, err := strconv.Atoi(w)
+		if err != nil || n < 0 {
+			writeError(writer, http.StatusBadRequest, fmt.Errorf("Wait : %s is invalid", w))
+			return
+		}
+		wait := time.Duration(n) * time.Second
+		if wait > maxReplWait {
+			wait = maxReplWait
+		}
+		h.bc.WaitDataFile(uint32(id), offset, wait)
+	}
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	// after a failure halfway the follower gets whole records up to it only
+	if n, err := h.bc.CopyDataFile(writer, uint32(id), offset); err != nil && n == 0 {
+		writeError(writer, statusOf(err), err)
+	}
+}
+
+func (h *handler) replStatus(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(h.follower.Status())
+}
+
+type FollowerOptions struct {
+	// Retry is how long to wait before reconnecting after an error, 1s if
+	// zero.
+	Retry time.Duration
+	// Wait is how long the leader may hold a request until it has new
+	// records, 30s if zero.
+	Wait time.Duration
+	// Client is used for every request, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// FollowerStatus tells how far a follower is behind its leader.
+// LagSeconds is how long ago it last had every record the leader had, 0
+// while it is waiting for new ones.
+type FollowerStatus struct {
+	Leader       string    `json:"leader"`
+	Connected    bool      `json:"connected"`
+	LagBytes     int64     `json:"lag_bytes"`
+	LagSeconds   float64   `json:"lag_seconds"`
+	CaughtUpAt   time.Time `json:"caught_up_at"`
+	AppliedBytes int64     `json:"applied_bytes"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// Follower keeps a replica opened with Bitcask.OpenReplica up to date with
+// the leader serving the HTTP API at a base URL. It copies the leader's data
+// files by file ID and offset and resumes from what it already has, so it
+// catches up by itself after a disconnect or a restart.
+type Follower struct {
+	bc     *Bitcask.BitCask
+	leader string
+	client *http.Client
+	retry  time.Duration
+	wait   time.Duration
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	lock    *sync.Mutex
+	status  FollowerStatus
+	waiting bool
+}
+
+func NewFollower(bc *Bitcask.BitCask, leader string, opt FollowerOptions) *Follower {
+	f := &Follower{
+		bc:     bc,
+		leader: strings.TrimSuffix(leader, "/"),
+		client: opt.Client,
+		retry:  opt.Retry,
+		wait:   opt.Wait,
+		done:   make(chan struct{}),
+		lock:   &sync.Mutex{},
+	}
+	if f.client == nil {
+		f.client = http.DefaultClient
+	}
+	if f.retry <= 0 {
+		f.retry = defaultReplRetry
+	}
+	if f.wait <= 0 {
+		f.wait = defaultReplWait
+	}
+	f.status.Leader = f.leader
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	return f
+}
+
+func (f *Follower) Start() {
+	go f.work()
+}
+
+// Stop ends replication and waits for the record being applied, if any.
+func (f *Follower) Stop() {
+	f.cancel()
+	<-f.done
+}
+
+func (f *Follower) Status() FollowerStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	status := f.status
+	if !f.waiting && !status.CaughtUpAt.IsZero() {
+		status.LagSeconds = time.Since(status.CaughtUpAt).Seconds()
+	}
+	return status
+}
+
+func (f *Follower) work() {
+	defer close(f.done)
+	for {
+		err := f.Sync()
+		if f.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Println("Replication from", f.leader, "failed:", err)
+			f.lock.Lock()
+			f.status.Connected = false
+			f.status.LastError = err.Error()
+			f.waiting = false
+			f.lock.Unlock()
+			select {
+			case <-f.ctx.Done():
+				return
+			case <-time.After(f.retry):
+			}
+		}
+	}
+}
+
+// Sync copies what the leader has and the replica not yet. If the replica
+// is already up to date it first waits up to the Wait option for new
+// records.
+func (f *Follower) Sync() error {
+	var state Bitcask.ReplicaState
+	if err := f.getJSON("/_repl/state", &state); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	f.status.Connected = true
+	f.status.LastError = ""
+	f.lock.Unlock()
+
+	for i, file := range state.Files {
+		last := i == len(state.Files)-1
+		offset := f.bc.ReplicaOffset(file.ID)
+		if offset > file.Size {
+			return fmt.Errorf("Replica of %d.data has %d bytes, the leader %d", file.ID, offset, file.Size)
+		}
+		if offset == file.Size && !last {
+			continue
+		}
+		path := fmt.Sprintf("/_repl/files/%d?offset=%d", file.ID, offset)
+		if offset == file.Size {
+			f.setLag(&state, true)
+			path += fmt.Sprintf("&wait=%d", int(f.wait/time.Second))
+		}
+		if err := f.copyFile(path, file.ID, !last); err != nil {
+			return err
+		}
+	}
+	if err := f.bc.PruneReplica(&state); err != nil {
+		return err
+	}
+	f.setLag(&state, false)
+	return nil
+}
+
+func (f *Follower) copyFile(path string, fileID uint32, sealed bool) error {
+	resp, err := f.get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// merged away since the state was read, the next Sync won't list it
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errorOf(resp)
+	}
+	n, err := f.bc.ApplyReplica(fileID, resp.Body, sealed)
+	f.lock.Lock()
+	f.status.AppliedBytes += n
+	f.lock.Unlock()
+	return err
+}
+
+// setLag updates the status from the sizes the leader reported.
+func (f *Follower) setLag(state *Bitcask.ReplicaState, waiting bool) {
+	lag := int64(0)
+	for _, file := range state.Files {
+		if offset := f.bc.ReplicaOffset(file.ID); offset < file.Size {
+			lag += file.Size - offset
+		}
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.status.LagBytes = lag
+	f.waiting = waiting
+	if lag == 0 {
+		f.status.CaughtUpAt = time.Now()
+	}
+}
+
+func (f *Follower) get(path string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(f.ctx, "GET", f.leader+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return f.client.Do(request)
+}
+
+func (f *Follower) getJSON(path string, v interface{}) error {
+	resp, err := f.get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errorOf(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// errorOf returns the error the leader sent with a failed response.
+func errorOf(resp *http.Response) error {
+	var body errorBody
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == "" {
+		return fmt.Errorf("Leader answered %s", resp.Status)
+	}
+	return fmt.Errorf("Leader answered %s: %s", resp.Status, body.Error)
+}
@@ -0,0 +1,169 @@
+package httpapi
+
+import (
+	"Bitcask"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cutTransport cuts the body of the next data file copy after limit bytes,
+// as a dropped connection would.
+type cutTransport struct {
+	limit int64
+	cut   bool
+}
+
+type cutBody struct {
+	io.Reader
+	io.Closer
+}
+
+func (c *cutTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(request)
+	if err != nil || !c.cut || !strings.Contains(request.URL.Path, "/_repl/files/") {
+		return resp, err
+	}
+	c.cut = false
+	resp.Body = cutBody{io.LimitReader(resp.Body, c.limit), resp.Body}
+	return resp, nil
+}
+
+func storeMap(t *testing.T, bc *Bitcask.BitCask) string {
+	t.Helper()
+	s := ""
+	err := bc.Fold(func(key, value []byte) error {
+		s += fmt.Sprintf("%s=%s;", key, value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func fileIDs(t *testing.T, bc *Bitcask.BitCask) string {
+	t.Helper()
+	state, err := bc.ReplicaState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := ""
+	for _, f := range state.Files {
+		s += fmt.Sprintf("%d:%d;", f.ID, f.Size)
+	}
+	return s
+}
+
+func TestFollower(t *testing.T) {
+	leaderFS := Bitcask.NewFaultFS(Bitcask.NewMemFS())
+	opt := Bitcask.NewOptions(0, 512, -1, 0, true)
+	opt.FileSystem = leaderFS
+	leader, err := Bitcask.Open("/leader", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	srv := httptest.NewServer(NewHandler(leader, HandlerOptions{}))
+	defer srv.Close()
+
+	ropt := Bitcask.NewOptions(0, 512, -1, 0, true)
+	ropt.FileSystem = Bitcask.NewMemFS()
+	replica, err := Bitcask.OpenReplica("/replica", ropt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	transport := &cutTransport{}
+	// a wait under a second asks the leader not to wait
+	f := NewFollower(replica, srv.URL, FollowerOptions{Wait: time.Millisecond, Client: &http.Client{Transport: transport}})
+
+	put := func(from, to int, prefix string) {
+		for i := from; i < to; i++ {
+			if err := leader.Put([]byte(fmt.Sprintf("%s%03d", prefix, i)), []byte(fmt.Sprintf("value %d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(step string) {
+		t.Helper()
+		if l, r := storeMap(t, leader), storeMap(t, replica); l != r {
+			t.Fatalf("%s: replica holds\n%s\nleader\n%s", step, r, l)
+		}
+		if l, r := fileIDs(t, leader), fileIDs(t, replica); l != r {
+			t.Fatalf("%s: replica files %s, leader %s", step, r, l)
+		}
+	}
+
+	// initial catch-up over several files
+	put(0, 40, "a")
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	check("catch-up")
+
+	// a copy cut short resumes where it stopped
+	put(40, 50, "a")
+	state, err := leader.ReplicaState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := state.Files[len(state.Files)-1]
+	before := replica.ReplicaOffset(active.ID)
+	transport.limit, transport.cut = 100, true
+	if err := f.Sync(); err == nil {
+		t.Fatal("sync of a cut copy succeeded")
+	}
+	resumeAt := replica.ReplicaOffset(active.ID)
+	if resumeAt <= before || resumeAt >= active.Size {
+		t.Fatalf("after a cut copy the replica is at %d, was at %d, leader at %d", resumeAt, before, active.Size)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	check("resume")
+
+	// a batch the leader failed to finish stays unfinished in its sealed file
+	leaderFS.Inject(Bitcask.Fault{Op: Bitcask.OpWrite, Suffix: ".data", After: 2, Once: true})
+	b := Bitcask.NewBatch()
+	for i := 0; i < 4; i++ {
+		b.Put([]byte(fmt.Sprintf("batch%d", i)), []byte("never"))
+	}
+	if err := leader.Write(b); !errors.Is(err, Bitcask.InjectedFaultErr) {
+		t.Fatalf("batch write: %v", err)
+	}
+	leaderFS.Clear()
+	put(50, 60, "a")
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	check("unfinished batch")
+	if _, err := replica.Get([]byte("batch0")); err != Bitcask.KeyNotFoundErr {
+		t.Fatalf("replica loaded an unfinished batch: %v", err)
+	}
+
+	// keys deleted by records merge drops before the follower saw them
+	if err := leader.Del([]byte("a001")); err != nil {
+		t.Fatal(err)
+	}
+	put(0, 20, "b")
+	if err := Bitcask.NewMerge(leader, 0).Run(); err != nil {
+		t.Fatal(err)
+	}
+	put(20, 25, "b")
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	check("merge")
+	if _, err := replica.Get([]byte("a001")); err != Bitcask.KeyNotFoundErr {
+		t.Fatalf("replica kept a key deleted before the merge: %v", err)
+	}
+	if err := replica.ChangesSince(0, func(e *Bitcask.Event) error { return nil }); err != Bitcask.HistoryUnavailableErr {
+		t.Fatalf("replica changes since 0 after the leader merged: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package httpapi
+
+import (
+	"Bitcask"
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultKeysLimit = 100
+	maxKeysLimit     = 1000
+	scanFlushEvery   = 100
+	// scanPageSize is how many keys /scan holds at once without a limit
+	scanPageSize = 1000
+)
+
+// page is the key range a /keys or /scan request asks for.
+type page struct {
+	prefix []byte
+	start  []byte
+	limit  int
+}
+
+type keysBody struct {
+	Keys []string `json:"keys"`
+	// Encoding is "base64" when the keys are base64 encoded
+	Encoding   string `json:"encoding,omitempty"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type scanLine struct {
+	Key         string `json:"key,omitempty"`
+	KeyBase64   []byte `json:"key_base64,omitempty"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 []byte `json:"value_base64,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// parsePage reads prefix, start, limit and cursor. The cursor is the one
+// returned with the previous page and resumes right after its last key.
+func parsePage(request *http.Request, defaultLimit, maxLimit int) (*page, error) {
+	q := request.URL.Query()
+	p := &page{
+		prefix: []byte(q.Get("prefix")),
+		start:  []byte(q.Get("start")),
+		limit:  defaultLimit,
+	}
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Limit : %s is invalid", l)
+		}
+		p.limit = n
+	}
+	if maxLimit > 0 && (p.limit == 0 || p.limit > maxLimit) {
+		p.limit = maxLimit
+	}
+	if c := q.Get("cursor"); c != "" {
+		last, err := base64.RawURLEncoding.DecodeString(c)
+		if err != nil {
+			return nil, fmt.Errorf("Cursor : %s is invalid", c)
+		}
+		after := append(last, 0)
+		if string(after) > string(p.start) {
+			p.start = after
+		}
+	}
+	return p, nil
+}
+
+// keys returns the keys of the page and the cursor of the next one, empty
+// when this is the last page.
+func (p *page) keys(bc *Bitcask.BitCask) ([][]byte, string) {
+	if p.limit == 0 {
+		return bc.ListKeys(p.prefix, p.start, 0), ""
+	}
+	keys := bc.ListKeys(p.prefix, p.start, p.limit+1)
+	if len(keys) <= p.limit {
+		return keys, ""
+	}
+	keys = keys[:p.limit]
+	return keys, base64.RawURLEncoding.EncodeToString(keys[len(keys)-1])
+}
+
+// listKeys returns a page of keys as JSON. If a key of the page is not
+// UTF-8, or encoding=base64 is asked for, every key of the page is sent
+// base64 encoded and encoding is "base64".
+func (h *handler) listKeys(writer http.ResponseWriter, request *http.Request) {
+	p, err := parsePage(request, defaultKeysLimit, maxKeysLimit)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+	keys, next := p.keys(h.bc)
+	body := keysBody{Keys: make([]string, len(keys)), NextCursor: next}
+	if request.URL.Query().Get("encoding") == "base64" {
+		body.Encoding = "base64"
+	}
+	for _, k := range keys {
+		if !utf8.Valid(k) {
+			body.Encoding = "base64"
+		}
+	}
+	for i, k := range keys {
+		if body.Encoding == "base64" {
+			body.Keys[i] = base64.StdEncoding.EncodeToString(k)
+		} else {
+			body.Keys[i] = string(k)
+		}
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(body)
+}
+
+// scan streams one JSON object per line. Keys and values that are not UTF-8
+// are sent base64 encoded in key_base64 and value_base64. The next cursor,
+// if any, is in the X-Next-Cursor header. Without a limit every matching
+// key is streamed, read scanPageSize keys at a time. As the status is sent
+// first, a read error ends the stream with a line holding only error.
+func (h *handler) scan(writer http.ResponseWriter, request *http.Request) {
+	p, err := parsePage(request, 0, 0)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+	var keys [][]byte
+	next := ""
+	if p.limit > 0 {
+		keys, next = p.keys(h.bc)
+	}
+	writer.Header().Set("Content-Type", "application/x-ndjson")
+	if next != "" {
+		writer.Header().Set("X-Next-Cursor", next)
+	}
+	writer.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriter(writer)
+	defer bw.Flush()
+	enc := json.NewEncoder(bw)
+	flusher, _ := writer.(http.Flusher)
+	n := 0
+	for start := p.start; ; {
+		if p.limit == 0 {
+			keys = h.bc.ListKeys(p.prefix, start, scanPageSize)
+		}
+		for _, key := range keys {
+			value, err := h.bc.Get(key)
+			if err == Bitcask.KeyNotFoundErr {
+				continue
+			}
+			if err != nil {
+				enc.Encode(scanLine{Error: strings.TrimSpace(err.Error())})
+				return
+			}
+			line := scanLine{}
+			if utf8.Valid(key) {
+				line.Key = string(key)
+			} else {
+				line.KeyBase64 = key
+			}
+			if utf8.Valid(value) {
+				line.Value = string(value)
+			} else {
+				line.ValueBase64 = value
+			}
+			if err := enc.Encode(line); err != nil {
+				return
+			}
+			if n++; flusher != nil && n%scanFlushEvery == 0 {
+				bw.Flush()
+				flusher.Flush()
+			}
+		}
+		if p.limit > 0 || len(keys) < scanPageSize {
+			return
+		}
+		last := keys[len(keys)-1]
+		start = append(last[:len(last):len(last)], 0)
+	}
+}
@@ -0,0 +1,157 @@
+package httpapi
+
+import (
+	"Bitcask"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListKeysPages(t *testing.T) {
+	bc := openTest(t)
+	for i := 0; i < 25; i++ {
+		bc.Put([]byte(fmt.Sprintf("k%02d", i)), []byte("v"))
+	}
+	bc.Put([]byte("other"), []byte("v"))
+	h := NewHandler(bc, HandlerOptions{})
+
+	var all []string
+	target := "/keys?prefix=k&limit=10"
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("cursor does not end")
+		}
+		var body keysBody
+		if err := json.NewDecoder(do(t, h, "GET", target, "", http.StatusOK).Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, body.Keys...)
+		if body.NextCursor == "" {
+			break
+		}
+		target = "/keys?prefix=k&limit=10&cursor=" + body.NextCursor
+	}
+	if len(all) != 25 || all[0] != "k00" || all[24] != "k24" {
+		t.Fatalf("pages hold %v", all)
+	}
+	do(t, h, "GET", "/keys?limit=x", "", http.StatusBadRequest)
+	do(t, h, "GET", "/keys?cursor=***", "", http.StatusBadRequest)
+}
+
+func TestKeysNotUTF8(t *testing.T) {
+	bc := openTest(t)
+	bc.Put([]byte("a"), []byte("1"))
+	bc.Put([]byte("b\xff"), []byte("\x00\xfe"))
+	h := NewHandler(bc, HandlerOptions{})
+
+	var body keysBody
+	if err := json.NewDecoder(do(t, h, "GET", "/keys", "", http.StatusOK).Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Encoding != "base64" || len(body.Keys) != 2 {
+		t.Fatalf("keys %+v", body)
+	}
+	for i, want := range []string{"a", "b\xff"} {
+		key, err := base64.StdEncoding.DecodeString(body.Keys[i])
+		if err != nil || string(key) != want {
+			t.Fatalf("key %d = %q, %v", i, key, err)
+		}
+	}
+	body = keysBody{}
+	if err := json.NewDecoder(do(t, h, "GET", "/keys?prefix=a", "", http.StatusOK).Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Encoding != "" || len(body.Keys) != 1 || body.Keys[0] != "a" {
+		t.Fatalf("UTF-8 keys %+v", body)
+	}
+
+	sc := bufio.NewScanner(do(t, h, "GET", "/scan", "", http.StatusOK).Body)
+	var lines []scanLine
+	for sc.Scan() {
+		var line scanLine
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 || lines[0].Key != "a" || lines[0].Value != "1" ||
+		string(lines[1].KeyBase64) != "b\xff" || string(lines[1].ValueBase64) != "\x00\xfe" {
+		t.Fatalf("scan lines %+v", lines)
+	}
+}
+
+func scanLines(t *testing.T, h http.Handler, target string) []scanLine {
+	t.Helper()
+	sc := bufio.NewScanner(do(t, h, "GET", target, "", http.StatusOK).Body)
+	var lines []scanLine
+	for sc.Scan() {
+		var line scanLine
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestScanWithoutLimit(t *testing.T) {
+	bc := openTest(t)
+	n := 2*scanPageSize + 10
+	for i := 0; i < n; i++ {
+		bc.Put([]byte(fmt.Sprintf("k%05d", i)), []byte("v"))
+	}
+	bc.Put([]byte("other"), []byte("v"))
+	h := NewHandler(bc, HandlerOptions{})
+
+	lines := scanLines(t, h, "/scan?prefix=k")
+	if len(lines) != n {
+		t.Fatalf("scan returned %d lines, want %d", len(lines), n)
+	}
+	for i, line := range lines {
+		if line.Key != fmt.Sprintf("k%05d", i) {
+			t.Fatalf("line %d holds %+v", i, line)
+		}
+	}
+	if lines := scanLines(t, h, "/scan?start=k01000"); len(lines) != n-1000+1 || lines[0].Key != "k01000" {
+		t.Fatalf("scan from k01000 returned %d lines", len(lines))
+	}
+}
+
+func TestScanReadError(t *testing.T) {
+	dir := t.TempDir()
+	bc, err := Bitcask.Open(dir, Bitcask.NewOptions(0, 0, -1, 0, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(bc.Close)
+	for i := 0; i < 10; i++ {
+		bc.Put([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	// cut the data file under the store, before the value of k5
+	names, _ := filepath.Glob(filepath.Join(dir, "*.data"))
+	if len(names) != 1 {
+		t.Fatalf("data files %v", names)
+	}
+	buf, err := ioutil.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(names[0], int64(bytes.Index(buf, []byte("value-5")))); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := scanLines(t, NewHandler(bc, HandlerOptions{}), "/scan")
+	if len(lines) != 6 || lines[4].Key != "k4" {
+		t.Fatalf("scan returned %+v", lines)
+	}
+	if last := lines[5]; last.Error == "" || last.Key != "" {
+		t.Fatalf("scan ended with %+v, want an error", last)
+	}
+}
@@ -0,0 +1,233 @@
+package httpapi
+
+import (
+	"Bitcask"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	watchHeartbeat      = 15 * time.Second
+	maxPollTimeout      = 60 * time.Second
+	defaultChangesLimit = 1000
+	maxChangesLimit     = 10000
+)
+
+// errPageFull ends ChangesSince once a page of changes is collected.
+var errPageFull = errors.New("page full")
+
+// watchEvent is an event as sent to clients. Seq is a string because it
+// does not fit in a JavaScript number. Keys and values that are not UTF-8
+// are sent base64 encoded, as /scan does.
+type watchEvent struct {
+	Seq         uint64 `json:"seq,string"`
+	Type        string `json:"type"`
+	Key         string `json:"key,omitempty"`
+	KeyBase64   []byte `json:"key_base64,omitempty"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 []byte `json:"value_base64,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+type pollResponse struct {
+	Events []*watchEvent `json:"events"`
+	Next   uint64        `json:"next,string"`
+}
+
+func newWatchEvent(e *Bitcask.Event) *watchEvent {
+	we := &watchEvent{Seq: e.Seq, Type: e.Type.String()}
+	if utf8.Valid(e.Key) {
+		we.Key = string(e.Key)
+	} else {
+		we.KeyBase64 = e.Key
+	}
+	if utf8.Valid(e.Value) {
+		we.Value = string(e.Value)
+	} else {
+		we.ValueBase64 = e.Value
+	}
+	if e.Meta != nil {
+		we.ContentType = e.Meta.ContentType
+	}
+	return we
+}
+
+// watch streams the changes of keys under ?prefix= as Server-Sent Events,
+// the event id being the Seq of the change. A client resumes with ?since=
+// or the Last-Event-ID header; 410 means those changes are no longer kept
+// in memory, /_changes may still replay them from disk. With ?poll=seconds it long-polls instead: it
+// waits for at least one change and returns them as JSON along with the
+// since to use next.
+func (h *handler) watch(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL.Query()
+	prefix := []byte(q.Get("prefix"))
+	since := uint64(0)
+	s := q.Get("since")
+	if s == "" {
+		s = request.Header.Get("Last-Event-ID")
+	}
+	if s != "" {
+		var err error
+		since, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, fmt.Errorf("Since : %s is invalid", s))
+			return
+		}
+	}
+	if p := q.Get("poll"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			writeError(writer, http.StatusBadRequest, fmt.Errorf("Poll : %s is invalid", p))
+			return
+		}
+		timeout := time.Duration(n) * time.Second
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+		h.poll(writer, request, prefix, since, timeout)
+		return
+	}
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writeError(writer, http.StatusInternalServerError, fmt.Errorf("Streaming is not supported"))
+		return
+	}
+	w, err := h.bc.Watch(prefix, since, 0)
+	if err != nil {
+		writeError(writer, statusOf(err), err)
+		return
+	}
+	defer w.Close()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(watchHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-w.C:
+			if !ok {
+				data, _ := json.Marshal(errorBody{Error: w.Err().Error()})
+				fmt.Fprintf(writer, "event: error\ndata: %s\n\n", data)
+				flusher.Flush()
+				return
+			}
+			data, _ := json.Marshal(newWatchEvent(e))
+			if _, err := fmt.Fprintf(writer, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			// a comment keeps proxies from closing an idle stream
+			if _, err := fmt.Fprint(writer, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
+func (h *handler) poll(writer http.ResponseWriter, request *http.Request, prefix []byte, since uint64, timeout time.Duration) {
+	if since == 0 {
+		since = h.bc.LastSeq()
+	}
+	w, err := h.bc.Watch(prefix, since, 0)
+	if err != nil {
+		writeError(writer, statusOf(err), err)
+		return
+	}
+	defer w.Close()
+
+	resp := pollResponse{Events: []*watchEvent{}, Next: since}
+	add := func(e *Bitcask.Event) {
+		resp.Events = append(resp.Events, newWatchEvent(e))
+		resp.Next = e.Seq
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case e, ok := <-w.C:
+		if !ok {
+			writeError(writer, http.StatusServiceUnavailable, w.Err())
+			return
+		}
+		add(e)
+	case <-timer.C:
+	case <-request.Context().Done():
+		return
+	}
+	// return whatever else is already pending along with the first change
+drain:
+	for len(resp.Events) > 0 {
+		select {
+		case e, ok := <-w.C:
+			if !ok {
+				break drain
+			}
+			add(e)
+		default:
+			break drain
+		}
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(resp)
+}
+
+// changes returns up to ?limit= changes after ?since= under ?prefix=, read
+// from the data files, along with the since to use next. 410 means merge
+// removed some of them and the client has to reload from /scan.
+func (h *handler) changes(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL.Query()
+	prefix := []byte(q.Get("prefix"))
+	since := uint64(0)
+	if s := q.Get("since"); s != "" {
+		var err error
+		since, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, fmt.Errorf("Since : %s is invalid", s))
+			return
+		}
+	}
+	limit := defaultChangesLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			writeError(writer, http.StatusBadRequest, fmt.Errorf("Limit : %s is invalid", l))
+			return
+		}
+		limit = n
+	}
+	if limit > maxChangesLimit {
+		limit = maxChangesLimit
+	}
+
+	resp := pollResponse{Events: []*watchEvent{}, Next: since}
+	err := h.bc.ChangesSince(since, func(e *Bitcask.Event) error {
+		if bytes.HasPrefix(e.Key, prefix) {
+			if len(resp.Events) == limit {
+				return errPageFull
+			}
+			resp.Events = append(resp.Events, newWatchEvent(e))
+		}
+		resp.Next = e.Seq
+		return nil
+	})
+	if err != nil && err != errPageFull {
+		writeError(writer, statusOf(err), err)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(resp)
+}
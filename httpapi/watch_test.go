@@ -0,0 +1,35 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestWatchKeysNotUTF8(t *testing.T) {
+	bc := openTest(t)
+	h := NewHandler(bc, HandlerOptions{})
+	bc.Put([]byte("a"), []byte("1"))
+	since := bc.LastSeq()
+	bc.Put([]byte("b\xff"), []byte("\x00\xfe"))
+
+	check := func(target string, want int) {
+		var resp pollResponse
+		if err := json.NewDecoder(do(t, h, "GET", target, "", http.StatusOK).Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Events) != want {
+			t.Fatalf("%s returned %d events", target, len(resp.Events))
+		}
+		last := resp.Events[want-1]
+		if last.Key != "" || string(last.KeyBase64) != "b\xff" || string(last.ValueBase64) != "\x00\xfe" {
+			t.Fatalf("%s returned %+v", target, last)
+		}
+		if want == 2 && (resp.Events[0].Key != "a" || resp.Events[0].KeyBase64 != nil) {
+			t.Fatalf("%s returned %+v", target, resp.Events[0])
+		}
+	}
+	check("/_changes", 2)
+	check(fmt.Sprintf("/_watch?poll=1&since=%d", since), 1)
+}
@@ -0,0 +1,294 @@
+package Bitcask
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+var (
+	IndexNotFoundErr = fmt.Errorf("Index not found ")
+	IndexStaleErr    = fmt.Errorf("Index is stale, register it to rebuild it ")
+)
+
+// IndexFunc returns the terms an index finds key under when it holds value.
+// It must always return the same terms for the same key and value.
+type IndexFunc func(key, value []byte) [][]byte
+
+// An index is kept in the bucket indexBucketPrefix followed by its name.
+// Its keys are the uvarint length of a term, the term and a key found under
+// it. The records a write makes to the indexes come before the record of
+// the key itself, in one batch, so a crash keeps or loses them together.
+// The key made of nothing but the bucket ID marks an index stale.
+const indexBucketPrefix = "\x00index:"
+
+// Index looks up the keys outside buckets by the terms an IndexFunc found
+// in their values, see RegisterIndex.
+type Index struct {
+	bc   *BitCask
+	name string
+}
+
+// indexUpdate is a change to the keydir of an index, applied once the
+// batch writing it is complete. A nil entry deletes key.
+type indexUpdate struct {
+	kd    *KeyDirs
+	key   string
+	entry *Entry
+}
+
+func indexKey(term, key []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen32, binary.MaxVarintLen32+len(term)+len(key))
+	n := binary.PutUvarint(buf, uint64(len(term)))
+	buf = append(buf[:n], term...)
+	return append(buf, key...)
+}
+
+func indexTerms(fn IndexFunc, key, value []byte) map[string]bool {
+	terms := make(map[string]bool)
+	for _, t := range fn(key, value) {
+		terms[string(t)] = true
+	}
+	return terms
+}
+
+// RegisterIndex maintains the index name with fn on every write of a key
+// outside buckets from now on. Each such write then also reads the previous
+// value of the key and calls fn on both values. An index that does not
+// exist yet is built from every key, holding the store lock meanwhile. The
+// build rotates the active file as it goes, as writes do, so no file ends
+// up more than a record past MaxFileSize.
+//
+// An existing index is taken as it is, unless it is stale: the first write
+// since Open marks the indexes not registered yet stale, as they miss it.
+// Index.Get refuses a stale index and registering it rebuilds it, so
+// indexes should be registered right after Open. DropIndex and registering
+// again rebuilds an index too, as is needed when fn changes.
+func (c *BitCask) RegisterIndex(name string, fn IndexFunc) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	bucket := indexBucketPrefix + name
+	if id, kd := c.buckets.lookup(bucket); kd != nil && kd.Get(string(bucketKey(id, nil))) == nil {
+		c.indexes[name] = fn
+		return nil
+	}
+	if c.readOnly {
+		return ReadOnlyErr
+	}
+	// the entries go to a new bucket, which the catalog key naming it ends,
+	// so an index is only there once it is complete. Naming it replaces a
+	// stale index, see buckets.add.
+	id := c.buckets.next
+	// the ID is taken even if the build fails, as some entries may be written
+	c.buckets.next++
+	kd := c.buckets.dir(id)
+	err := func() error {
+		for _, k := range c.keyDirs.Keys() {
+			value, err := c.get([]byte(k))
+			if err == KeyNotFoundErr {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for term := range indexTerms(fn, []byte(k), value) {
+				if err := CheckWriteableFile(c); err != nil {
+					return err
+				}
+				key := bucketKey(id, indexKey([]byte(term), []byte(k)))
+				e, err := c.writeFile.WriteWithFlags(key, nil, FlagBucket)
+				if err != nil {
+					return err
+				}
+				kd.Put(string(key), &e)
+			}
+		}
+		if err := CheckWriteableFile(c); err != nil {
+			return err
+		}
+		return c.nameBucket(id, bucket)
+	}()
+	if err != nil {
+		delete(c.buckets.dirs, id)
+		return err
+	}
+	c.indexes[name] = fn
+	return nil
+}
+
+// DropIndex stops maintaining the index name and deletes it.
+func (c *BitCask) DropIndex(name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.readOnly {
+		return ReadOnlyErr
+	}
+	delete(c.indexes, name)
+	if err := c.dropBucket(indexBucketPrefix + name); err != BucketNotFoundErr {
+		return err
+	}
+	return IndexNotFoundErr
+}
+
+// write writes the record of key, which stores value or deletes key as
+// flags say, together with the changes to the indexes it makes. It updates
+// the keydirs of the indexes, those of key are left to the caller.
+func (c *BitCask) write(key, value, stored []byte, flags uint8) (Entry, error) {
+	if err := c.markStaleIndexes(); err != nil {
+		return Entry{}, err
+	}
+	if len(c.indexes) == 0 {
+		return c.writeFile.WriteWithFlags(key, stored, flags)
+	}
+	old, found, err := c.indexedValue(key)
+	if err != nil {
+		return Entry{}, err
+	}
+	start := c.writeFile.offset
+	var updates []indexUpdate
+	e, err := c.writeIndexed(key, old, found, value, stored, flags, &updates)
+	if err != nil {
+		if c.writeFile.offset != start {
+			closeUnfinishedBatch(c)
+		}
+		return Entry{}, err
+	}
+	applyIndexUpdates(updates)
+	return e, nil
+}
+
+// markStaleIndexes marks, before the first write since Open, the indexes
+// not registered yet stale, as they miss it.
+func (c *BitCask) markStaleIndexes() error {
+	if c.indexesChecked {
+		return nil
+	}
+	for name, id := range c.buckets.ids {
+		if !strings.HasPrefix(name, indexBucketPrefix) {
+			continue
+		}
+		if _, ok := c.indexes[name[len(indexBucketPrefix):]]; ok {
+			continue
+		}
+		kd := c.buckets.dirs[id]
+		key := bucketKey(id, nil)
+		if kd.Get(string(key)) != nil {
+			continue
+		}
+		if err := CheckWriteableFile(c); err != nil {
+			return err
+		}
+		e, err := c.writeFile.WriteWithFlags(key, nil, FlagBucket)
+		if err != nil {
+			return err
+		}
+		kd.Put(string(key), &e)
+		c.publishBucket(EventPut, key, &e)
+	}
+	c.indexesChecked = true
+	return nil
+}
+
+// indexedValue returns the value the indexes hold key under, which they do
+// until it is deleted even if it expired.
+func (c *BitCask) indexedValue(key []byte) ([]byte, bool, error) {
+	e := c.keyDirs.Get(string(key))
+	if e == nil {
+		return nil, false, nil
+	}
+	value, _, err := c.readEntry(e)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// writeIndexed writes the records that replacing old, if found, with value
+// make to the indexes, followed by the record of key ending their batch. The
+// changes to the keydirs of the indexes are appended to updates.
+func (c *BitCask) writeIndexed(key, old []byte, found bool, value, stored []byte, flags uint8, updates *[]indexUpdate) (Entry, error) {
+	for name, fn := range c.indexes {
+		id, kd := c.buckets.lookup(indexBucketPrefix + name)
+		if kd == nil {
+			continue
+		}
+		oldTerms, newTerms := map[string]bool{}, map[string]bool{}
+		if found {
+			oldTerms = indexTerms(fn, key, old)
+		}
+		if flags&FlagTombstone == 0 {
+			newTerms = indexTerms(fn, key, value)
+		}
+		for term := range oldTerms {
+			if newTerms[term] {
+				continue
+			}
+			ikey := bucketKey(id, indexKey([]byte(term), key))
+			if _, err := c.writeFile.WriteWithFlags(ikey, nil, FlagBucket|FlagBatch|FlagTombstone); err != nil {
+				return Entry{}, err
+			}
+			*updates = append(*updates, indexUpdate{kd, string(ikey), nil})
+		}
+		for term := range newTerms {
+			if oldTerms[term] {
+				continue
+			}
+			ikey := bucketKey(id, indexKey([]byte(term), key))
+			e, err := c.writeFile.WriteWithFlags(ikey, nil, FlagBucket|FlagBatch)
+			if err != nil {
+				return Entry{}, err
+			}
+			*updates = append(*updates, indexUpdate{kd, string(ikey), &e})
+		}
+	}
+	return c.writeFile.WriteWithFlags(key, stored, flags)
+}
+
+func applyIndexUpdates(updates []indexUpdate) {
+	for _, u := range updates {
+		if u.entry == nil {
+			u.kd.Del(u.key)
+		} else {
+			u.kd.Put(u.key, u.entry)
+		}
+	}
+}
+
+// Index returns the index name, which RegisterIndex creates.
+func (c *BitCask) Index(name string) *Index {
+	return &Index{bc: c, name: name}
+}
+
+func (x *Index) Name() string {
+	return x.name
+}
+
+// Get returns, in sorted order, the keys whose value the index finds under
+// term. Keys that expired are listed until merge drops them. It returns
+// IndexStaleErr once the store was written while the index was not
+// registered.
+func (x *Index) Get(term []byte) ([][]byte, error) {
+	c := x.bc
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	id, kd := c.buckets.lookup(indexBucketPrefix + x.name)
+	if kd == nil {
+		return nil, IndexNotFoundErr
+	}
+	if kd.Get(string(bucketKey(id, nil))) != nil {
+		return nil, IndexStaleErr
+	}
+	prefix := bucketKey(id, indexKey(term, nil))
+	keys := [][]byte{}
+	for _, k := range kd.Range(string(prefix), "", 0) {
+		key := k[len(prefix):]
+		// an index registered late may list keys gone since
+		if c.keyDirs.Get(key) != nil {
+			keys = append(keys, []byte(key))
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,167 @@
+package Bitcask
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// byWord indexes a value under each of its words.
+func byWord(key, value []byte) [][]byte {
+	return bytes.Fields(value)
+}
+
+func checkTerm(t *testing.T, bc *BitCask, term string, want ...string) {
+	t.Helper()
+	keys, err := bc.Index("words").Get([]byte(term))
+	if err != nil {
+		t.Fatalf("index get %s: %v", term, err)
+	}
+	got := []string{}
+	for _, k := range keys {
+		got = append(got, string(k))
+	}
+	if want == nil {
+		want = []string{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("index lists %q under %s, want %q", got, term, want)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	dir := t.TempDir()
+	bc := openTest(t, dir)
+	putTest(t, bc, "a", "red green", "b", "green")
+	if _, err := bc.Index("words").Get([]byte("red")); err != IndexNotFoundErr {
+		t.Fatalf("get from a missing index: %v", err)
+	}
+	// built from the keys already there
+	if err := bc.RegisterIndex("words", byWord); err != nil {
+		t.Fatal(err)
+	}
+	checkTerm(t, bc, "green", "a", "b")
+	checkTerm(t, bc, "red", "a")
+
+	putTest(t, bc, "a", "blue green", "c", "red")
+	checkTerm(t, bc, "red", "c")
+	checkTerm(t, bc, "blue", "a")
+	checkTerm(t, bc, "green", "a", "b")
+	if err := bc.Del([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	checkTerm(t, bc, "green", "a")
+	batch := NewBatch()
+	batch.Put([]byte("d"), []byte("green"))
+	batch.Put([]byte("d"), []byte("red"))
+	batch.Del([]byte("c"))
+	if err := bc.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	checkTerm(t, bc, "green", "a")
+	checkTerm(t, bc, "red", "d")
+	// index buckets are not listed
+	if names := bc.Buckets(); len(names) != 0 {
+		t.Fatalf("buckets %q", names)
+	}
+	bc.Close()
+
+	// registered again after Open, the index is taken as it is
+	bc = openTest(t, dir)
+	if err := bc.RegisterIndex("words", byWord); err != nil {
+		t.Fatal(err)
+	}
+	checkTerm(t, bc, "red", "d")
+	putTest(t, bc, "e", "red")
+	checkTerm(t, bc, "red", "d", "e")
+	bc.Close()
+
+	// writes before it is registered leave it stale, even for the next
+	// process, until registering rebuilds it
+	bc = openTest(t, dir)
+	putTest(t, bc, "f", "red")
+	if err := bc.Del([]byte("e")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.Index("words").Get([]byte("red")); err != IndexStaleErr {
+		t.Fatalf("get from a stale index: %v", err)
+	}
+	bc.Close()
+	bc = openTest(t, dir)
+	if _, err := bc.Index("words").Get([]byte("red")); err != IndexStaleErr {
+		t.Fatalf("get from a stale index after reopen: %v", err)
+	}
+	if err := bc.RegisterIndex("words", byWord); err != nil {
+		t.Fatal(err)
+	}
+	checkTerm(t, bc, "red", "d", "f")
+	bc.Close()
+	// the rebuilt index replaced the stale one for good
+	bc = openTest(t, dir)
+	defer bc.Close()
+	if err := bc.RegisterIndex("words", byWord); err != nil {
+		t.Fatal(err)
+	}
+	checkTerm(t, bc, "red", "d", "f")
+	checkTerm(t, bc, "blue", "a")
+
+	if err := bc.DropIndex("words"); err != nil {
+		t.Fatalf("drop: %v", err)
+	}
+	if _, err := bc.Index("words").Get([]byte("red")); err != IndexNotFoundErr {
+		t.Fatalf("get from a dropped index: %v", err)
+	}
+	if err := bc.DropIndex("words"); err != IndexNotFoundErr {
+		t.Fatalf("drop twice: %v", err)
+	}
+	// writes no longer maintain it
+	putTest(t, bc, "g", "red")
+	checkStore(t, bc, map[string]string{"a": "blue green", "d": "red", "f": "red", "g": "red"})
+}
+
+func TestIndexBuildRotates(t *testing.T) {
+	dir := t.TempDir()
+	opt := NewOptions(0, 1024, -1, 0, true)
+	bc, err := Open(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		putTest(t, bc, fmt.Sprintf("k%03d", i), fmt.Sprintf("w%d w%d all", i%3, i%7))
+	}
+	if err := bc.RegisterIndex("words", byWord); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ListDataFiles(bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		stat, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a file is rotated once a record took it past MaxFileSize
+		if stat.Size() > 1024+64 {
+			t.Fatalf("%s holds %d bytes", name, stat.Size())
+		}
+	}
+	bc.Close()
+
+	bc, err = Open(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	if err := bc.RegisterIndex("words", byWord); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := bc.Index("words").Get([]byte("all"))
+	if err != nil || len(keys) != 100 {
+		t.Fatalf("index lists %d keys under all: %v", len(keys), err)
+	}
+	checkTerm(t, bc, "w6", "k006", "k013", "k020", "k027", "k034", "k041", "k048", "k055", "k062", "k069", "k076", "k083", "k090", "k097")
+}
@@ -1,70 +1,135 @@
 package Bitcask
 
-import "sync"
-
-var keyDirsLock *sync.RWMutex
-var once sync.Once
-var keyDirs *KeyDirs
-
-func init() {
-	keyDirsLock = &sync.RWMutex{}
-}
+import (
+	"strings"
+	"sync"
+)
 
 type KeyDirs struct {
 	entries map[string]*Entry
+	// sorted holds the keys of entries in order
+	sorted *keyList
+	lock   *sync.RWMutex
+	// liveBytes is the size of the records entries point to
+	liveBytes int64
+	keyBytes  int64
 }
 
+// NewKeyDirs returns an empty keydir. Each open store has its own, so a
+// process can open several stores, as a leader and its follower do.
 func NewKeyDirs(dir string) *KeyDirs {
-	keyDirsLock.Lock()
-	defer keyDirsLock.Unlock()
-
-	once.Do(func() {
-		if keyDirs == nil {
-			keyDirs = &KeyDirs{
-				entries: make(map[string]*Entry),
-			}
-		}
-	})
-	return keyDirs
+	return &KeyDirs{
+		entries: make(map[string]*Entry),
+		sorted:  newKeyList(),
+		lock:    &sync.RWMutex{},
+	}
 }
 
 func (kd *KeyDirs) Get(key string) *Entry {
-	keyDirsLock.RLock()
-	defer keyDirsLock.RUnlock()
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
 
 	entry, _ := kd.entries[key]
 	return entry
 }
 
 func (kd *KeyDirs) Del(key string) {
-	keyDirsLock.Lock()
-	defer keyDirsLock.Unlock()
-
-	delete(kd.entries, key)
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	if old, ok := kd.entries[key]; ok {
+		kd.liveBytes -= recordSize(key, old)
+		kd.keyBytes -= int64(len(key))
+		delete(kd.entries, key)
+		kd.sorted.remove(key)
+	}
 }
 
 func (kd *KeyDirs) Put(key string, entry *Entry) {
-	keyDirsLock.Lock()
-	defer keyDirsLock.Unlock()
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	kd.put(key, entry)
+}
 
+func (kd *KeyDirs) put(key string, entry *Entry) {
+	if old, ok := kd.entries[key]; ok {
+		kd.liveBytes -= recordSize(key, old)
+		kd.keyBytes -= int64(len(key))
+	} else {
+		kd.sorted.insert(key)
+	}
 	kd.entries[key] = entry
+	kd.keyBytes += int64(len(key))
+	kd.liveBytes += recordSize(key, entry)
+}
+
+// reset removes every entry.
+func (kd *KeyDirs) reset() {
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	kd.entries = make(map[string]*Entry)
+	kd.sorted = newKeyList()
+	kd.liveBytes, kd.keyBytes = 0, 0
+}
+
+func recordSize(key string, e *Entry) int64 {
+	return int64(HeaderSize + e.keySize(len(key)) + int(e.valueSize))
+}
+
+// Len returns the number of keys.
+func (kd *KeyDirs) Len() int {
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
+
+	return len(kd.entries)
+}
+
+// LiveBytes returns the size of the records the keys point to, the part of
+// the data files merge keeps.
+func (kd *KeyDirs) LiveBytes() int64 {
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
+
+	return kd.liveBytes
+}
+
+// KeyBytes returns the total length of the keys.
+func (kd *KeyDirs) KeyBytes() int64 {
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
+
+	return kd.keyBytes
+}
+
+// LiveBytesByFile is LiveBytes split by the data file holding the records.
+func (kd *KeyDirs) LiveBytesByFile() map[uint32]int64 {
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
+
+	live := make(map[uint32]int64)
+	for k, e := range kd.entries {
+		live[e.fileID] += recordSize(k, e)
+	}
+	return live
 }
 
 func (kd *KeyDirs) Compare(key string, entry *Entry) bool {
-	keyDirsLock.RLock()
-	defer keyDirsLock.RUnlock()
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
 
 	old, ok := kd.entries[key]
 	if !ok || entry.IsNewer(old) {
-		kd.entries[key] = entry
+		kd.put(key, entry)
 		return true
 	}
 	return false
 }
 
 func (kd *KeyDirs) UpdateFileID(oldID, newID uint32) {
-	keyDirsLock.Lock()
-	defer keyDirsLock.Unlock()
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
 
 	for _, e := range kd.entries {
 		if e.fileID == oldID {
@@ -72,3 +137,50 @@ func (kd *KeyDirs) UpdateFileID(oldID, newID uint32) {
 		}
 	}
 }
+
+// DelWithFileID removes every entry in the file fileID and returns how
+// many there were.
+func (kd *KeyDirs) DelWithFileID(fileID uint32) int {
+	kd.lock.Lock()
+	defer kd.lock.Unlock()
+
+	n := 0
+	for k, e := range kd.entries {
+		if e.fileID == fileID {
+			kd.liveBytes -= recordSize(k, e)
+			kd.keyBytes -= int64(len(k))
+			delete(kd.entries, k)
+			kd.sorted.remove(k)
+			n++
+		}
+	}
+	return n
+}
+
+// Keys returns a sorted snapshot of every key.
+func (kd *KeyDirs) Keys() []string {
+	return kd.Range("", "", 0)
+}
+
+// Range returns, in sorted order, at most limit keys starting with prefix
+// that are not less than start. A limit <= 0 means no limit. It costs a
+// seek to the first key and a step to each next one.
+func (kd *KeyDirs) Range(prefix, start string, limit int) []string {
+	kd.lock.RLock()
+	defer kd.lock.RUnlock()
+
+	if start < prefix {
+		start = prefix
+	}
+	keys := make([]string, 0)
+	if prefix == "" && start == "" && limit <= 0 {
+		keys = make([]string, 0, len(kd.entries))
+	}
+	for n := kd.sorted.seek(start); n != nil && strings.HasPrefix(n.key, prefix); n = n.next[0] {
+		if limit > 0 && len(keys) == limit {
+			break
+		}
+		keys = append(keys, n.key)
+	}
+	return keys
+}
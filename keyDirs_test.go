@@ -0,0 +1,72 @@
+package Bitcask
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestKeyDirsRange(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	kd := NewKeyDirs("")
+	model := make(map[string]bool)
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("%c%d", 'a'+rnd.Intn(4), rnd.Intn(1000))
+		switch rnd.Intn(4) {
+		case 0:
+			kd.Del(key)
+			delete(model, key)
+		default:
+			kd.Put(key, &Entry{fileID: uint32(rnd.Intn(3))})
+			model[key] = true
+		}
+	}
+	// drop a file, as merge does
+	n := kd.DelWithFileID(2)
+	for k := range model {
+		if kd.Get(k) == nil {
+			delete(model, k)
+			n--
+		}
+	}
+	if n != 0 || kd.Len() != len(model) {
+		t.Fatalf("keydir holds %d keys, want %d", kd.Len(), len(model))
+	}
+
+	sorted := make([]string, 0, len(model))
+	for k := range model {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	want := func(prefix, start string, limit int) []string {
+		keys := []string{}
+		for _, k := range sorted {
+			if k >= start && strings.HasPrefix(k, prefix) && (limit <= 0 || len(keys) < limit) {
+				keys = append(keys, k)
+			}
+		}
+		return keys
+	}
+	for _, q := range []struct {
+		prefix, start string
+		limit         int
+	}{
+		{"", "", 0}, {"", "", 10}, {"b", "", 0}, {"b", "", 7}, {"b", "b5", 3},
+		{"c", "a", 0}, {"c", "d", 0}, {"", "c", 20}, {"z", "", 0}, {"a1", "", 0},
+	} {
+		got := kd.Range(q.prefix, q.start, q.limit)
+		if w := want(q.prefix, q.start, q.limit); strings.Join(got, ",") != strings.Join(w, ",") {
+			t.Fatalf("Range(%q, %q, %d) = %v, want %v", q.prefix, q.start, q.limit, got, w)
+		}
+	}
+	if strings.Join(kd.Keys(), ",") != strings.Join(sorted, ",") {
+		t.Fatal("Keys is not every key in order")
+	}
+
+	kd.reset()
+	if kd.Len() != 0 || len(kd.Keys()) != 0 {
+		t.Fatal("reset keydir still holds keys")
+	}
+}
@@ -0,0 +1,94 @@
+package Bitcask
+
+// keyListLevels bounds the height of a keyList, enough for 4^24 keys.
+const keyListLevels = 24
+
+// keyList is a skip list holding the keys of a KeyDirs in sorted order, so
+// a page of keys costs a seek rather than a sort of every key. It is guarded
+// by the lock of its KeyDirs.
+type keyList struct {
+	head  keyNode
+	level int
+	// seed of the xorshift generator choosing the level of new nodes
+	seed uint64
+}
+
+type keyNode struct {
+	key  string
+	next []*keyNode
+}
+
+func newKeyList() *keyList {
+	return &keyList{
+		head:  keyNode{next: make([]*keyNode, keyListLevels)},
+		level: 1,
+		seed:  0x9e3779b97f4a7c15,
+	}
+}
+
+// randomLevel returns 1 with probability 3/4, 2 with 3/16 and so on.
+func (l *keyList) randomLevel() int {
+	level := 1
+	for level < keyListLevels {
+		l.seed ^= l.seed << 13
+		l.seed ^= l.seed >> 7
+		l.seed ^= l.seed << 17
+		if l.seed&3 != 0 {
+			break
+		}
+		level++
+	}
+	return level
+}
+
+// path fills prev with the last node before key at every level.
+func (l *keyList) path(key string, prev []*keyNode) {
+	n := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+		prev[i] = n
+	}
+}
+
+// insert adds key, which must not be in the list yet.
+func (l *keyList) insert(key string) {
+	var prev [keyListLevels]*keyNode
+	l.path(key, prev[:])
+	level := l.randomLevel()
+	for ; l.level < level; l.level++ {
+		prev[l.level] = &l.head
+	}
+	n := &keyNode{key: key, next: make([]*keyNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+}
+
+func (l *keyList) remove(key string) {
+	var prev [keyListLevels]*keyNode
+	l.path(key, prev[:])
+	n := prev[0].next[0]
+	if n == nil || n.key != key {
+		return
+	}
+	for i := range n.next {
+		prev[i].next[i] = n.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+}
+
+// seek returns the node of the first key not less than key, nil if none.
+func (l *keyList) seek(key string) *keyNode {
+	n := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+	}
+	return n.next[0]
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"Bitcask"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+)
+
+var (
+	addr        string
+	storagePath string
+	merged      bool
+	interval    int64
+	maxSize     uint64
+)
+
+// A server speaking the memcached text protocol, so memcached clients can
+// be used with a bitcask store. See commands for what it supports.
+func main() {
+	flag.StringVar(&addr, "addr", "127.0.0.1:11212", "bitcask memcached protocol listen addr")
+	flag.StringVar(&storagePath, "s", "Storage", "data storage path")
+	flag.BoolVar(&merged, "m", true, "true: open file merge; false: not open file merge ")
+	flag.Int64Var(&interval, "t", 3600, "interval for file merging")
+	flag.Uint64Var(&maxSize, "ms", 1<<31, "single data file maxsize")
+	flag.Parse()
+
+	opt := &Bitcask.Options{
+		MaxFileSize: maxSize,
+	}
+	bc, err := Bitcask.Open(storagePath, opt)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if merged {
+		mergeWorker := Bitcask.NewMerge(bc, interval)
+		mergeWorker.Start()
+		defer mergeWorker.Stop()
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		bc.Close()
+		log.Fatalln(err)
+	}
+	log.Println("Bitcask listen at : ", addr)
+	s := newServer(bc)
+	go func() {
+		if err := s.serve(l); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	<-quit
+
+	log.Println("Shutdown Server ...")
+	l.Close()
+	s.closeConns()
+	bc.Close()
+	log.Println("Server exiting")
+}
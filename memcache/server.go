@@ -0,0 +1,492 @@
+package main
+
+import (
+	"Bitcask"
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// https://github.com/memcached/memcached/blob/master/doc/protocol.txt
+const (
+	maxLine      = 64 << 10
+	maxKeySize   = 250
+	maxValueSize = 1 << 20
+	// exptimes up to 30 days are relative, larger ones unix times
+	maxRelativeExptime = 60 * 60 * 24 * 30
+
+	version = "1.6.0-bitcask"
+)
+
+var commands map[string]func(s *server, c *conn, args [][]byte)
+
+func init() {
+	commands = map[string]func(s *server, c *conn, args [][]byte){
+		"get":     get,
+		"gets":    get,
+		"set":     store,
+		"add":     store,
+		"replace": store,
+		"cas":     store,
+		"delete":  del,
+		"incr":    incr,
+		"decr":    incr,
+		"touch":   touch,
+		"stats":   stats,
+		"version": versionInfo,
+	}
+}
+
+// counters are the statistics reported by stats.
+type counters struct {
+	cmdGet, getHits, getMisses                 int64
+	cmdSet, cmdTouch, touchHits, touchMisses   int64
+	deleteHits, deleteMisses                   int64
+	incrHits, incrMisses, decrHits, decrMisses int64
+	casHits, casMisses, casBadval              int64
+}
+
+type server struct {
+	bc      *Bitcask.BitCask
+	started time.Time
+	clients int64
+	total   int64
+	stats   counters
+
+	lock  *sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func newServer(bc *Bitcask.BitCask) *server {
+	return &server{
+		bc:      bc,
+		started: time.Now(),
+		lock:    &sync.Mutex{},
+		conns:   make(map[net.Conn]bool),
+	}
+}
+
+func (s *server) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s.lock.Lock()
+		s.conns[conn] = true
+		s.lock.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// closeConns ends every connection.
+func (s *server) closeConns() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// conn is one client connection. A command ending in noreply sets noreply
+// and its answer is dropped.
+type conn struct {
+	br      *bufio.Reader
+	bw      *bufio.Writer
+	noreply bool
+	closing bool
+}
+
+func (c *conn) reply(line string) {
+	if !c.noreply {
+		c.bw.WriteString(line + "\r\n")
+	}
+}
+
+// clientError answers a malformed request.
+func (c *conn) clientError(msg string) {
+	c.bw.WriteString("CLIENT_ERROR " + msg + "\r\n")
+}
+
+// serverError answers a store failure.
+func (c *conn) serverError(err error) {
+	c.bw.WriteString("SERVER_ERROR " + strings.TrimSpace(err.Error()) + "\r\n")
+}
+
+func (s *server) handle(nc net.Conn) {
+	atomic.AddInt64(&s.clients, 1)
+	atomic.AddInt64(&s.total, 1)
+	defer func() {
+		atomic.AddInt64(&s.clients, -1)
+		s.lock.Lock()
+		delete(s.conns, nc)
+		s.lock.Unlock()
+		nc.Close()
+	}()
+
+	c := &conn{
+		br: bufio.NewReaderSize(nc, maxLine),
+		bw: bufio.NewWriter(nc),
+	}
+	for !c.closing {
+		line, err := c.br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			c.clientError("line too long")
+			c.bw.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Println(nc.RemoteAddr(), err)
+			}
+			return
+		}
+		// line is only valid until the next read
+		args := bytes.Fields(append([]byte{}, line...))
+		if len(args) == 0 {
+			c.bw.WriteString("ERROR\r\n")
+		} else if name := string(args[0]); name == "quit" {
+			return
+		} else if run, ok := commands[name]; ok {
+			c.noreply = false
+			run(s, c, args)
+		} else {
+			c.bw.WriteString("ERROR\r\n")
+		}
+		// answer pipelined commands together
+		if c.br.Buffered() == 0 {
+			if err := c.bw.Flush(); err != nil {
+				return
+			}
+		}
+	}
+	c.bw.Flush()
+}
+
+// takeNoreply drops a trailing noreply from args, which has at least min
+// arguments, and remembers it.
+func takeNoreply(c *conn, args [][]byte, min int) [][]byte {
+	if len(args) > min && string(args[len(args)-1]) == "noreply" {
+		c.noreply = true
+		return args[:len(args)-1]
+	}
+	return args
+}
+
+func validKey(key []byte) bool {
+	if len(key) > maxKeySize {
+		return false
+	}
+	for _, b := range key {
+		if b < 0x21 || b == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// expiresAt converts a memcached exptime to a time, zero for never. A
+// negative exptime is already past.
+func expiresAt(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Unix(0, 0)
+	case exptime <= maxRelativeExptime:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
+
+// get answers get and gets, which also sends the version of each key as
+// its cas unique.
+func get(s *server, c *conn, args [][]byte) {
+	if len(args) < 2 {
+		c.bw.WriteString("ERROR\r\n")
+		return
+	}
+	withCas := string(args[0]) == "gets"
+	for _, key := range args[1:] {
+		if !validKey(key) {
+			c.clientError("bad command line format")
+			return
+		}
+	}
+	for _, key := range args[1:] {
+		atomic.AddInt64(&s.stats.cmdGet, 1)
+		value, meta, version, err := s.bc.GetWithVersion(key)
+		if err == Bitcask.KeyNotFoundErr {
+			atomic.AddInt64(&s.stats.getMisses, 1)
+			continue
+		}
+		if err != nil {
+			c.serverError(err)
+			return
+		}
+		atomic.AddInt64(&s.stats.getHits, 1)
+		header := "VALUE " + string(key) + " " + strconv.FormatUint(uint64(meta.Flags), 10) +
+			" " + strconv.Itoa(len(value))
+		if withCas {
+			header += " " + strconv.FormatUint(version, 10)
+		}
+		c.bw.WriteString(header + "\r\n")
+		c.bw.Write(value)
+		c.bw.WriteString("\r\n")
+	}
+	c.bw.WriteString("END\r\n")
+}
+
+// store answers set, add, replace and cas:
+//
+//	<command> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+//
+// followed by a line of <bytes> bytes of data.
+func store(s *server, c *conn, args [][]byte) {
+	name := string(args[0])
+	n := 5
+	if name == "cas" {
+		n = 6
+	}
+	args = takeNoreply(c, args, n)
+	if len(args) != n {
+		c.bw.WriteString("ERROR\r\n")
+		return
+	}
+	flags, err1 := strconv.ParseUint(string(args[2]), 10, 32)
+	exptime, err2 := strconv.ParseInt(string(args[3]), 10, 64)
+	size, err3 := strconv.Atoi(string(args[4]))
+	if err1 != nil || err2 != nil || err3 != nil || size < 0 || !validKey(args[1]) {
+		c.clientError("bad command line format")
+		return
+	}
+	if size > maxValueSize {
+		// skip the data, which would otherwise be read as commands
+		if _, err := c.br.Discard(size + 2); err != nil {
+			c.closing = true
+		}
+		c.bw.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.br, data); err != nil {
+		c.closing = true
+		return
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		c.clientError("bad data chunk")
+		c.closing = true
+		return
+	}
+	atomic.AddInt64(&s.stats.cmdSet, 1)
+	key, value := args[1], data[:size]
+	meta := &Bitcask.Meta{Flags: uint32(flags), ExpiresAt: expiresAt(exptime)}
+
+	var ok bool
+	var err error
+	switch name {
+	case "set":
+		ok, err = s.bc.PutIf(key, value, meta, Bitcask.PutAlways)
+	case "add":
+		ok, err = s.bc.PutIf(key, value, meta, Bitcask.PutIfAbsent)
+	case "replace":
+		ok, err = s.bc.PutIf(key, value, meta, Bitcask.PutIfExists)
+	case "cas":
+		version, perr := strconv.ParseUint(string(args[5]), 10, 64)
+		if perr != nil {
+			c.clientError("bad command line format")
+			return
+		}
+		ok, err = s.bc.PutIfVersion(key, value, meta, version)
+		switch {
+		case err == Bitcask.KeyNotFoundErr:
+			atomic.AddInt64(&s.stats.casMisses, 1)
+			c.reply("NOT_FOUND")
+			return
+		case err == nil && !ok:
+			atomic.AddInt64(&s.stats.casBadval, 1)
+			c.reply("EXISTS")
+			return
+		case err == nil:
+			atomic.AddInt64(&s.stats.casHits, 1)
+		}
+	}
+	if err != nil {
+		c.serverError(err)
+		return
+	}
+	if !ok {
+		c.reply("NOT_STORED")
+		return
+	}
+	c.reply("STORED")
+}
+
+// del answers delete <key> [noreply]. The time argument of old clients is
+// accepted if it is 0.
+func del(s *server, c *conn, args [][]byte) {
+	args = takeNoreply(c, args, 2)
+	if len(args) == 3 && string(args[2]) == "0" {
+		args = args[:2]
+	}
+	if len(args) != 2 || !validKey(args[1]) {
+		c.clientError("bad command line format.  Usage: delete <key> [noreply]")
+		return
+	}
+	err := s.bc.Del(args[1])
+	if err == Bitcask.KeyNotFoundErr {
+		atomic.AddInt64(&s.stats.deleteMisses, 1)
+		c.reply("NOT_FOUND")
+		return
+	}
+	if err != nil {
+		c.serverError(err)
+		return
+	}
+	atomic.AddInt64(&s.stats.deleteHits, 1)
+	c.reply("DELETED")
+}
+
+// incr answers incr and decr <key> <delta> [noreply]. Values are unsigned
+// 64 bit decimals: incr wraps around and decr stops at 0. The flags and
+// exptime of the key are kept.
+func incr(s *server, c *conn, args [][]byte) {
+	decr := string(args[0]) == "decr"
+	args = takeNoreply(c, args, 3)
+	if len(args) != 3 || !validKey(args[1]) {
+		c.bw.WriteString("ERROR\r\n")
+		return
+	}
+	delta, err := strconv.ParseUint(string(args[2]), 10, 64)
+	if err != nil {
+		c.clientError("invalid numeric delta argument")
+		return
+	}
+	hits, misses := &s.stats.incrHits, &s.stats.incrMisses
+	if decr {
+		hits, misses = &s.stats.decrHits, &s.stats.decrMisses
+	}
+	key := args[1]
+	for {
+		value, meta, version, err := s.bc.GetWithVersion(key)
+		if err == Bitcask.KeyNotFoundErr {
+			atomic.AddInt64(misses, 1)
+			c.reply("NOT_FOUND")
+			return
+		}
+		if err != nil {
+			c.serverError(err)
+			return
+		}
+		n, err := strconv.ParseUint(string(bytes.TrimSpace(value)), 10, 64)
+		if err != nil {
+			c.clientError("cannot increment or decrement non-numeric value")
+			return
+		}
+		switch {
+		case !decr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		result := strconv.FormatUint(n, 10)
+		ok, err := s.bc.PutIfVersion(key, []byte(result), meta, version)
+		if err != nil && err != Bitcask.KeyNotFoundErr {
+			c.serverError(err)
+			return
+		}
+		// on a concurrent write try again with the new value
+		if ok {
+			atomic.AddInt64(hits, 1)
+			c.reply(result)
+			return
+		}
+	}
+}
+
+// touch answers touch <key> <exptime> [noreply].
+func touch(s *server, c *conn, args [][]byte) {
+	args = takeNoreply(c, args, 3)
+	if len(args) != 3 || !validKey(args[1]) {
+		c.bw.WriteString("ERROR\r\n")
+		return
+	}
+	exptime, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		c.clientError("invalid exptime argument")
+		return
+	}
+	atomic.AddInt64(&s.stats.cmdTouch, 1)
+	err = s.bc.Expire(args[1], expiresAt(exptime))
+	if err == Bitcask.KeyNotFoundErr {
+		atomic.AddInt64(&s.stats.touchMisses, 1)
+		c.reply("NOT_FOUND")
+		return
+	}
+	if err != nil {
+		c.serverError(err)
+		return
+	}
+	atomic.AddInt64(&s.stats.touchHits, 1)
+	c.reply("TOUCHED")
+}
+
+// stats answers the general statistics; stats groups like "stats items"
+// are not supported.
+func stats(s *server, c *conn, args [][]byte) {
+	if len(args) != 1 {
+		c.bw.WriteString("ERROR\r\n")
+		return
+	}
+	now := time.Now()
+	st := &s.stats
+	lines := []struct {
+		name  string
+		value int64
+	}{
+		{"pid", int64(os.Getpid())},
+		{"uptime", int64(now.Sub(s.started) / time.Second)},
+		{"time", now.Unix()},
+		{"curr_connections", atomic.LoadInt64(&s.clients)},
+		{"total_connections", atomic.LoadInt64(&s.total)},
+		{"cmd_get", atomic.LoadInt64(&st.cmdGet)},
+		{"cmd_set", atomic.LoadInt64(&st.cmdSet)},
+		{"cmd_touch", atomic.LoadInt64(&st.cmdTouch)},
+		{"get_hits", atomic.LoadInt64(&st.getHits)},
+		{"get_misses", atomic.LoadInt64(&st.getMisses)},
+		{"delete_hits", atomic.LoadInt64(&st.deleteHits)},
+		{"delete_misses", atomic.LoadInt64(&st.deleteMisses)},
+		{"incr_hits", atomic.LoadInt64(&st.incrHits)},
+		{"incr_misses", atomic.LoadInt64(&st.incrMisses)},
+		{"decr_hits", atomic.LoadInt64(&st.decrHits)},
+		{"decr_misses", atomic.LoadInt64(&st.decrMisses)},
+		{"cas_hits", atomic.LoadInt64(&st.casHits)},
+		{"cas_misses", atomic.LoadInt64(&st.casMisses)},
+		{"cas_badval", atomic.LoadInt64(&st.casBadval)},
+		{"touch_hits", atomic.LoadInt64(&st.touchHits)},
+		{"touch_misses", atomic.LoadInt64(&st.touchMisses)},
+		// expired keys merge has not dropped yet are counted too
+		{"curr_items", int64(s.bc.Len())},
+	}
+	c.bw.WriteString("STAT version " + version + "\r\n")
+	for _, l := range lines {
+		c.bw.WriteString("STAT " + l.name + " " + strconv.FormatInt(l.value, 10) + "\r\n")
+	}
+	c.bw.WriteString("END\r\n")
+}
+
+func versionInfo(s *server, c *conn, args [][]byte) {
+	c.bw.WriteString("VERSION " + version + "\r\n")
+}
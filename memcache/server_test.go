@@ -0,0 +1,164 @@
+package main
+
+import (
+	"Bitcask"
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// client speaks the text protocol to a server over an in-memory connection.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func newClient(t *testing.T) *client {
+	t.Helper()
+	bc, err := Bitcask.Open(t.TempDir(), Bitcask.NewOptions(0, 0, -1, 0, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(bc)
+	conn, peer := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		s.handle(peer)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+		bc.Close()
+	})
+	return &client{t: t, conn: conn, br: bufio.NewReader(conn)}
+}
+
+func (c *client) send(req string) {
+	go c.conn.Write([]byte(req))
+}
+
+// expect sends req and fails unless the server answers exactly want.
+func (c *client) expect(req, want string) {
+	c.t.Helper()
+	c.send(req)
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c.br, got); err != nil {
+		c.t.Fatalf("%q: read %q: %v", req, got, err)
+	}
+	if string(got) != want {
+		c.t.Fatalf("%q answered %q, want %q", req, got, want)
+	}
+}
+
+// casUnique returns the cas unique gets sends for key.
+func (c *client) casUnique(key string) string {
+	c.t.Helper()
+	c.send("gets " + key + "\r\n")
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.br.ReadString('\n')
+	fields := strings.Fields(line)
+	if err != nil || len(fields) != 5 || fields[0] != "VALUE" {
+		c.t.Fatalf("gets %s answered %q, %v", key, line, err)
+	}
+	for rest := ""; rest != "END\r\n"; {
+		if rest, err = c.br.ReadString('\n'); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	return fields[4]
+}
+
+func TestGetSet(t *testing.T) {
+	c := newClient(t)
+	c.expect("get a\r\n", "END\r\n")
+	c.expect("set a 5 0 3\r\nxyz\r\n", "STORED\r\n")
+	c.expect("set b 0 0 0\r\n\r\n", "STORED\r\n")
+	c.expect("get a b missing\r\n", "VALUE a 5 3\r\nxyz\r\nVALUE b 0 0\r\n\r\nEND\r\n")
+	c.expect("add a 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+	c.expect("replace missing 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+	c.expect("set a 0 0 1 noreply\r\nx\r\nget a\r\n", "VALUE a 0 1\r\nx\r\nEND\r\n")
+	c.expect("delete b\r\n", "DELETED\r\n")
+	c.expect("delete b\r\n", "NOT_FOUND\r\n")
+	c.expect("set c 0 0 2\r\nabc\r\n", "CLIENT_ERROR bad data chunk\r\n")
+}
+
+func TestCas(t *testing.T) {
+	c := newClient(t)
+	c.expect("cas a 0 0 1 1\r\nx\r\n", "NOT_FOUND\r\n")
+	c.expect("set a 0 0 1\r\n1\r\n", "STORED\r\n")
+	stale := c.casUnique("a")
+	c.expect("set a 0 0 1\r\n2\r\n", "STORED\r\n")
+	current := c.casUnique("a")
+	if current == stale {
+		t.Fatalf("cas unique %s unchanged by a set", current)
+	}
+	c.expect("cas a 0 0 1 "+stale+"\r\n3\r\n", "EXISTS\r\n")
+	c.expect("cas a 0 0 1 "+current+"\r\n4\r\n", "STORED\r\n")
+	c.expect("cas a 0 0 1 "+current+"\r\n5\r\n", "EXISTS\r\n")
+	c.expect("get a\r\n", "VALUE a 0 1\r\n4\r\nEND\r\n")
+}
+
+func TestIncr(t *testing.T) {
+	c := newClient(t)
+	c.expect("incr n 1\r\n", "NOT_FOUND\r\n")
+	c.expect("decr n 1\r\n", "NOT_FOUND\r\n")
+	c.expect("set n 7 0 2\r\n10\r\n", "STORED\r\n")
+	c.expect("incr n 5\r\n", "15\r\n")
+	c.expect("decr n 20\r\n", "0\r\n")
+	c.expect("set n 7 0 20\r\n18446744073709551615\r\n", "STORED\r\n")
+	c.expect("incr n 2\r\n", "1\r\n")
+	// flags are kept
+	c.expect("get n\r\n", "VALUE n 7 1\r\n1\r\nEND\r\n")
+	c.expect("incr n x\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n")
+	c.expect("set s 0 0 3\r\nabc\r\n", "STORED\r\n")
+	c.expect("incr s 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+	c.expect("decr s 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+}
+
+func TestTouch(t *testing.T) {
+	c := newClient(t)
+	c.expect("touch a 100\r\n", "NOT_FOUND\r\n")
+	c.expect("set a 0 0 1\r\nx\r\n", "STORED\r\n")
+	c.expect("touch a 100\r\n", "TOUCHED\r\n")
+	c.expect("get a\r\n", "VALUE a 0 1\r\nx\r\nEND\r\n")
+	// a negative exptime expires the key at once
+	c.expect("touch a -1\r\n", "TOUCHED\r\n")
+	c.expect("get a\r\n", "END\r\n")
+	c.expect("touch a 100\r\n", "NOT_FOUND\r\n")
+}
+
+func TestSetTooLarge(t *testing.T) {
+	c := newClient(t)
+	c.expect("set a 0 0 1\r\nx\r\n", "STORED\r\n")
+	// the data, holding what looks like commands, must be skipped whole
+	data := strings.Repeat("delete a\r\n", maxValueSize/10+1)
+	c.expect("set a 0 0 "+strconv.Itoa(len(data))+"\r\n"+data+"\r\nget a\r\n",
+		"SERVER_ERROR object too large for cache\r\nVALUE a 0 1\r\nx\r\nEND\r\n")
+	c.expect("version\r\n", "VERSION "+version+"\r\n")
+}
+
+func TestStatsItems(t *testing.T) {
+	c := newClient(t)
+	c.expect("set a 0 0 1\r\nx\r\nset b 0 0 1\r\ny\r\ndelete a\r\n", "STORED\r\nSTORED\r\nDELETED\r\n")
+	c.send("stats\r\n")
+	var items string
+	for line := ""; line != "END\r\n"; {
+		var err error
+		if line, err = c.br.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "STAT curr_items ") {
+			items = line
+		}
+	}
+	if items != "STAT curr_items 1\r\n" {
+		t.Fatalf("stats sent %q", items)
+	}
+}
@@ -0,0 +1,334 @@
+package Bitcask
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemFS is a FileSystem held in memory, for tests and stores that need not
+// outlive the process. As on unix, a removed file stays readable through
+// the handles open on it.
+type MemFS struct {
+	lock  *sync.RWMutex
+	files map[string]*memNode
+	dirs  map[string]bool
+}
+
+type memNode struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		lock:  &sync.RWMutex{},
+		files: make(map[string]*memNode),
+		dirs:  map[string]bool{".": true, "/": true},
+	}
+}
+
+// Clone returns a copy of fs sharing nothing with it, a snapshot of every
+// file as it is now.
+func (fs *MemFS) Clone() *MemFS {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
+	c := NewMemFS()
+	for name, node := range fs.files {
+		c.files[name] = &memNode{data: append([]byte{}, node.data...), modTime: node.modTime}
+	}
+	for dir := range fs.dirs {
+		c.dirs[dir] = true
+	}
+	return c
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.dirs[name] {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: isDirErr}
+		}
+		return &memFile{fs: fs, name: name, node: &memNode{}, flag: flag, dir: true}, nil
+	}
+	node, ok := fs.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if !fs.dirs[filepath.Dir(name)] {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		node = &memNode{modTime: time.Now()}
+		fs.files[name] = node
+	}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	return &memFile{fs: fs, name: name, node: node, flag: flag}, nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
+	if fs.dirs[name] {
+		return &memInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	node, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return &memInfo{name: filepath.Base(name), size: int64(len(node.data)), modTime: node.modTime}, nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if !fs.dirs[name] {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if len(fs.children(name)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: notEmptyErr}
+	}
+	delete(fs.dirs, name)
+	return nil
+}
+
+// Rename moves a file, replacing newpath if it exists. Directories can't
+// be renamed.
+func (fs *MemFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	node, ok := fs.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if !fs.dirs[filepath.Dir(newpath)] || fs.dirs[newpath] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldpath)
+	fs.files[newpath] = node
+	return nil
+}
+
+func (fs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	for p := path; !fs.dirs[p]; p = filepath.Dir(p) {
+		if _, ok := fs.files[p]; ok {
+			return &os.PathError{Op: "mkdir", Path: p, Err: notDirErr}
+		}
+		fs.dirs[p] = true
+	}
+	return nil
+}
+
+func (fs *MemFS) ReadDirNames(dir string) ([]string, error) {
+	dir = filepath.Clean(dir)
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
+	if !fs.dirs[dir] {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	return fs.children(dir), nil
+}
+
+func (fs *MemFS) children(dir string) []string {
+	var names []string
+	for name := range fs.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for name := range fs.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+type memFile struct {
+	fs     *MemFS
+	name   string
+	node   *memNode
+	flag   int
+	dir    bool
+	offset int64
+	closed bool
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	case !write && f.flag&os.O_WRONLY != 0:
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	f.fs.lock.RLock()
+	defer f.fs.lock.RUnlock()
+
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		f.fs.lock.RLock()
+		f.offset = int64(len(f.node.data))
+		f.fs.lock.RUnlock()
+	}
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if size, end := int64(len(f.node.data)), off+int64(len(p)); end > size {
+		if end > int64(cap(f.node.data)) {
+			data := make([]byte, size, 2*end)
+			copy(data, f.node.data)
+			f.node.data = data
+		}
+		f.node.data = f.node.data[:end]
+		// a write past the end leaves a hole of zeros
+		for i := size; i < off; i++ {
+			f.node.data[i] = 0
+		}
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	f.fs.lock.RLock()
+	defer f.fs.lock.RUnlock()
+
+	return &memInfo{
+		name:    filepath.Base(f.name),
+		size:    int64(len(f.node.data)),
+		modTime: f.node.modTime,
+		dir:     f.dir,
+	}, nil
+}
+
+// Sync does nothing, memory is as durable as MemFS gets.
+func (f *memFile) Sync() error {
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.dir }
+func (i *memInfo) Sys() interface{}   { return nil }
+
+func (i *memInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+var (
+	isDirErr    = fmt.Errorf("Is a directory ")
+	notDirErr   = fmt.Errorf("Not a directory ")
+	notEmptyErr = fmt.Errorf("Directory not empty ")
+)
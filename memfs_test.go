@@ -0,0 +1,144 @@
+package Bitcask
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func writeMem(t *testing.T, fs *MemFS, name, data string) {
+	t.Helper()
+	f, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func readMem(t *testing.T, fs *MemFS, name string) string {
+	t.Helper()
+	buf, err := readFile(fs, name)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return string(buf)
+}
+
+func TestMemFSRename(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/db", 0755)
+	writeMem(t, fs, "/db/a", "1")
+	writeMem(t, fs, "/db/b", "2")
+
+	if err := fs.Rename("/db/a", "/db/b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMem(t, fs, "/db/b"); got != "1" {
+		t.Fatalf("renamed over b, b holds %q", got)
+	}
+	if _, err := fs.Stat("/db/a"); !os.IsNotExist(err) {
+		t.Fatalf("stat of the old name: %v", err)
+	}
+	if err := fs.Rename("/db/a", "/db/c"); !os.IsNotExist(err) {
+		t.Fatalf("rename of a missing file: %v", err)
+	}
+	if err := fs.Rename("/db/b", "/nodir/b"); !os.IsNotExist(err) {
+		t.Fatalf("rename into a missing directory: %v", err)
+	}
+	if err := fs.Rename("/db/b", "/db"); err == nil {
+		t.Fatal("renamed over a directory")
+	}
+}
+
+func TestMemFSTruncate(t *testing.T) {
+	fs := NewMemFS()
+	writeMem(t, fs, "/f", "hello")
+	f, err := fs.OpenFile("/f", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMem(t, fs, "/f"); got != "he" {
+		t.Fatalf("cut to 2 bytes, holds %q", got)
+	}
+	if err := f.Truncate(4); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMem(t, fs, "/f"); got != "he\x00\x00" {
+		t.Fatalf("grown to 4 bytes, holds %q", got)
+	}
+
+	ro, err := fs.OpenFile("/f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if err := ro.Truncate(0); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("truncate of a read only file: %v", err)
+	}
+}
+
+func TestMemFSReadDirNames(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/db/sub/deep", 0755)
+	writeMem(t, fs, "/db/b", "")
+	writeMem(t, fs, "/db/a", "")
+	writeMem(t, fs, "/db/sub/c", "")
+
+	names, err := fs.ReadDirNames("/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "sub"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("names %v, want %v", names, want)
+	}
+	if _, err := fs.ReadDirNames("/none"); !os.IsNotExist(err) {
+		t.Fatalf("read of a missing directory: %v", err)
+	}
+	if err := fs.Remove("/db/sub"); err == nil {
+		t.Fatal("removed a directory that is not empty")
+	}
+	if _, err := fs.OpenFile("/db/sub", os.O_RDWR, 0); err == nil {
+		t.Fatal("opened a directory for writing")
+	}
+}
+
+func TestMemFSClosedAndRemoved(t *testing.T) {
+	fs := NewMemFS()
+	writeMem(t, fs, "/f", "data")
+	f, err := fs.OpenFile("/f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a removed file stays readable through a handle open on it
+	if err := fs.Remove("/f"); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadAll(f); err != nil || string(buf) != "data" {
+		t.Fatalf("read of a removed file: %q, %v", buf, err)
+	}
+	if _, err := f.ReadAt(make([]byte, 1), 4); err != io.EOF {
+		t.Fatalf("read past the end: %v", err)
+	}
+
+	f.Close()
+	if _, err := f.ReadAt(make([]byte, 1), 0); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("read after close: %v", err)
+	}
+	if _, err := f.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("stat after close: %v", err)
+	}
+	if err := f.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("second close: %v", err)
+	}
+}
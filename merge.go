@@ -2,12 +2,10 @@ package Bitcask
 
 import (
 	"container/list"
-	"io"
 	"log"
-	"os"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,36 +14,25 @@ const (
 	StopCmd         = "STOP"
 )
 
-var (
-	mergeOnce *sync.Once
-	merge     *Merge
-)
-
-func init() {
-	mergeOnce = &sync.Once{}
-}
-
 type Merge struct {
 	bc           *BitCask
 	cmd          chan string
 	rate         int64
 	oldMergeSize int
 	mergeList    *list.List
+	// discarded is the Seq of the newest record in mergeList's files
+	discarded uint64
 }
 
+// NewMerge returns a Merge of bc. Only one of a store should run at a time.
 func NewMerge(bc *BitCask, rate int64) *Merge {
-	mergeOnce.Do(func() {
-		if merge == nil {
-			merge = &Merge{
-				bc:           bc,
-				cmd:          make(chan string),
-				rate:         rate,
-				oldMergeSize: 2,
-				mergeList:    list.New(),
-			}
-		}
-	})
-	return merge
+	return &Merge{
+		bc:           bc,
+		cmd:          make(chan string),
+		rate:         rate,
+		oldMergeSize: 2,
+		mergeList:    list.New(),
+	}
 }
 
 func (m *Merge) Start() {
@@ -62,6 +49,8 @@ func (m *Merge) work() {
 		select {
 		case <-m.cmd:
 			log.Println("STOP")
+			t.Stop()
+			return
 		case <-t.C:
 			log.Println("Start to merge files")
 			t.Reset(time.Second * time.Duration(m.rate))
@@ -72,83 +61,116 @@ func (m *Merge) work() {
 			}
 			if len(dataFiles) <= m.oldMergeSize {
 				log.Println("No files need to merge, dataList:", dataFiles)
+				continue
 			}
-			for i := 0; i < len(dataFiles); i++ {
-				err := m.mergeDataFile(dataFiles[i])
-				if err != nil {
-					log.Fatalln(err)
-				}
-				idx := strings.LastIndex(dataFiles[i], ".data")
-				m.mergeList.PushBack(struct {
-					dataFile string
-					hintFile string
-				}{
-					dataFile: dataFiles[i],
-					hintFile: dataFiles[i][:idx] + ".hint",
-				})
-			}
-			if err := m.removeOldFiles(); err != nil {
+			if err := m.Run(); err != nil {
 				log.Fatalln(err)
 			}
 		}
 	}
 }
 
-func (m *Merge) mergeDataFile(fileName string) error {
-	fp, err := os.OpenFile(m.bc.dir+"/"+fileName, os.O_RDONLY, 0755)
+// Run rewrites the live records of every data file older than the active
+// one into the active file, then removes the old files.
+func (m *Merge) Run() error {
+	if m.bc.readOnly {
+		return ReadOnlyErr
+	}
+	result := &MergeResult{StartedAt: time.Now()}
+	err := m.run(result)
+	result.Seconds = time.Since(result.StartedAt).Seconds()
+	m.bc.metrics.merge.observe(result.Seconds)
 	if err != nil {
-		return err
+		atomic.AddUint64(&m.bc.metrics.mergeErrors, 1)
+		result.Error = err.Error()
 	}
-	defer fp.Close()
+	m.bc.metrics.merged(result)
+	return err
+}
 
-	idx := strings.LastIndex(fileName, ".data")
-	fileID, err := strconv.Atoi(fileName[:idx])
+func (m *Merge) run(result *MergeResult) error {
+	dataFiles, err := ListDataFiles(m.bc)
 	if err != nil {
 		return err
 	}
-	buf := make([]byte, HeaderSize)
-	offset := 0
-	valueOffset := uint64(0)
-	for {
-		n, err := fp.Read(buf)
-		if err != nil && err != io.EOF {
-			return err
-		}
-		if err == io.EOF {
-			break
-		}
-		offset += n
-		_, tStamp, keySize, valueSize := DecodeEntryHeader(buf)
-		if err != nil {
-			return err
-		}
-		if keySize+valueSize == 0 {
+	m.bc.lock.RLock()
+	activeFile := strconv.Itoa(int(m.bc.writeFile.fileID)) + ".data"
+	m.bc.lock.RUnlock()
+	for i := 0; i < len(dataFiles); i++ {
+		if dataFiles[i] == activeFile {
 			continue
 		}
-		keyValue := make([]byte, keySize+valueSize)
-		n, err = fp.Read(keyValue)
-		valueOffset = uint64(offset) + uint64(keySize)
-		if err != nil && err != io.EOF {
+		if err := m.mergeDataFile(dataFiles[i]); err != nil {
+			m.mergeList.Init()
 			return err
 		}
-		if err == io.EOF {
-			break
+		idx := strings.LastIndex(dataFiles[i], ".data")
+		m.mergeList.PushBack(struct {
+			dataFile string
+			hintFile string
+		}{
+			dataFile: dataFiles[i],
+			hintFile: dataFiles[i][:idx] + ".hint",
+		})
+	}
+	return m.removeOldFiles(result)
+}
+
+func (m *Merge) mergeDataFile(fileName string) error {
+	fp, err := openRead(m.bc.fs, m.bc.dir+"/"+fileName)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	stat, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	fileID := FileIDOf(fileName)
+	return ReadRecords(fp, stat.Size(), func(rec *Record) error {
+		if seq := SeqOf(fileID, uint64(rec.Offset)); seq > m.discarded {
+			m.discarded = seq
+		}
+		if rec.IsTombstone() {
+			return nil
 		}
 		e := &Entry{
-			fileID:      uint32(fileID),
-			timeStamp:   tStamp,
-			valueOffset: valueOffset,
-			valueSize:   valueSize,
+			fileID:      fileID,
+			timeStamp:   rec.TimeStamp,
+			valueOffset: rec.ValueOffset(),
+			valueSize:   uint32(len(rec.Value)),
+			flags:       rec.Flags,
 		}
-		err = m.bc.put(keyValue[:keySize], keyValue[keySize:], e)
-		if err != nil {
-			return err
+		key := rec.Key
+		if rec.Flags&FlagEncrypted != 0 {
+			var err error
+			if key, err = m.bc.seal.open(key); err != nil {
+				return &RecordError{rec.Offset, err}
+			}
 		}
-	}
-	return nil
+		return m.bc.put(key, rec.Value, e)
+	})
 }
 
-func (m *Merge) removeOldFiles() error {
+func (m *Merge) removeOldFiles(result *MergeResult) error {
+	// hold the store lock so a concurrent backup never sees a half removed pair
+	m.bc.lock.Lock()
+	defer m.bc.lock.Unlock()
+
+	// the copies must be on disk before the originals are gone
+	if err := m.bc.sync(); err != nil {
+		m.mergeList.Init()
+		return err
+	}
+	// record what ChangesSince can no longer replay before it is gone
+	if m.mergeList.Len() > 0 && m.discarded > m.bc.discarded {
+		if err := writeHistoryFloor(m.bc.fs, m.bc.dir, m.discarded); err != nil {
+			m.mergeList.Init()
+			return err
+		}
+		m.bc.discarded = m.discarded
+	}
 	for {
 		item := m.mergeList.Front()
 		if item == nil {
@@ -165,12 +187,21 @@ func (m *Merge) removeOldFiles() error {
 		if err != nil {
 			return err
 		}
-		if err := os.Remove(m.bc.dir + "/" + value.dataFile); err != nil {
+		m.bc.metrics.forget(uint32(fileID))
+		stat, err := m.bc.fs.Stat(m.bc.dir + "/" + value.dataFile)
+		if err != nil {
+			return err
+		}
+		// hints first: a data file left without them is merged again, while
+		// hints left without data would point at nothing
+		if err := m.bc.fs.Remove(m.bc.dir + "/" + value.hintFile); err != nil {
 			return err
 		}
-		if err := os.Remove(m.bc.dir + "/" + value.hintFile); err != nil {
+		if err := m.bc.fs.Remove(m.bc.dir + "/" + value.dataFile); err != nil {
 			return err
 		}
+		result.Files++
+		result.RemovedBytes += stat.Size()
 		m.mergeList.Remove(item)
 		item.Value = nil
 		item = nextItem
@@ -0,0 +1,135 @@
+package Bitcask
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// A record flagged FlagMeta stores metaSz:fields before the value, where
+// every field is tag:len:bytes(1:2:len) and metaSz(2) is the byte length
+// of the fields.
+// Unknown tags are skipped so older versions can read newer records.
+
+const (
+	MetaHeaderSize = 2
+
+	metaTagContentType = 1
+	// metaTagExpiresAt holds unix milliseconds(8)
+	metaTagExpiresAt = 2
+	// metaTagFlags holds uint32(4), opaque to the store
+	metaTagFlags = 3
+)
+
+var (
+	MetaError   = fmt.Errorf("Record metadata error ")
+	MetaSizeErr = fmt.Errorf("Record metadata too large ")
+)
+
+// Meta holds optional attributes stored together with a value.
+type Meta struct {
+	ContentType string
+	// ExpiresAt is when reads start treating the key as deleted, zero for
+	// never. Merge drops expired keys.
+	ExpiresAt time.Time
+	// Flags are client defined, as the flags of memcached.
+	Flags uint32
+}
+
+func (m *Meta) isEmpty() bool {
+	return m == nil || m.ContentType == "" && m.ExpiresAt.IsZero() && m.Flags == 0
+}
+
+func (m *Meta) Expired(now time.Time) bool {
+	return m != nil && !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+// EncodeValue prefixes value with the encoded meta. It returns the value
+// unchanged and no flags when meta is empty, and MetaSizeErr when a field
+// or all of them are longer than their uint16 size can tell.
+func EncodeValue(value []byte, meta *Meta) ([]byte, uint8, error) {
+	if meta.isEmpty() {
+		return value, 0, nil
+	}
+	if len(meta.ContentType) > math.MaxUint16 {
+		return nil, 0, MetaSizeErr
+	}
+	var fields []byte
+	if meta.ContentType != "" {
+		fields = appendMetaField(fields, metaTagContentType, []byte(meta.ContentType))
+	}
+	if !meta.ExpiresAt.IsZero() {
+		var ms [8]byte
+		binary.LittleEndian.PutUint64(ms[:], uint64(meta.ExpiresAt.UnixNano()/int64(time.Millisecond)))
+		fields = appendMetaField(fields, metaTagExpiresAt, ms[:])
+	}
+	if meta.Flags != 0 {
+		var flags [4]byte
+		binary.LittleEndian.PutUint32(flags[:], meta.Flags)
+		fields = appendMetaField(fields, metaTagFlags, flags[:])
+	}
+	if len(fields) > math.MaxUint16 {
+		return nil, 0, MetaSizeErr
+	}
+	buf := make([]byte, MetaHeaderSize, MetaHeaderSize+len(fields)+len(value))
+	binary.LittleEndian.PutUint16(buf, uint16(len(fields)))
+	buf = append(buf, fields...)
+	return append(buf, value...), FlagMeta, nil
+}
+
+// DecodeValue splits a stored value into the user value and its meta,
+// decompressing it first if flags name a Codec.
+func DecodeValue(stored []byte, flags uint8) ([]byte, *Meta, error) {
+	stored, err := decompress(stored, flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := &Meta{}
+	if flags&FlagMeta == 0 {
+		return stored, meta, nil
+	}
+	if len(stored) < MetaHeaderSize {
+		return nil, nil, MetaError
+	}
+	end := MetaHeaderSize + int(binary.LittleEndian.Uint16(stored))
+	if end > len(stored) {
+		return nil, nil, MetaError
+	}
+	fields := stored[MetaHeaderSize:end]
+	for len(fields) > 0 {
+		if len(fields) < 3 {
+			return nil, nil, MetaError
+		}
+		tag := fields[0]
+		size := 3 + int(binary.LittleEndian.Uint16(fields[1:3]))
+		if size > len(fields) {
+			return nil, nil, MetaError
+		}
+		switch tag {
+		case metaTagContentType:
+			meta.ContentType = string(fields[3:size])
+		case metaTagExpiresAt:
+			if size != 3+8 {
+				return nil, nil, MetaError
+			}
+			ms := int64(binary.LittleEndian.Uint64(fields[3:size]))
+			meta.ExpiresAt = time.Unix(0, ms*int64(time.Millisecond))
+		case metaTagFlags:
+			if size != 3+4 {
+				return nil, nil, MetaError
+			}
+			meta.Flags = binary.LittleEndian.Uint32(fields[3:size])
+		}
+		fields = fields[size:]
+	}
+	return stored[end:], meta, nil
+}
+
+func appendMetaField(buf []byte, tag uint8, value []byte) []byte {
+	var header [3]byte
+	header[0] = tag
+	binary.LittleEndian.PutUint16(header[1:], uint16(len(value)))
+	buf = append(buf, header[:]...)
+	return append(buf, value...)
+}
@@ -0,0 +1,56 @@
+package Bitcask
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeValue(t *testing.T) {
+	meta := &Meta{ContentType: "text/plain", ExpiresAt: time.Unix(1700000000, 0), Flags: 7}
+	stored, flags, err := EncodeValue([]byte("value"), meta)
+	if err != nil || flags != FlagMeta {
+		t.Fatalf("encode: flags %d, %v", flags, err)
+	}
+	value, got, err := DecodeValue(stored, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "value" || got.ContentType != meta.ContentType || !got.ExpiresAt.Equal(meta.ExpiresAt) || got.Flags != 7 {
+		t.Fatalf("decoded %q %+v", value, got)
+	}
+
+	stored, flags, err = EncodeValue([]byte("value"), &Meta{})
+	if err != nil || flags != 0 || string(stored) != "value" {
+		t.Fatalf("empty meta: %q, flags %d, %v", stored, flags, err)
+	}
+}
+
+func TestEncodeValueTooLarge(t *testing.T) {
+	// the longest content type fits, but not once other fields join it
+	longest := strings.Repeat("x", math.MaxUint16)
+	if _, _, err := EncodeValue(nil, &Meta{ContentType: longest + "x"}); err != MetaSizeErr {
+		t.Fatalf("oversized field: %v", err)
+	}
+	if _, _, err := EncodeValue(nil, &Meta{ContentType: longest}); err != MetaSizeErr {
+		t.Fatalf("oversized fields: %v", err)
+	}
+	fits := longest[:math.MaxUint16-3-3-4]
+	stored, flags, err := EncodeValue(nil, &Meta{ContentType: fits, Flags: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, meta, err := DecodeValue(stored, flags); err != nil || meta.ContentType != fits {
+		t.Fatalf("decode of the largest meta: %v", err)
+	}
+
+	bc := openTest(t, t.TempDir())
+	defer bc.Close()
+	if err := bc.PutWithMeta([]byte("a"), nil, &Meta{ContentType: longest + "x"}); err != MetaSizeErr {
+		t.Fatalf("put with oversized meta: %v", err)
+	}
+	if _, err := bc.Get([]byte("a")); err != KeyNotFoundErr {
+		t.Fatalf("rejected put stored its key: %v", err)
+	}
+}
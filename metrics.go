@@ -0,0 +1,140 @@
+package Bitcask
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// latencyBounds are the histogram buckets of reads and writes, in seconds
+	latencyBounds = []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+	// mergeBounds are the histogram buckets of merge runs, in seconds
+	mergeBounds = []float64{.1, .5, 1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+)
+
+// Histogram is a snapshot of observations counted in buckets. Counts[i] is
+// the number of observations not above Bounds[i] and above the previous
+// bound; the last count is of those above every bound.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    float64   `json:"sum"`
+}
+
+func (h Histogram) Count() uint64 {
+	n := uint64(0)
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+type histogram struct {
+	lock   *sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		lock:   &sync.Mutex{},
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.counts[i]++
+	h.sum += v
+}
+
+// since observes the time elapsed since start, as in
+// defer h.since(time.Now()).
+func (h *histogram) since(start time.Time) {
+	h.observe(time.Since(start).Seconds())
+}
+
+func (h *histogram) snapshot() Histogram {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return Histogram{
+		Bounds: h.bounds,
+		Counts: append([]uint64{}, h.counts...),
+		Sum:    h.sum,
+	}
+}
+
+// metrics counts what a store does since it was opened. Data files share
+// the metrics of their store; files opened on their own have none.
+type metrics struct {
+	put, get, del *histogram
+	merge         *histogram
+
+	bytesWritten uint64
+	bytesRead    uint64
+	rotations    uint64
+	mergeErrors  uint64
+
+	lock *sync.Mutex
+	// records counts the records of each data file
+	records   map[uint32]int64
+	lastMerge *MergeResult
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		put:     newHistogram(latencyBounds),
+		get:     newHistogram(latencyBounds),
+		del:     newHistogram(latencyBounds),
+		merge:   newHistogram(mergeBounds),
+		lock:    &sync.Mutex{},
+		records: make(map[uint32]int64),
+	}
+}
+
+func (m *metrics) wrote(n int) {
+	if m != nil {
+		atomic.AddUint64(&m.bytesWritten, uint64(n))
+	}
+}
+
+func (m *metrics) read(n int) {
+	if m != nil {
+		atomic.AddUint64(&m.bytesRead, uint64(n))
+	}
+}
+
+func (m *metrics) recorded(fileID uint32, n int64) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.records[fileID] += n
+}
+
+// forget drops the counts of a removed data file.
+func (m *metrics) forget(fileID uint32) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.records, fileID)
+}
+
+func (m *metrics) merged(result *MergeResult) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.lastMerge = result
+}
@@ -0,0 +1,117 @@
+package Bitcask
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+var (
+	NotIntegerErr = fmt.Errorf("Value is not an integer ")
+	OverflowErr   = fmt.Errorf("Increment would overflow ")
+)
+
+// MergeOperator combines the current value of a key with an operand.
+// existing is nil when the key is not present.
+type MergeOperator interface {
+	Merge(existing, operand []byte) ([]byte, error)
+}
+
+// MergeOperatorFunc adapts an ordinary function to a MergeOperator.
+type MergeOperatorFunc func(existing, operand []byte) ([]byte, error)
+
+func (f MergeOperatorFunc) Merge(existing, operand []byte) ([]byte, error) {
+	return f(existing, operand)
+}
+
+// AppendOperator appends the operand to the existing value, separated by Sep.
+type AppendOperator struct {
+	Sep []byte
+}
+
+func (o AppendOperator) Merge(existing, operand []byte) ([]byte, error) {
+	if len(existing) == 0 {
+		return append([]byte{}, operand...), nil
+	}
+	buf := make([]byte, 0, len(existing)+len(o.Sep)+len(operand))
+	buf = append(buf, existing...)
+	buf = append(buf, o.Sep...)
+	return append(buf, operand...), nil
+}
+
+// MaxOperator keeps the larger of two decimal integers.
+type MaxOperator struct{}
+
+func (MaxOperator) Merge(existing, operand []byte) ([]byte, error) {
+	n, err := ParseInt(operand)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		old, err := ParseInt(existing)
+		if err != nil {
+			return nil, err
+		}
+		if old >= n {
+			return existing, nil
+		}
+	}
+	return FormatInt(n), nil
+}
+
+// SetUnionOperator treats values as Sep separated sets and adds every
+// member of the operand that is not already present.
+type SetUnionOperator struct {
+	Sep []byte
+}
+
+func (o SetUnionOperator) Merge(existing, operand []byte) ([]byte, error) {
+	var members [][]byte
+	seen := make(map[string]bool)
+	for _, v := range [][]byte{existing, operand} {
+		if len(v) == 0 {
+			continue
+		}
+		for _, m := range bytes.Split(v, o.Sep) {
+			if len(m) == 0 || seen[string(m)] {
+				continue
+			}
+			seen[string(m)] = true
+			members = append(members, m)
+		}
+	}
+	return bytes.Join(members, o.Sep), nil
+}
+
+// IncrOperator adds Delta to a decimal integer, treating a missing key as 0.
+type IncrOperator struct {
+	Delta int64
+}
+
+func (o IncrOperator) Merge(existing, operand []byte) ([]byte, error) {
+	n := int64(0)
+	if existing != nil {
+		var err error
+		n, err = ParseInt(existing)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if (o.Delta > 0 && n > math.MaxInt64-o.Delta) || (o.Delta < 0 && n < math.MinInt64-o.Delta) {
+		return nil, OverflowErr
+	}
+	return FormatInt(n + o.Delta), nil
+}
+
+func ParseInt(value []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, NotIntegerErr
+	}
+	return n, nil
+}
+
+func FormatInt(n int64) []byte {
+	return []byte(strconv.FormatInt(n, 10))
+}
@@ -0,0 +1,118 @@
+package Bitcask
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestOperators(t *testing.T) {
+	cases := []struct {
+		name              string
+		op                MergeOperator
+		existing, operand []byte
+		want              string
+		err               error
+	}{
+		{"append to missing", AppendOperator{Sep: []byte(",")}, nil, []byte("a"), "a", nil},
+		{"append to empty", AppendOperator{Sep: []byte(",")}, []byte{}, []byte("a"), "a", nil},
+		{"append", AppendOperator{Sep: []byte(",")}, []byte("a"), []byte("b"), "a,b", nil},
+		{"append without sep", AppendOperator{}, []byte("a"), []byte("b"), "ab", nil},
+		{"max of missing", MaxOperator{}, nil, []byte("5"), "5", nil},
+		{"max keeps larger", MaxOperator{}, []byte("7"), []byte("5"), "7", nil},
+		{"max takes larger", MaxOperator{}, []byte("-7"), []byte("5"), "5", nil},
+		{"max of non-numeric operand", MaxOperator{}, []byte("7"), []byte("x"), "", NotIntegerErr},
+		{"max of non-numeric value", MaxOperator{}, []byte("x"), []byte("5"), "", NotIntegerErr},
+		{"union with missing", SetUnionOperator{Sep: []byte(",")}, nil, []byte("b,a,b"), "b,a", nil},
+		{"union", SetUnionOperator{Sep: []byte(",")}, []byte("a,b"), []byte("c,a,,d"), "a,b,c,d", nil},
+		{"incr missing", IncrOperator{Delta: 3}, nil, nil, "3", nil},
+		{"incr", IncrOperator{Delta: -5}, []byte("3"), nil, "-2", nil},
+		{"incr non-numeric", IncrOperator{Delta: 1}, []byte("1.5"), nil, "", NotIntegerErr},
+		{"incr overflow", IncrOperator{Delta: 1}, FormatInt(math.MaxInt64), nil, "", OverflowErr},
+		{"decr overflow", IncrOperator{Delta: -2}, FormatInt(math.MinInt64 + 1), nil, "", OverflowErr},
+		{"func", MergeOperatorFunc(func(existing, operand []byte) ([]byte, error) {
+			return append(operand, existing...), nil
+		}), []byte("b"), []byte("a"), "ab", nil},
+	}
+	for _, c := range cases {
+		got, err := c.op.Merge(c.existing, c.operand)
+		if err != c.err || err == nil && string(got) != c.want {
+			t.Errorf("%s: %q, %v, want %q, %v", c.name, got, err, c.want, c.err)
+		}
+	}
+}
+
+func TestIncr(t *testing.T) {
+	bc := openTest(t, t.TempDir())
+	defer bc.Close()
+	for i, want := range []int64{5, 3, 10} {
+		n, err := bc.Incr([]byte("missing"), []int64{5, -2, 7}[i])
+		if err != nil || n != want {
+			t.Fatalf("incr %d: %d, %v, want %d", i, n, err, want)
+		}
+	}
+	putTest(t, bc, "text", "abc", "max", strconv.FormatInt(math.MaxInt64, 10))
+	if _, err := bc.Incr([]byte("text"), 1); err != NotIntegerErr {
+		t.Fatalf("incr of a non-numeric value: %v", err)
+	}
+	if _, err := bc.Incr([]byte("max"), 1); err != OverflowErr {
+		t.Fatalf("incr past the largest integer: %v", err)
+	}
+	// a failed incr leaves the value alone
+	checkStore(t, bc, map[string]string{"missing": "10", "text": "abc", "max": strconv.FormatInt(math.MaxInt64, 10)})
+}
+
+func TestApplyKeepsMeta(t *testing.T) {
+	bc := openTest(t, t.TempDir())
+	defer bc.Close()
+	meta := &Meta{ContentType: "text/plain", Flags: 3}
+	if err := bc.PutWithMeta([]byte("k"), []byte("a"), meta); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := bc.Apply([]byte("k"), []byte("b"), AppendOperator{Sep: []byte(" ")}); err != nil || string(v) != "a b" {
+		t.Fatalf("apply: %q, %v", v, err)
+	}
+	if _, got, err := bc.GetWithMeta([]byte("k")); err != nil || *got != *meta {
+		t.Fatalf("meta after apply %+v, %v", got, err)
+	}
+}
+
+// TestOperatorsAcrossMerge applies every operator to keys whose earlier
+// values merge rewrote, then reopens.
+func TestOperatorsAcrossMerge(t *testing.T) {
+	dir := t.TempDir()
+	bc := openTest(t, dir)
+	ops := []struct {
+		key      string
+		op       MergeOperator
+		operands []string
+		want     string
+	}{
+		{"append", AppendOperator{Sep: []byte(",")}, []string{"a", "b", "c", "d"}, "a,b,c,d"},
+		{"max", MaxOperator{}, []string{"3", "9", "4", "7"}, "9"},
+		{"union", SetUnionOperator{Sep: []byte(",")}, []string{"x", "y,x", "z", "y"}, "x,y,z"},
+		{"incr", IncrOperator{Delta: 2}, []string{"", "", "", ""}, "8"},
+	}
+	want := make(map[string]string)
+	for i := 0; i < 4; i++ {
+		for _, o := range ops {
+			if _, err := bc.Apply([]byte(o.key), []byte(o.operands[i]), o.op); err != nil {
+				t.Fatalf("apply %s: %v", o.key, err)
+			}
+		}
+		if i == 1 {
+			rotateTest(t, bc)
+			if err := NewMerge(bc, 0).Run(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, o := range ops {
+		want[o.key] = o.want
+	}
+	checkStore(t, bc, want)
+	bc.Close()
+	bc = openTest(t, dir)
+	defer bc.Close()
+	checkStore(t, bc, want)
+}
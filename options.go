@@ -6,6 +6,11 @@ const (
 	defaultTimeoutSecs   = 10
 	defaultValueMaxSize  = 1 << 20 // 1m
 	defaultCheckSumCrc32 = false
+	// defaultCompressMinSize skips values too short to gain from compression
+	defaultCompressMinSize = 256
+
+	// maxFileSizeLimit keeps offsets below 4G so a Seq can address them
+	maxFileSizeLimit = 1 << 31
 )
 
 type Options struct {
@@ -16,6 +21,17 @@ type Options struct {
 	MergeSecs       int
 	CheckSumCrc32   bool
 	ValueMaxSize    uint64
+	// FileSystem holds the files of the store, the one of the operating
+	// system if nil.
+	FileSystem FileSystem
+	// Compression compresses the values written from now on, along with
+	// their meta, unless shorter than CompressMinSize or left no shorter.
+	// Records stay readable whatever it is set to later.
+	Compression     Codec
+	CompressMinSize int
+	// Encryption encrypts the keys and values written from now on if set.
+	// It must also be set to read records written with it.
+	Encryption KeyProvider
 }
 
 func NewOptions(expirySecs int, maxFileSize uint64, openTimeoutSecs, mergeSecs int, readWrite bool) *Options {
@@ -38,5 +54,6 @@ func NewOptions(expirySecs int, maxFileSize uint64, openTimeoutSecs, mergeSecs i
 		ReadWrite:       readWrite,
 		CheckSumCrc32:   defaultCheckSumCrc32,
 		ValueMaxSize:    defaultValueMaxSize,
+		CompressMinSize: defaultCompressMinSize,
 	}
 }
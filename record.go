@@ -0,0 +1,215 @@
+package Bitcask
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Record is one entry decoded from a data file.
+type Record struct {
+	Offset    int64
+	CRC32     uint32
+	TimeStamp uint32
+	Flags     uint8
+	Key       []byte
+	Value     []byte
+}
+
+func (r *Record) Size() int64 {
+	return int64(HeaderSize + len(r.Key) + len(r.Value))
+}
+
+func (r *Record) ValueOffset() uint64 {
+	return uint64(r.Offset) + uint64(HeaderSize+len(r.Key))
+}
+
+// IsTombstone also recognises the old delete records, which had neither key
+// nor value and no flags.
+func (r *Record) IsTombstone() bool {
+	return r.Flags&FlagTombstone != 0 || len(r.Key)+len(r.Value) == 0
+}
+
+// Hint is one entry decoded from a hint file.
+type Hint struct {
+	Offset    int64
+	TimeStamp uint32
+	Flags     uint8
+	ValueSize uint32
+	ValuePos  uint64
+	Key       []byte
+}
+
+func (h *Hint) Size() int64 {
+	return int64(HintHeaderSize + len(h.Key))
+}
+
+func (h *Hint) IsTombstone() bool {
+	return h.Flags&FlagTombstone != 0
+}
+
+// RecordError reports where in a file decoding stopped.
+type RecordError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("offset %d: %v", e.Offset, e.Err)
+}
+
+// ReadRecords calls fn for every record of a data file of the given size, in
+// order. It stops with a *RecordError on a checksum mismatch or a record
+// running past the end of the file.
+func ReadRecords(r io.ReaderAt, size int64, fn func(rec *Record) error) error {
+	return ReadRecordsFrom(r, size, 0, fn)
+}
+
+// ReadRecordsFrom is ReadRecords starting at the record at offset.
+func ReadRecordsFrom(r io.ReaderAt, size, offset int64, fn func(rec *Record) error) error {
+	for offset < size {
+		rec, err := ReadRecordAt(r, size, offset)
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+		offset += rec.Size()
+	}
+	return nil
+}
+
+// ReadRecordAt decodes the record starting at offset.
+func ReadRecordAt(r io.ReaderAt, size, offset int64) (*Record, error) {
+	header := make([]byte, HeaderSize)
+	if offset+HeaderSize > size {
+		return nil, &RecordError{offset, io.ErrUnexpectedEOF}
+	}
+	if err := readAt(r, header, offset); err != nil {
+		return nil, &RecordError{offset, err}
+	}
+	crc32Sum, tStamp, keySize, valueSize, err := DecodeEntryHeader(header)
+	if err != nil {
+		return nil, &RecordError{offset, err}
+	}
+	if offset+HeaderSize+int64(keySize)+int64(valueSize) > size {
+		return nil, &RecordError{offset, io.ErrUnexpectedEOF}
+	}
+	kv := make([]byte, keySize+valueSize)
+	if err := readAt(r, kv, offset+HeaderSize); err != nil {
+		return nil, &RecordError{offset, err}
+	}
+	sum := crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, kv)
+	if sum != crc32Sum {
+		return nil, &RecordError{offset, CRC32Error}
+	}
+	return &Record{
+		Offset:    offset,
+		CRC32:     crc32Sum,
+		TimeStamp: tStamp,
+		Flags:     EntryFlags(header),
+		Key:       kv[:keySize],
+		Value:     kv[keySize:],
+	}, nil
+}
+
+// readAt fills p from offset. A read ending right at the end of r succeeds,
+// whether r reports io.EOF with it or not.
+func readAt(r io.ReaderAt, p []byte, offset int64) error {
+	n, err := r.ReadAt(p, offset)
+	if n == len(p) {
+		return nil
+	}
+	return err
+}
+
+// DecodeRecord reads the record starting at offset from a stream, such as
+// a data file sent by a replication leader. It returns io.EOF if r ends
+// before the record starts and a *RecordError if it ends within it.
+func DecodeRecord(r io.Reader, offset int64) (*Record, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, header); err == io.EOF {
+		return nil, err
+	} else if err != nil {
+		return nil, &RecordError{offset, err}
+	}
+	crc32Sum, tStamp, keySize, valueSize, err := DecodeEntryHeader(header)
+	if err != nil {
+		return nil, &RecordError{offset, err}
+	}
+	kv, err := ReadN(r, int64(keySize)+int64(valueSize))
+	if err != nil {
+		return nil, &RecordError{offset, err}
+	}
+	sum := crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, kv)
+	if sum != crc32Sum {
+		return nil, &RecordError{offset, CRC32Error}
+	}
+	return &Record{
+		Offset:    offset,
+		CRC32:     crc32Sum,
+		TimeStamp: tStamp,
+		Flags:     EntryFlags(header),
+		Key:       kv[:keySize],
+		Value:     kv[keySize:],
+	}, nil
+}
+
+// ReadN reads n bytes from r. The buffer grows with what arrives rather
+// than with n, which may come from a corrupt header.
+func ReadN(r io.Reader, n int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if m, err := io.CopyN(&buf, r, n); m < n {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadHints calls fn for every entry of a hint file of the given size, in
+// order. Old delete hints, which carry no key size, are skipped.
+func ReadHints(r io.ReaderAt, size int64, fn func(h *Hint) error) error {
+	header := make([]byte, HintHeaderSize)
+	offset := int64(0)
+	for offset < size {
+		if offset+HintHeaderSize > size {
+			return &RecordError{offset, io.ErrUnexpectedEOF}
+		}
+		if err := readAt(r, header, offset); err != nil {
+			return &RecordError{offset, err}
+		}
+		tStamp, keySize, valueSize, valuePos, err := DecodeHint(header)
+		if err != nil {
+			return &RecordError{offset, err}
+		}
+		flags := HintFlags(header)
+		if keySize+valueSize == 0 && flags == 0 {
+			offset += HintHeaderSize
+			continue
+		}
+		if offset+HintHeaderSize+int64(keySize) > size {
+			return &RecordError{offset, io.ErrUnexpectedEOF}
+		}
+		key := make([]byte, keySize)
+		if err := readAt(r, key, offset+HintHeaderSize); err != nil {
+			return &RecordError{offset, err}
+		}
+		h := &Hint{
+			Offset:    offset,
+			TimeStamp: tStamp,
+			Flags:     flags,
+			ValueSize: valueSize,
+			ValuePos:  valuePos,
+			Key:       key,
+		}
+		if err := fn(h); err != nil {
+			return err
+		}
+		offset += h.Size()
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+package Bitcask
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RebuildHints regenerates the hint file of every data file in dir from the
+// data itself. A data file that fails to decode gets hints for the records
+// before the damage, and the first such error is returned. fs is the one of
+// the operating system if nil.
+func RebuildHints(fs FileSystem, dir string) error {
+	if fs == nil {
+		fs = OSFS{}
+	}
+	dataFiles, err := listFiles(fs, dir, ".data")
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, name := range dataFiles {
+		err := rebuildHintFile(fs, dir+"/"+name, dir+"/"+strings.TrimSuffix(name, ".data")+".hint")
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func rebuildHintFile(fs FileSystem, dataPath, hintPath string) error {
+	fp, err := openRead(fs, dataPath)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	stat, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := hintPath + ".tmp"
+	hp, err := fs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	readErr := ReadRecords(fp, stat.Size(), func(rec *Record) error {
+		_, err := hp.Write(hintOf(rec))
+		return err
+	})
+	if _, ok := readErr.(*RecordError); readErr != nil && !ok {
+		hp.Close()
+		fs.Remove(tmp)
+		return readErr
+	}
+	if err := hp.Sync(); err != nil {
+		hp.Close()
+		return err
+	}
+	if err := hp.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmp, hintPath); err != nil {
+		return err
+	}
+	if readErr != nil {
+		return &os.PathError{Op: "rebuild hints", Path: dataPath, Err: readErr}
+	}
+	return nil
+}
+
+// hintOf returns the hint of a record.
+func hintOf(rec *Record) []byte {
+	flags := rec.Flags
+	if rec.IsTombstone() {
+		flags |= FlagTombstone
+	}
+	keySize := PackKeySize(flags, uint32(len(rec.Key)))
+	return EncodeHint(rec.TimeStamp, keySize, uint32(len(rec.Value)), rec.ValueOffset(), rec.Key)
+}
+
+// recoverDataFile cuts the data file fileID back to its last whole record
+// and rewrites its hints to match the records left. A crash can leave the
+// active file with a torn tail, or with hints of records that never reached
+// the disk, which only the data can tell.
+func recoverDataFile(fs FileSystem, dir string, fileID uint32) error {
+	name := dir + "/" + strconv.Itoa(int(fileID))
+	fp, err := fs.OpenFile(name+".data", os.O_CREATE|os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	stat, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	var hints []byte
+	end := int64(0)
+	err = ReadRecords(fp, stat.Size(), func(rec *Record) error {
+		hints = append(hints, hintOf(rec)...)
+		end = rec.Offset + rec.Size()
+		return nil
+	})
+	if _, ok := err.(*RecordError); err != nil && !ok {
+		return err
+	}
+	if end < stat.Size() {
+		log.Printf("Cut %s.data from %d to %d bytes: %v", name, stat.Size(), end, err)
+		if err := fp.Truncate(end); err != nil {
+			return err
+		}
+		if err := fp.Sync(); err != nil {
+			return err
+		}
+	}
+
+	hp, err := fs.OpenFile(name+".hint", os.O_CREATE|os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+	defer hp.Close()
+	old, err := ioutil.ReadAll(hp)
+	if err != nil || bytes.Equal(old, hints) {
+		return err
+	}
+	log.Printf("Rewrite %s.hint from its data", name)
+	if err := hp.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := hp.WriteAt(hints, 0); err != nil {
+		return err
+	}
+	return hp.Sync()
+}
+
+const QuarantineDir = "quarantine"
+
+// ByteRange is a half open range of file offsets.
+type ByteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+type RepairedFile struct {
+	Name        string      `json:"name"`
+	Salvaged    int         `json:"salvaged"`
+	Lost        []ByteRange `json:"lost"`
+	Quarantined string      `json:"quarantined,omitempty"`
+}
+
+// RepairReport lists the data files Repair had to rewrite.
+type RepairReport struct {
+	Dir       string          `json:"dir"`
+	Files     []*RepairedFile `json:"files"`
+	LostBytes int64           `json:"lost_bytes"`
+}
+
+// Repair salvages every readable record from damaged data files in dir. A
+// damaged file is rewritten with its valid records only and the original is
+// moved to the quarantine directory. Hint files are regenerated for every data
+// file afterwards. The store must not be open while Repair runs. fs is the
+// one of the operating system if nil.
+func Repair(fs FileSystem, dir string) (*RepairReport, error) {
+	if fs == nil {
+		fs = OSFS{}
+	}
+	dataFiles, err := listFiles(fs, dir, ".data")
+	if err != nil {
+		return nil, err
+	}
+	report := &RepairReport{Dir: dir, Files: []*RepairedFile{}}
+	for _, name := range dataFiles {
+		rf, err := repairDataFile(fs, dir, name)
+		if err != nil {
+			return nil, err
+		}
+		if rf == nil {
+			continue
+		}
+		for _, r := range rf.Lost {
+			report.LostBytes += r.End - r.Start
+		}
+		report.Files = append(report.Files, rf)
+	}
+	if err := RebuildHints(fs, dir); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// repairDataFile returns nil when the file needs no repair.
+func repairDataFile(fs FileSystem, dir, name string) (*RepairedFile, error) {
+	path := dir + "/" + name
+	fp, err := openRead(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	stat, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if ReadRecords(fp, stat.Size(), func(rec *Record) error { return nil }) == nil {
+		return nil, nil
+	}
+
+	rf := &RepairedFile{Name: name, Lost: []ByteRange{}}
+	tmp := path + ".repair.tmp"
+	out, err := fs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = SalvageRecords(fp, stat.Size(), func(rec *Record) error {
+		rf.Salvaged++
+		buf := make([]byte, rec.Size())
+		if _, err := fp.ReadAt(buf, rec.Offset); err != nil {
+			return err
+		}
+		_, err := out.Write(buf)
+		return err
+	}, func(start, end int64) {
+		rf.Lost = append(rf.Lost, ByteRange{start, end})
+	})
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fs.Remove(tmp)
+		return nil, err
+	}
+
+	if err := fs.MkdirAll(dir+"/"+QuarantineDir, 0755); err != nil {
+		return nil, err
+	}
+	suffix := "." + strconv.FormatInt(time.Now().Unix(), 10)
+	rf.Quarantined = QuarantineDir + "/" + name + suffix
+	if err := fs.Rename(path, dir+"/"+rf.Quarantined); err != nil {
+		return nil, err
+	}
+	hintName := strings.TrimSuffix(name, ".data") + ".hint"
+	if _, err := fs.Stat(dir + "/" + hintName); err == nil {
+		if err := fs.Rename(dir+"/"+hintName, dir+"/"+QuarantineDir+"/"+hintName+suffix); err != nil {
+			return nil, err
+		}
+	}
+	return rf, fs.Rename(tmp, path)
+}
+
+// SalvageRecords is ReadRecords for damaged files. Where a record fails to
+// decode it searches byte by byte for the next offset holding a plausible
+// header, and only there reads the record and checks its checksum. The bytes
+// skipped are reported to lost.
+func SalvageRecords(r io.ReaderAt, size int64, fn func(rec *Record) error, lost func(start, end int64)) error {
+	offset := int64(0)
+	badStart := int64(-1)
+	headers := &headerWindow{r: r, size: size}
+	for offset < size {
+		header, err := headers.at(offset)
+		var rec *Record
+		if err == nil {
+			if plausibleHeader(header, size-offset) {
+				rec, err = ReadRecordAt(r, size, offset)
+			} else {
+				err = &RecordError{offset, CRC32Error}
+			}
+		}
+		if _, ok := err.(*RecordError); ok {
+			if badStart < 0 {
+				badStart = offset
+			}
+			offset++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if badStart >= 0 {
+			lost(badStart, offset)
+			badStart = -1
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+		offset += rec.Size()
+	}
+	if badStart >= 0 {
+		lost(badStart, size)
+	}
+	return nil
+}
+
+const salvageWindow = 64 << 10
+
+// headerWindow reads the headers SalvageRecords tries through a window of
+// the file, so searching costs no read per byte.
+type headerWindow struct {
+	r     io.ReaderAt
+	size  int64
+	start int64
+	buf   []byte
+}
+
+func (w *headerWindow) at(offset int64) ([]byte, error) {
+	if offset+HeaderSize > w.size {
+		return nil, &RecordError{offset, io.ErrUnexpectedEOF}
+	}
+	if offset < w.start || offset+HeaderSize > w.start+int64(len(w.buf)) {
+		n := w.size - offset
+		if n > salvageWindow {
+			n = salvageWindow
+		}
+		if int64(cap(w.buf)) < n {
+			w.buf = make([]byte, n)
+		}
+		w.start, w.buf = offset, w.buf[:n]
+		if err := readAt(w.r, w.buf, offset); err != nil {
+			w.buf = w.buf[:0]
+			return nil, &RecordError{offset, err}
+		}
+	}
+	return w.buf[offset-w.start : offset-w.start+HeaderSize], nil
+}
+
+// plausibleHeader guards resynchronisation against reading records whose
+// header is garbage, and against those that only match their checksum by
+// accident. remaining is the size of the file from the header on.
+func plausibleHeader(header []byte, remaining int64) bool {
+	_, tStamp, keySize, valueSize, err := DecodeEntryHeader(header)
+	if err != nil {
+		return false
+	}
+	flags := EntryFlags(header)
+	if flags&^KnownFlags != 0 || tStamp == 0 {
+		return false
+	}
+	if HeaderSize+int64(keySize)+int64(valueSize) > remaining {
+		return false
+	}
+	return flags&FlagTombstone == 0 || valueSize == 0
+}
@@ -0,0 +1,102 @@
+package Bitcask
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+type countingReader struct {
+	r    io.ReaderAt
+	read int64
+}
+
+func (c *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.read += int64(n)
+	return n, err
+}
+
+func testRecord(key, value string) []byte {
+	return EncodeEntry(1, PackKeySize(0, uint32(len(key))), uint32(len(value)), []byte(key), []byte(value))
+}
+
+func TestSalvageRecords(t *testing.T) {
+	garbage := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(garbage)
+	var buf bytes.Buffer
+	buf.Write(testRecord("a", "1"))
+	buf.Write(garbage)
+	buf.Write(testRecord("b", "2"))
+	buf.Write(testRecord("c", "3"))
+	size := int64(buf.Len())
+
+	r := &countingReader{r: bytes.NewReader(buf.Bytes())}
+	var keys []string
+	var lost []ByteRange
+	err := SalvageRecords(r, size, func(rec *Record) error {
+		keys = append(keys, string(rec.Key))
+		return nil
+	}, func(start, end int64) {
+		lost = append(lost, ByteRange{start, end})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0] != "a" || keys[1] != "b" || keys[2] != "c" {
+		t.Fatalf("salvaged %q", keys)
+	}
+	first := int64(len(testRecord("a", "1")))
+	if len(lost) != 1 || lost[0] != (ByteRange{first, first + int64(len(garbage))}) {
+		t.Fatalf("lost %+v", lost)
+	}
+	// skipping garbage reads headers through a window, not records at every byte
+	if r.read > 3*size {
+		t.Fatalf("read %d bytes salvaging a file of %d", r.read, size)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	fs := NewMemFS()
+	opt := testOptions()
+	opt.FileSystem = fs
+	bc, err := Open("/db", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTest(t, bc, "a", "1", "b", "2", "c", "3")
+	bc.Close()
+
+	names, err := listFiles(fs, "/db", ".data")
+	if err != nil || len(names) != 1 {
+		t.Fatalf("data files %v, %v", names, err)
+	}
+	fp, err := fs.OpenFile("/db/"+names[0], os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// damage the value of "b"
+	if _, err := fp.WriteAt([]byte{'x'}, 2*HeaderSize+3); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	report, err := Repair(fs, "/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Files) != 1 || report.Files[0].Salvaged != 2 || report.LostBytes != HeaderSize+2 {
+		t.Fatalf("repair report %+v", report.Files[0])
+	}
+	if _, err := fs.Stat("/db/" + report.Files[0].Quarantined); err != nil {
+		t.Fatalf("quarantined file: %v", err)
+	}
+	bc, err = Open("/db", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	checkStore(t, bc, map[string]string{"a": "1", "c": "3"})
+}
@@ -0,0 +1,345 @@
+package Bitcask
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+var DataFileNotFoundErr = fmt.Errorf("Data file not found ")
+
+// FileState is the size of one data file of a replication leader.
+type FileState struct {
+	ID   uint32 `json:"id"`
+	Size int64  `json:"size"`
+}
+
+// ReplicaState is what a follower needs to know to catch up with a leader:
+// its data files, the last one being the active one, and how much history
+// merge has removed, see ChangesSince.
+type ReplicaState struct {
+	Files     []FileState `json:"files"`
+	Discarded uint64      `json:"discarded,string"`
+}
+
+// OpenReplica opens dir as a follower of another store. Writes fail with
+// ReadOnlyErr; the files only change through ApplyReplica and PruneReplica.
+func OpenReplica(dir string, opt *Options) (*BitCask, error) {
+	return open(dir, opt, true)
+}
+
+func (c *BitCask) ReadOnly() bool {
+	return c.readOnly
+}
+
+// ReplicaState returns the data files of the store as a leader.
+func (c *BitCask) ReplicaState() (*ReplicaState, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	dataFiles, err := ListDataFiles(c)
+	if err != nil {
+		return nil, err
+	}
+	state := &ReplicaState{Files: []FileState{}, Discarded: c.discarded}
+	for _, name := range dataFiles {
+		fileID := FileIDOf(name)
+		if fileID > c.writeFile.fileID {
+			continue
+		}
+		size := int64(c.writeFile.offset)
+		if fileID != c.writeFile.fileID {
+			stat, err := c.fs.Stat(c.dir + "/" + name)
+			if err != nil {
+				return nil, err
+			}
+			size = stat.Size()
+		}
+		state.Files = append(state.Files, FileState{ID: fileID, Size: size})
+	}
+	return state, nil
+}
+
+// CopyDataFile writes the data file fileID from offset up to its current
+// end to w. The active file is cut at the last committed record, so w
+// always gets whole records and whole batches.
+func (c *BitCask) CopyDataFile(w io.Writer, fileID uint32, offset int64) (int64, error) {
+	fp, size, err := c.openDataFile(fileID)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	if offset > size {
+		return 0, fmt.Errorf("Offset %d is past the end of %d.data ", offset, fileID)
+	}
+	return io.Copy(w, io.NewSectionReader(fp, offset, size-offset))
+}
+
+// WaitDataFile waits up to timeout for the data file fileID to grow past
+// offset, and returns whether it did. It returns at once for files that
+// are no longer active.
+func (c *BitCask) WaitDataFile(fileID uint32, offset int64, timeout time.Duration) bool {
+	w := c.watchAll(1)
+	defer w.Close()
+
+	c.lock.RLock()
+	grown := c.writeFile.fileID != fileID || int64(c.writeFile.offset) > offset
+	c.lock.RUnlock()
+	if grown {
+		return true
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-w.C:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func (c *BitCask) openDataFile(fileID uint32) (File, int64, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	fp, err := openRead(c.fs, c.dir+"/"+strconv.Itoa(int(fileID))+".data")
+	if os.IsNotExist(err) {
+		return nil, 0, DataFileNotFoundErr
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if fileID == c.writeFile.fileID {
+		return fp, int64(c.writeFile.offset), nil
+	}
+	stat, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, 0, err
+	}
+	return fp, stat.Size(), nil
+}
+
+// ReplicaOffset returns how much of the leader's data file fileID the
+// replica already has, the offset to resume copying it from.
+func (c *BitCask) ReplicaOffset(fileID uint32) int64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if fileID == c.writeFile.fileID {
+		return int64(c.writeFile.offset)
+	}
+	stat, err := c.fs.Stat(c.dir + "/" + strconv.Itoa(int(fileID)) + ".data")
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
+
+// ApplyReplica appends the records read from r, the leader's data file
+// fileID from ReplicaOffset on, to the replica and loads them into its
+// keydir. A batch is only written once it is complete, so a copy cut short
+// can be resumed from ReplicaOffset. sealed says the leader has moved on to
+// a newer file, so an unfinished batch at the end will never complete: it
+// is written like the leader has it but not loaded.
+func (c *BitCask) ApplyReplica(fileID uint32, r io.Reader, sealed bool) (int64, error) {
+	if !c.readOnly {
+		return 0, fmt.Errorf("Store is not a replica ")
+	}
+	if err := c.switchReplicaFile(fileID); err != nil {
+		return 0, err
+	}
+	offset := c.ReplicaOffset(fileID)
+	br := bufio.NewReader(r)
+	applied := int64(0)
+	var pending []*Record
+	for {
+		rec, err := DecodeRecord(br, offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return applied, err
+		}
+		offset += rec.Size()
+		pending = append(pending, rec)
+		if rec.Flags&FlagBatch != 0 {
+			continue
+		}
+		if err := c.appendReplica(fileID, pending, true); err != nil {
+			return applied, err
+		}
+		for _, rec := range pending {
+			applied += rec.Size()
+		}
+		pending = nil
+	}
+	if sealed && len(pending) > 0 {
+		if err := c.appendReplica(fileID, pending, false); err != nil {
+			return applied, err
+		}
+		for _, rec := range pending {
+			applied += rec.Size()
+		}
+	}
+	return applied, nil
+}
+
+// switchReplicaFile makes fileID the file ApplyReplica appends to. The
+// leader only ever appends to its newest file, so neither does a replica.
+func (c *BitCask) switchReplicaFile(fileID uint32) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if fileID == c.writeFile.fileID {
+		return nil
+	}
+	if fileID < c.writeFile.fileID && c.writeFile.offset > 0 {
+		return fmt.Errorf("Replica is at %d.data, can't go back to %d.data ", c.writeFile.fileID, fileID)
+	}
+	file, _, err := SetWriteableFile(c.fs, fileID, c.dir)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	hintFile, err := SetHintFile(c.fs, fileID, c.dir)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	c.writeFile.file.Close()
+	c.writeFile.hintFile.Close()
+	c.writeFile = &DBFile{
+		file:     file,
+		fileID:   fileID,
+		offset:   uint64(stat.Size()),
+		hintFile: hintFile,
+		metrics:  c.metrics,
+		seal:     c.seal,
+	}
+	WritePID(c.lockFile, fileID)
+	return nil
+}
+
+// appendReplica writes records at the end of the active file and, if load
+// is set, loads them into the keydir and reports them to watchers.
+func (c *BitCask) appendReplica(fileID uint32, records []*Record, load bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.writeFile.fileID != fileID {
+		return fmt.Errorf("Replica switched away from %d.data ", fileID)
+	}
+	// decrypt first, a replica that can't read a record must not write it
+	plain := make([]*Record, len(records))
+	for i, rec := range records {
+		p, err := c.seal.plain(rec)
+		if err != nil {
+			return err
+		}
+		plain[i] = p
+	}
+	entries := make([]Entry, len(records))
+	for i, rec := range records {
+		if uint64(rec.Offset) != c.writeFile.offset {
+			return fmt.Errorf("Replica of %d.data is at offset %d, not %d ", fileID, c.writeFile.offset, rec.Offset)
+		}
+		e, err := c.writeFile.writeRecord(rec.TimeStamp, rec.Key, rec.Value, rec.Flags)
+		if err != nil {
+			return err
+		}
+		entries[i] = e
+	}
+	if !load {
+		return nil
+	}
+	for i, rec := range plain {
+		if len(rec.Key) == 0 {
+			continue
+		}
+		t := EventPut
+		if rec.IsTombstone() {
+			t = EventDel
+			c.load(rec.Key, rec.Flags, nil)
+		} else {
+			c.load(rec.Key, rec.Flags, &entries[i])
+		}
+		if rec.Flags&FlagBucket != 0 {
+			c.publishBucket(t, rec.Key, &entries[i])
+			continue
+		}
+		e, err := eventOf(c.seal, fileID, rec)
+		if err == nil && e != nil {
+			c.watch.publish(e)
+		}
+	}
+	return nil
+}
+
+// PruneReplica removes the data files the leader no longer has once merge
+// copied what was left of them into newer files. It must only be called
+// after every file of state was applied up to its size, so the replica has
+// those copies too; keys still found in a removed file were deleted by a
+// record merge dropped before the replica saw it. A non empty file the
+// leader never had means the replica was not started from an empty
+// directory or follows another leader.
+func (c *BitCask) PruneReplica(state *ReplicaState) error {
+	if len(state.Files) == 0 {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	leader := make(map[uint32]bool)
+	for _, f := range state.Files {
+		leader[f.ID] = true
+	}
+	oldest := state.Files[0].ID
+	dataFiles, err := ListDataFiles(c)
+	if err != nil {
+		return err
+	}
+	for _, name := range dataFiles {
+		fileID := FileIDOf(name)
+		if leader[fileID] || fileID == c.writeFile.fileID {
+			continue
+		}
+		stat, err := c.fs.Stat(c.dir + "/" + name)
+		if err != nil {
+			return err
+		}
+		if fileID > oldest && stat.Size() > 0 {
+			return fmt.Errorf("Replica has %s, which the leader does not ", name)
+		}
+		if n := c.keyDirs.DelWithFileID(fileID) + c.buckets.delWithFileID(fileID); n > 0 {
+			log.Printf("Drop %d keys deleted in merged files", n)
+		}
+		if err := c.oldFiles.DelWithFileID(fileID); err != nil {
+			return err
+		}
+		c.metrics.forget(fileID)
+		if err := c.fs.Remove(c.dir + "/" + name); err != nil {
+			return err
+		}
+		hintName := c.dir + "/" + strconv.Itoa(int(fileID)) + ".hint"
+		if err := c.fs.Remove(hintName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if state.Discarded > c.discarded {
+		if err := writeHistoryFloor(c.fs, c.dir, state.Discarded); err != nil {
+			return err
+		}
+		c.discarded = state.Discarded
+	}
+	return nil
+}
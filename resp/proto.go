@@ -0,0 +1,112 @@
+package main
+
+import (
+	"Bitcask"
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// RESP2, see https://redis.io/docs/reference/protocol-spec/
+const (
+	maxBulkSize  = 512 << 20
+	maxArraySize = 1 << 20
+	maxInline    = 64 << 10
+)
+
+// protoError is a malformed request. The connection is closed after
+// replying with it, as the rest of the stream can't be trusted.
+type protoError string
+
+func (e protoError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// reader buffers maxInline bytes, the longest line it accepts.
+type reader struct {
+	br *bufio.Reader
+}
+
+// readCommand returns the arguments of the next command, sent either as an
+// array of bulk strings, as clients do, or inline as space separated words,
+// as typed into telnet.
+func (r *reader) readCommand() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		// line is only valid until the next read
+		return bytes.Fields(append([]byte{}, line...)), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArraySize {
+		return nil, protoError("invalid multibulk length")
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protoError(fmt.Sprintf("expected '$', got '%.1s'", line))
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, protoError("invalid bulk length")
+		}
+		// grown as the bytes arrive, not up front for a size a client claims
+		buf, err := Bitcask.ReadN(r.br, int64(size)+2)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(buf, []byte("\r\n")) {
+			return nil, protoError("bulk string not terminated by CRLF")
+		}
+		args = append(args, buf[:size])
+	}
+	return args, nil
+}
+
+func (r *reader) readLine() ([]byte, error) {
+	line, err := r.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, protoError("too big inline request")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+type writer struct {
+	bw *bufio.Writer
+}
+
+func (w *writer) simple(s string) {
+	w.bw.WriteString("+" + s + "\r\n")
+}
+
+func (w *writer) error(s string) {
+	w.bw.WriteString("-" + s + "\r\n")
+}
+
+func (w *writer) integer(n int64) {
+	w.bw.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *writer) bulk(b []byte) {
+	if b == nil {
+		w.bw.WriteString("$-1\r\n")
+		return
+	}
+	w.bw.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.bw.Write(b)
+	w.bw.WriteString("\r\n")
+}
+
+func (w *writer) array(n int) {
+	w.bw.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readAll(input string) ([][][]byte, error) {
+	r := &reader{br: bufio.NewReaderSize(strings.NewReader(input), maxInline)}
+	var cmds [][][]byte
+	for {
+		args, err := r.readCommand()
+		if err != nil {
+			return cmds, err
+		}
+		cmds = append(cmds, args)
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	cmds, err := readAll("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\na\r\nb\r\r\n" +
+		"GET  k\r\n" +
+		"\r\n" +
+		"*1\r\n$0\r\n\r\n")
+	if err != io.EOF {
+		t.Fatalf("read: %v", err)
+	}
+	want := [][][]byte{
+		{[]byte("SET"), []byte("k"), []byte("a\r\nb\r")},
+		{[]byte("GET"), []byte("k")},
+		{},
+		{{}},
+	}
+	if !reflect.DeepEqual(cmds, want) {
+		t.Fatalf("read %q, want %q", cmds, want)
+	}
+}
+
+func TestReadCommandErrors(t *testing.T) {
+	for _, c := range []struct {
+		input string
+		err   error
+	}{
+		{"*x\r\n", protoError("invalid multibulk length")},
+		{"*2\r\n$3\r\nGET\r\n:1\r\n", protoError("expected '$', got ':'")},
+		{"*1\r\n$-1\r\n", protoError("invalid bulk length")},
+		{"*1\r\n$1000000000\r\n", protoError("invalid bulk length")},
+		{"*1\r\n$3\r\nGETxx", protoError("bulk string not terminated by CRLF")},
+		// the bytes a client claims don't all arrive
+		{"*1\r\n$100\r\nGET\r\n", io.ErrUnexpectedEOF},
+		{"*2\r\n$3\r\nGET\r\n", io.EOF},
+		{strings.Repeat("x", maxInline+1) + "\r\n", protoError("too big inline request")},
+	} {
+		if _, err := readAll(c.input); err != c.err {
+			t.Errorf("read %.32q: %v, want %v", c.input, err, c.err)
+		}
+	}
+}
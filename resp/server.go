@@ -0,0 +1,537 @@
+package main
+
+import (
+	"Bitcask"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultScanCount = 10
+
+type command struct {
+	// arity counts the command name, a negative one is a minimum
+	arity int
+	run   func(s *server, w *writer, args [][]byte)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":    {-1, ping},
+		"echo":    {2, echo},
+		"quit":    {1, nil},
+		"select":  {2, selectDB},
+		"command": {-1, commandInfo},
+		"get":     {2, get},
+		"set":     {-3, set},
+		"del":     {-2, del},
+		"exists":  {-2, exists},
+		"mget":    {-2, mget},
+		"mset":    {-3, mset},
+		"incr":    {2, incr},
+		"scan":    {-2, scan},
+		"ttl":     {2, ttl},
+		"expire":  {3, expire},
+		"dbsize":  {1, dbsize},
+		"info":    {-1, info},
+	}
+}
+
+type server struct {
+	bc      *Bitcask.BitCask
+	addr    string
+	started time.Time
+	clients int64
+	cursors *scanCursors
+
+	lock  *sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func newServer(bc *Bitcask.BitCask, addr string) *server {
+	return &server{
+		bc:      bc,
+		addr:    addr,
+		started: time.Now(),
+		cursors: newScanCursors(),
+		lock:    &sync.Mutex{},
+		conns:   make(map[net.Conn]bool),
+	}
+}
+
+func (s *server) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s.lock.Lock()
+		s.conns[conn] = true
+		s.lock.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// closeConns ends every connection.
+func (s *server) closeConns() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *server) handle(conn net.Conn) {
+	atomic.AddInt64(&s.clients, 1)
+	defer func() {
+		atomic.AddInt64(&s.clients, -1)
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	r := &reader{br: bufio.NewReaderSize(conn, maxInline)}
+	w := &writer{bw: bufio.NewWriter(conn)}
+	for {
+		args, err := r.readCommand()
+		if perr, ok := err.(protoError); ok {
+			w.error("ERR " + perr.Error())
+			w.bw.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Println(conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToLower(string(args[0]))
+		c, ok := commands[name]
+		switch {
+		case !ok:
+			w.error(fmt.Sprintf("ERR unknown command '%.128s'", args[0]))
+		case c.arity > 0 && len(args) != c.arity || c.arity < 0 && len(args) < -c.arity:
+			w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		case name == "quit":
+			w.simple("OK")
+			w.bw.Flush()
+			return
+		default:
+			c.run(s, w, args)
+		}
+		// answer pipelined commands together
+		if r.br.Buffered() == 0 {
+			if err := w.bw.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// storeError replies with the Redis error matching err.
+func storeError(w *writer, err error) {
+	switch err {
+	case Bitcask.ReadOnlyErr:
+		w.error("READONLY You can't write against a read only replica.")
+	case Bitcask.NotIntegerErr:
+		w.error("ERR value is not an integer or out of range")
+	case Bitcask.OverflowErr:
+		w.error("ERR increment or decrement would overflow")
+	default:
+		w.error("ERR " + strings.TrimSpace(err.Error()))
+	}
+}
+
+func ping(s *server, w *writer, args [][]byte) {
+	switch len(args) {
+	case 1:
+		w.simple("PONG")
+	case 2:
+		w.bulk(args[1])
+	default:
+		w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func echo(s *server, w *writer, args [][]byte) {
+	w.bulk(args[1])
+}
+
+// selectDB accepts the only database there is, so clients configured
+// with db 0 can connect.
+func selectDB(s *server, w *writer, args [][]byte) {
+	if string(args[1]) != "0" {
+		w.error("ERR DB index is out of range")
+		return
+	}
+	w.simple("OK")
+}
+
+// commandInfo answers COMMAND, which redis-cli sends on start, with an
+// empty list.
+func commandInfo(s *server, w *writer, args [][]byte) {
+	w.array(0)
+}
+
+func get(s *server, w *writer, args [][]byte) {
+	value, err := s.bc.Get(args[1])
+	if err == Bitcask.KeyNotFoundErr {
+		w.bulk(nil)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	w.bulk(value)
+}
+
+// set supports SET key value [EX seconds|PX milliseconds] [NX|XX].
+func set(s *server, w *writer, args [][]byte) {
+	meta := &Bitcask.Meta{}
+	cond := Bitcask.PutAlways
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToLower(string(args[i]))
+		switch {
+		case (opt == "ex" || opt == "px") && i+1 < len(args) && meta.ExpiresAt.IsZero():
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			unit := time.Second
+			if opt == "px" {
+				unit = time.Millisecond
+			}
+			at, ok := expireAt(n, unit)
+			if err != nil || n <= 0 || !ok {
+				w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			meta.ExpiresAt = at
+			i++
+		case opt == "nx" && cond == Bitcask.PutAlways:
+			cond = Bitcask.PutIfAbsent
+		case opt == "xx" && cond == Bitcask.PutAlways:
+			cond = Bitcask.PutIfExists
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+	ok, err := s.bc.PutIf(args[1], args[2], meta, cond)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if !ok {
+		w.bulk(nil)
+		return
+	}
+	w.simple("OK")
+}
+
+func del(s *server, w *writer, args [][]byte) {
+	n := int64(0)
+	for _, key := range args[1:] {
+		err := s.bc.Del(key)
+		if err == Bitcask.KeyNotFoundErr {
+			continue
+		}
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		n++
+	}
+	w.integer(n)
+}
+
+func exists(s *server, w *writer, args [][]byte) {
+	n := int64(0)
+	for _, key := range args[1:] {
+		_, err := s.bc.Get(key)
+		if err == Bitcask.KeyNotFoundErr {
+			continue
+		}
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		n++
+	}
+	w.integer(n)
+}
+
+func mget(s *server, w *writer, args [][]byte) {
+	values, err := s.bc.MGet(args[1:])
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	w.array(len(values))
+	for _, value := range values {
+		w.bulk(value)
+	}
+}
+
+// mset writes every pair in one batch, so it is atomic as in Redis.
+func mset(s *server, w *writer, args [][]byte) {
+	if len(args)%2 != 1 {
+		w.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	b := Bitcask.NewBatch()
+	for i := 1; i < len(args); i += 2 {
+		b.Put(args[i], args[i+1])
+	}
+	if err := s.bc.Write(b); err != nil {
+		storeError(w, err)
+		return
+	}
+	w.simple("OK")
+}
+
+func incr(s *server, w *writer, args [][]byte) {
+	n, err := s.bc.Incr(args[1], 1)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	w.integer(n)
+}
+
+// scan supports SCAN cursor [MATCH pattern] [COUNT count]. Keys are walked
+// in sorted order and a cursor stands for the last key returned, so as in
+// Redis a key present during the whole scan is returned even if other keys
+// are added or deleted meanwhile. Each call seeks to its cursor rather than
+// walking every key.
+func scan(s *server, w *writer, args [][]byte) {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		w.error("ERR invalid cursor")
+		return
+	}
+	var pattern []byte
+	count := defaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				w.error("ERR syntax error")
+				return
+			}
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	var start []byte
+	if cursor != 0 {
+		last, ok := s.cursors.get(cursor)
+		if !ok {
+			w.error("ERR invalid cursor")
+			return
+		}
+		start = append(last[:len(last):len(last)], 0)
+	}
+	candidates := s.bc.ListKeys(literalPrefix(pattern), start, count+1)
+	next := uint64(0)
+	if len(candidates) > count {
+		candidates = candidates[:count]
+		next = s.cursors.add(candidates[count-1])
+	}
+	var keys [][]byte
+	for _, key := range candidates {
+		if pattern != nil && !match(pattern, key) {
+			continue
+		}
+		if _, err := s.bc.Get(key); err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	w.array(2)
+	w.bulk([]byte(strconv.FormatUint(next, 10)))
+	w.array(len(keys))
+	for _, key := range keys {
+		w.bulk(key)
+	}
+}
+
+// maxScanCursors is how many cursors a server remembers. SCAN fails with
+// an older one.
+const maxScanCursors = 4096
+
+// scanCursors maps the cursors SCAN returned, numbers as clients expect, to
+// the last key each call returned.
+type scanCursors struct {
+	lock  *sync.Mutex
+	last  uint64
+	keys  map[uint64][]byte
+	order []uint64
+}
+
+func newScanCursors() *scanCursors {
+	return &scanCursors{lock: &sync.Mutex{}, keys: make(map[uint64][]byte)}
+}
+
+func (c *scanCursors) add(key []byte) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.last++
+	c.keys[c.last] = key
+	c.order = append(c.order, c.last)
+	if len(c.order) > maxScanCursors {
+		delete(c.keys, c.order[0])
+		c.order = c.order[1:]
+	}
+	return c.last
+}
+
+func (c *scanCursors) get(cursor uint64) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key, ok := c.keys[cursor]
+	return key, ok
+}
+
+// ttl replies -2 for a missing key, -1 for a key that never expires and
+// the seconds left otherwise.
+func ttl(s *server, w *writer, args [][]byte) {
+	_, meta, err := s.bc.GetWithMeta(args[1])
+	if err == Bitcask.KeyNotFoundErr {
+		w.integer(-2)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	if meta.ExpiresAt.IsZero() {
+		w.integer(-1)
+		return
+	}
+	left := time.Until(meta.ExpiresAt) + time.Second/2
+	w.integer(int64(left / time.Second))
+}
+
+func expire(s *server, w *writer, args [][]byte) {
+	n, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		w.error("ERR value is not an integer or out of range")
+		return
+	}
+	// a past time deletes the key, as in Redis
+	at := time.Unix(0, 0)
+	if n > 0 {
+		var ok bool
+		if at, ok = expireAt(n, time.Second); !ok {
+			w.error("ERR invalid expire time in 'expire' command")
+			return
+		}
+	}
+	err = s.bc.Expire(args[1], at)
+	if err == Bitcask.KeyNotFoundErr {
+		w.integer(0)
+		return
+	}
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	w.integer(1)
+}
+
+// expireAt returns the time n units from now, false if it is too far off
+// for a time.Duration or for Meta to hold.
+func expireAt(n int64, unit time.Duration) (time.Time, bool) {
+	if n > math.MaxInt64/int64(unit) {
+		return time.Time{}, false
+	}
+	at := time.Now().Add(time.Duration(n) * unit)
+	if at.After(maxExpireAt) {
+		return time.Time{}, false
+	}
+	return at, true
+}
+
+// maxExpireAt is the latest expiry Meta holds, in unix nanoseconds.
+var maxExpireAt = time.Unix(0, math.MaxInt64)
+
+// dbsize counts expired keys merge has not dropped yet.
+func dbsize(s *server, w *writer, args [][]byte) {
+	w.integer(int64(s.bc.Len()))
+}
+
+func info(s *server, w *writer, args [][]byte) {
+	section := "default"
+	if len(args) > 1 {
+		section = strings.ToLower(string(args[1]))
+	}
+	role := "master"
+	if s.bc.ReadOnly() {
+		role = "slave"
+	}
+	_, port, _ := net.SplitHostPort(s.addr)
+	sections := []struct {
+		name  string
+		lines []string
+	}{
+		{"server", []string{
+			"redis_mode:standalone",
+			"process_id:" + strconv.Itoa(os.Getpid()),
+			"tcp_port:" + port,
+			"uptime_in_seconds:" + strconv.Itoa(int(time.Since(s.started)/time.Second)),
+		}},
+		{"clients", []string{
+			"connected_clients:" + strconv.FormatInt(atomic.LoadInt64(&s.clients), 10),
+		}},
+		{"replication", []string{
+			"role:" + role,
+		}},
+		{"keyspace", []string{
+			fmt.Sprintf("db0:keys=%d,expires=0,avg_ttl=0", s.bc.Len()),
+		}},
+	}
+	var buf bytes.Buffer
+	for _, sec := range sections {
+		if section != "default" && section != "all" && section != "everything" && section != sec.name {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString("# " + strings.Title(sec.name) + "\r\n")
+		for _, line := range sec.lines {
+			buf.WriteString(line + "\r\n")
+		}
+	}
+	w.bulk(buf.Bytes())
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"Bitcask"
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// client speaks RESP to a server over an in-memory connection.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func newClient(t *testing.T) (*client, *Bitcask.BitCask) {
+	t.Helper()
+	bc, err := Bitcask.Open(t.TempDir(), Bitcask.NewOptions(0, 0, -1, 0, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(bc, "127.0.0.1:6379")
+	conn, peer := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		s.handle(peer)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+		bc.Close()
+	})
+	return &client{t: t, conn: conn, br: bufio.NewReader(conn)}, bc
+}
+
+// do sends args and returns the reply: a string for a simple string, a bulk
+// string or an integer, "-" and the message for an error, nil for a nil bulk
+// string and a []interface{} for an array.
+func (c *client) do(args ...string) interface{} {
+	c.t.Helper()
+	req := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, a := range args {
+		req += "$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n"
+	}
+	go c.conn.Write([]byte(req))
+	reply, err := c.read()
+	if err != nil {
+		c.t.Fatalf("%q: %v", args, err)
+	}
+	return reply
+}
+
+func (c *client) read() (interface{}, error) {
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return line, nil
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.br, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+func (c *client) expect(want interface{}, args ...string) {
+	c.t.Helper()
+	if got := c.do(args...); !reflect.DeepEqual(got, want) {
+		c.t.Fatalf("%q replied %#v, want %#v", args, got, want)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	c, _ := newClient(t)
+	c.expect("PONG", "PING")
+	c.expect("OK", "SET", "a", "1")
+	c.expect("1", "GET", "a")
+	c.expect(nil, "GET", "missing")
+	c.expect(nil, "SET", "a", "2", "NX")
+	c.expect("OK", "SET", "a", "2", "XX")
+	c.expect("3", "INCR", "a")
+	c.expect("OK", "MSET", "b", "x", "c", "y")
+	c.expect([]interface{}{"3", "x", nil}, "MGET", "a", "b", "missing")
+	c.expect("-ERR value is not an integer or out of range", "INCR", "b")
+	c.expect("2", "EXISTS", "a", "b", "missing")
+	c.expect("1", "DEL", "b", "missing")
+	c.expect("2", "DBSIZE")
+	if info := c.do("INFO", "keyspace"); info != "# Keyspace\r\ndb0:keys=2,expires=0,avg_ttl=0\r\n" {
+		t.Fatalf("info keyspace %q", info)
+	}
+	c.expect("-ERR wrong number of arguments for 'get' command", "GET")
+	c.expect("-ERR unknown command 'NOPE'", "NOPE")
+}
+
+func TestExpireTime(t *testing.T) {
+	c, _ := newClient(t)
+	c.expect("-2", "TTL", "k")
+	c.expect("OK", "SET", "k", "v")
+	c.expect("-1", "TTL", "k")
+	c.expect("OK", "SET", "k", "v", "EX", "100")
+	c.expect("100", "TTL", "k")
+	c.expect("1", "EXPIRE", "k", "200")
+	c.expect("200", "TTL", "k")
+
+	// too far off for a time.Duration, or past what Meta holds
+	for _, args := range [][]string{
+		{"SET", "k", "v", "EX", "9223372036854775807"},
+		{"SET", "k", "v", "PX", "9223372036854775807"},
+		{"SET", "k", "v", "EX", "9223372036"},
+		{"SET", "k", "v", "EX", "0"},
+		{"SET", "k", "v", "PX", "-1"},
+	} {
+		c.expect("-ERR invalid expire time in 'set' command", args...)
+	}
+	c.expect("-ERR invalid expire time in 'expire' command", "EXPIRE", "k", "9223372036854775807")
+	c.expect("-ERR value is not an integer or out of range", "EXPIRE", "k", "x")
+	c.expect("200", "TTL", "k")
+
+	// a past time deletes the key
+	c.expect("1", "EXPIRE", "k", "-1")
+	c.expect(nil, "GET", "k")
+	c.expect("0", "EXPIRE", "k", "10")
+}
+
+// scanAll pages through SCAN with args, calling between after each page.
+func scanAll(c *client, args []string, between func()) []string {
+	c.t.Helper()
+	var keys []string
+	cursor := "0"
+	for pages := 0; ; pages++ {
+		if pages > 1000 {
+			c.t.Fatal("scan does not end")
+		}
+		reply, ok := c.do(append([]string{"SCAN", cursor}, args...)...).([]interface{})
+		if !ok || len(reply) != 2 {
+			c.t.Fatalf("scan replied %#v", reply)
+		}
+		for _, k := range reply[1].([]interface{}) {
+			keys = append(keys, k.(string))
+		}
+		if cursor = reply[0].(string); cursor == "0" {
+			return keys
+		}
+		between()
+	}
+}
+
+func TestScan(t *testing.T) {
+	c, bc := newClient(t)
+	var want []string
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("key%03d", i)
+		c.expect("OK", "SET", k, "v")
+		c.expect("OK", "SET", fmt.Sprintf("other%03d", i), "v")
+		want = append(want, k)
+	}
+	got := scanAll(c, []string{"MATCH", "key*", "COUNT", "7"}, func() {})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("scan returned %q", got)
+	}
+
+	// keys present during the whole scan are returned once, whatever
+	// changes meanwhile
+	page := 0
+	got = scanAll(c, []string{"COUNT", "13"}, func() {
+		page++
+		putTest(t, bc, fmt.Sprintf("key%03d-%d", page*7, page), "new")
+		c.expect("1", "DEL", fmt.Sprintf("key%03d", 100-page))
+	})
+	seen := make(map[string]int)
+	for _, k := range got {
+		seen[k]++
+	}
+	for i := 0; i < 100-page; i++ {
+		for _, k := range []string{fmt.Sprintf("key%03d", i), fmt.Sprintf("other%03d", i)} {
+			if seen[k] != 1 {
+				t.Fatalf("scan returned %s %d times", k, seen[k])
+			}
+		}
+	}
+	if !sort.StringsAreSorted(got) {
+		t.Fatalf("scan returned %q out of order", got)
+	}
+
+	got = scanAll(c, []string{"MATCH", "o*5", "COUNT", "50"}, func() {})
+	if len(got) != 10 {
+		t.Fatalf("scan matching o*5 returned %q", got)
+	}
+	c.expect("-ERR invalid cursor", "SCAN", "12345")
+	c.expect("-ERR invalid cursor", "SCAN", "x")
+	c.expect("-ERR syntax error", "SCAN", "0", "COUNT", "0")
+}
+
+func putTest(t *testing.T, bc *Bitcask.BitCask, key, value string) {
+	t.Helper()
+	if err := bc.Put([]byte(key), []byte(value)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,162 @@
+package Bitcask
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// keydirEntrySize estimates the memory a keydir entry takes besides its
+// key: the Entry, the map slot and the string header.
+const keydirEntrySize = 64
+
+// Stats is a snapshot of the state of a store and of the operations done
+// since it was opened.
+type Stats struct {
+	Keys      int `json:"keys"`
+	DataFiles int `json:"data_files"`
+	// DataBytes is the size of the data files, LiveBytes the part of it
+	// holding the current record of a key and DeadBytes what merge frees.
+	DataBytes int64       `json:"data_bytes"`
+	LiveBytes int64       `json:"live_bytes"`
+	DeadBytes int64       `json:"dead_bytes"`
+	Files     []FileStats `json:"files"`
+
+	ActiveFileID uint32 `json:"active_file_id"`
+	ActiveOffset uint64 `json:"active_offset"`
+	// KeydirBytes estimates the memory the keydir takes.
+	KeydirBytes int64 `json:"keydir_bytes"`
+	// OpenFiles counts the file handles the store holds.
+	OpenFiles int `json:"open_files"`
+
+	BytesWritten uint64 `json:"bytes_written"`
+	BytesRead    uint64 `json:"bytes_read"`
+	Rotations    uint64 `json:"rotations"`
+
+	Put Histogram `json:"put"`
+	Get Histogram `json:"get"`
+	Del Histogram `json:"del"`
+	// Merge is the duration of merge runs, MergeErrors counts failed ones
+	Merge       Histogram    `json:"merge"`
+	MergeErrors uint64       `json:"merge_errors"`
+	LastMerge   *MergeResult `json:"last_merge,omitempty"`
+
+	// Buckets describes every bucket; Keys counts their keys too, but not
+	// the entries of indexes.
+	Buckets []BucketStats `json:"buckets"`
+}
+
+// FileStats describes one data file. Records counts every record in it,
+// live or not. File IDs are taken from the time the file is created.
+type FileStats struct {
+	ID        uint32    `json:"id"`
+	Size      int64     `json:"size"`
+	LiveBytes int64     `json:"live_bytes"`
+	LiveRatio float64   `json:"live_ratio"`
+	Records   int64     `json:"records"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MergeResult is the outcome of a merge run. Files and RemovedBytes count
+// the data files it removed.
+type MergeResult struct {
+	StartedAt    time.Time `json:"started_at"`
+	Seconds      float64   `json:"seconds"`
+	Files        int       `json:"files"`
+	RemovedBytes int64     `json:"removed_bytes"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Stats returns the current Stats of the store.
+func (c *BitCask) Stats() (*Stats, error) {
+	dataFiles, err := ListDataFiles(c)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.RLock()
+	activeID, activeOffset := c.writeFile.fileID, c.writeFile.offset
+	c.lock.RUnlock()
+
+	dirs := c.keyDirList()
+	keys, keyBytes, liveBytes := 0, int64(0), int64(0)
+	live := make(map[uint32]int64)
+	for _, kd := range dirs {
+		keys += kd.Len()
+		keyBytes += kd.KeyBytes()
+		liveBytes += kd.LiveBytes()
+		for id, n := range kd.LiveBytesByFile() {
+			live[id] += n
+		}
+	}
+	s := &Stats{
+		Keys:         c.keyDirs.Len(),
+		DataFiles:    len(dataFiles),
+		LiveBytes:    liveBytes,
+		Files:        []FileStats{},
+		ActiveFileID: activeID,
+		ActiveOffset: activeOffset,
+		KeydirBytes:  int64(keys)*keydirEntrySize + keyBytes,
+		// the active data and hint files and the lock file
+		OpenFiles:    3 + c.oldFiles.OpenFiles(),
+		BytesWritten: atomic.LoadUint64(&c.metrics.bytesWritten),
+		BytesRead:    atomic.LoadUint64(&c.metrics.bytesRead),
+		Rotations:    atomic.LoadUint64(&c.metrics.rotations),
+		Put:          c.metrics.put.snapshot(),
+		Get:          c.metrics.get.snapshot(),
+		Del:          c.metrics.del.snapshot(),
+		Merge:        c.metrics.merge.snapshot(),
+		MergeErrors:  atomic.LoadUint64(&c.metrics.mergeErrors),
+		Buckets:      c.bucketStats(),
+	}
+	for _, b := range s.Buckets {
+		s.Keys += b.Keys
+	}
+	c.metrics.lock.Lock()
+	records := make(map[uint32]int64, len(c.metrics.records))
+	for id, n := range c.metrics.records {
+		records[id] = n
+	}
+	s.LastMerge = c.metrics.lastMerge
+	c.metrics.lock.Unlock()
+
+	for _, name := range dataFiles {
+		stat, err := c.fs.Stat(c.dir + "/" + name)
+		if err != nil {
+			// merge removed it meanwhile
+			continue
+		}
+		id := FileIDOf(name)
+		f := FileStats{
+			ID:        id,
+			Size:      stat.Size(),
+			LiveBytes: live[id],
+			Records:   records[id],
+			CreatedAt: time.Unix(int64(id), 0),
+		}
+		if f.Size > 0 {
+			f.LiveRatio = float64(f.LiveBytes) / float64(f.Size)
+		}
+		s.DataBytes += f.Size
+		s.Files = append(s.Files, f)
+	}
+	sort.Slice(s.Files, func(i, j int) bool { return s.Files[i].ID < s.Files[j].ID })
+	if s.DeadBytes = s.DataBytes - s.LiveBytes; s.DeadBytes < 0 {
+		s.DeadBytes = 0
+	}
+	return s, nil
+}
+
+func (c *BitCask) bucketStats() []BucketStats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	stats := []BucketStats{}
+	for name, id := range c.buckets.ids {
+		if reservedBucket(name) {
+			continue
+		}
+		stats = append(stats, *bucketStats(name, id, c.buckets.dirs[id]))
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
@@ -0,0 +1,104 @@
+package Bitcask
+
+import (
+	"fmt"
+	"testing"
+)
+
+func statsOf(t *testing.T, bc *BitCask) *Stats {
+	t.Helper()
+	s, err := bc.Stats()
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	return s
+}
+
+// checkSizes fails unless the sizes of s add up.
+func checkSizes(t *testing.T, s *Stats) {
+	t.Helper()
+	if len(s.Files) != s.DataFiles {
+		t.Fatalf("%d files described, %d data files", len(s.Files), s.DataFiles)
+	}
+	var size, live int64
+	for _, f := range s.Files {
+		size += f.Size
+		live += f.LiveBytes
+		if f.LiveBytes > f.Size || f.Size > 0 && f.LiveRatio != float64(f.LiveBytes)/float64(f.Size) {
+			t.Fatalf("file %+v", f)
+		}
+	}
+	if size != s.DataBytes || live != s.LiveBytes || s.DataBytes-s.LiveBytes != s.DeadBytes {
+		t.Fatalf("data %d live %d dead %d, files hold %d live %d", s.DataBytes, s.LiveBytes, s.DeadBytes, size, live)
+	}
+}
+
+func TestStats(t *testing.T) {
+	opt := testOptions()
+	opt.MaxFileSize = 256
+	bc, err := Open(t.TempDir(), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	s := statsOf(t, bc)
+	checkSizes(t, s)
+	if s.Keys != 0 || s.LiveBytes != 0 || s.BytesWritten != 0 || s.Put.Count() != 0 || s.LastMerge != nil {
+		t.Fatalf("stats of an empty store %+v", s)
+	}
+
+	for i := 0; i < 40; i++ {
+		putTest(t, bc, fmt.Sprintf("key%d", i%10), fmt.Sprintf("value%d", i))
+	}
+	if _, err := bc.Get([]byte("key1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.Del([]byte("key2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.Bucket("b").Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	s = statsOf(t, bc)
+	checkSizes(t, s)
+	if s.Keys != 10 {
+		t.Fatalf("%d keys, want 9 and 1 in a bucket", s.Keys)
+	}
+	if len(s.Buckets) != 1 || s.Buckets[0].Name != "b" || s.Buckets[0].Keys != 1 || s.Buckets[0].KeyBytes != 1 {
+		t.Fatalf("buckets %+v", s.Buckets)
+	}
+	// the bucket put is timed too
+	if s.Put.Count() != 41 || s.Get.Count() != 1 || s.Del.Count() != 1 {
+		t.Fatalf("%d puts, %d gets, %d deletes", s.Put.Count(), s.Get.Count(), s.Del.Count())
+	}
+	if s.Rotations == 0 || s.DataFiles < 2 || s.Files[len(s.Files)-1].ID != s.ActiveFileID {
+		t.Fatalf("%d rotations, %d data files, active %d", s.Rotations, s.DataFiles, s.ActiveFileID)
+	}
+	if s.BytesWritten != uint64(s.DataBytes) || s.BytesRead == 0 || s.DeadBytes == 0 {
+		t.Fatalf("wrote %d of %d data bytes, read %d, dead %d", s.BytesWritten, s.DataBytes, s.BytesRead, s.DeadBytes)
+	}
+	records := int64(0)
+	for _, f := range s.Files {
+		records += f.Records
+	}
+	// the puts, the delete, the bucket key and the key naming the bucket
+	if records != 43 {
+		t.Fatalf("%d records, want 43", records)
+	}
+
+	if err := NewMerge(bc, 0).Run(); err != nil {
+		t.Fatal(err)
+	}
+	merged := statsOf(t, bc)
+	checkSizes(t, merged)
+	if merged.Keys != 10 || merged.Merge.Count() != 1 || merged.MergeErrors != 0 {
+		t.Fatalf("after merge %d keys, %d merges, %d errors", merged.Keys, merged.Merge.Count(), merged.MergeErrors)
+	}
+	if m := merged.LastMerge; m == nil || m.Error != "" || m.Files == 0 || m.RemovedBytes == 0 {
+		t.Fatalf("last merge %+v", m)
+	}
+	if merged.DeadBytes >= s.DeadBytes {
+		t.Fatalf("merge left %d dead bytes of %d", merged.DeadBytes, s.DeadBytes)
+	}
+}
@@ -1,10 +1,13 @@
 package Bitcask
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,107 +20,145 @@ const (
 	MergingHintSuffix = MergeHintSuffix + ".tmp"
 )
 
-func AppendToFile(f *os.File, buf []byte) (int, error) {
+// AppendToFile writes buf at the end of f. If that fails, what was written
+// of it is cut off again, so the next append starts where this one did. If
+// that fails too it returns a *TornAppendError.
+func AppendToFile(f File, buf []byte) (int, error) {
 	stat, err := f.Stat()
 	if err != nil {
 		return -1, err
 	}
-	return f.WriteAt(buf, stat.Size())
+	n, err := f.WriteAt(buf, stat.Size())
+	if err != nil {
+		if terr := f.Truncate(stat.Size()); terr != nil {
+			return n, &TornAppendError{err, terr}
+		}
+	}
+	return n, err
 }
 
-func CheckWriteableFile(c *BitCask) {
-	if c.writeFile.offset > c.options.MaxFileSize && c.writeFile.fileID != uint32(time.Now().Unix()) {
-		// open a new file
-		c.writeFile.hintFile.Close()
-		c.writeFile.file.Close()
+// TornAppendError reports an append that failed and could not be cut off,
+// so the file ends in part of it.
+type TornAppendError struct {
+	Err         error
+	TruncateErr error
+}
 
-		file, fileID := SetWriteableFile(0, c.dir)
-		hintFile := SetHintFile(fileID, c.dir)
-		f := &DBFile{
-			file:     file,
-			fileID:   fileID,
-			offset:   0,
-			hintFile: hintFile,
-		}
-		c.writeFile = f
-		WritePID(c.lockFile, fileID)
+func (e *TornAppendError) Error() string {
+	return fmt.Sprintf("%v, and cutting it off failed: %v", e.Err, e.TruncateErr)
+}
+
+func (e *TornAppendError) Unwrap() error {
+	return e.Err
+}
+
+// CheckWriteableFile rotates the active file once it is past MaxFileSize.
+func CheckWriteableFile(c *BitCask) error {
+	if c.writeFile.offset > c.options.MaxFileSize {
+		return RotateWriteableFile(c)
+	}
+	return nil
+}
+
+// RotateWriteableFile closes the active file and opens a new one whose ID is
+// strictly greater, so files rotated within the same second never collide.
+// If it fails the active file stays as it was.
+func RotateWriteableFile(c *BitCask) error {
+	if c.writeFile.torn != nil {
+		// only the active file is cut back by Open
+		return c.writeFile.torn
+	}
+	// only the active file is recovered after a crash, see recoverDataFile
+	if err := c.sync(); err != nil {
+		return err
+	}
+	fileID := uint32(time.Now().Unix())
+	if fileID <= c.writeFile.fileID {
+		fileID = c.writeFile.fileID + 1
 	}
+	file, fileID, err := SetWriteableFile(c.fs, fileID, c.dir)
+	if err != nil {
+		return err
+	}
+	hintFile, err := SetHintFile(c.fs, fileID, c.dir)
+	if err != nil {
+		file.Close()
+		c.fs.Remove(file.Name())
+		return err
+	}
+	c.writeFile.hintFile.Close()
+	c.writeFile.file.Close()
+	f := &DBFile{
+		file:     file,
+		fileID:   fileID,
+		offset:   0,
+		hintFile: hintFile,
+		metrics:  c.metrics,
+		seal:     c.seal,
+	}
+	c.writeFile = f
+	atomic.AddUint64(&c.metrics.rotations, 1)
+	WritePID(c.lockFile, fileID)
+	return nil
 }
 
-func WritePID(file *os.File, fileID uint32) {
+// closeUnfinishedBatch rotates the active file after a write that failed
+// part way through a batch, which stays unfinished at the end of its file.
+// If that fails the file takes no more records, so no later one seems to
+// end the batch, and Open rotates it instead.
+func closeUnfinishedBatch(c *BitCask) {
+	if err := RotateWriteableFile(c); err != nil {
+		c.writeFile.torn = err
+	}
+}
+
+func WritePID(file File, fileID uint32) {
 	file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\t"+strconv.Itoa(int(fileID))+".data"), 0)
 }
 
-func SetHintFile(fileID uint32, dir string) *os.File {
+func SetHintFile(fs FileSystem, fileID uint32, dir string) (File, error) {
 	if fileID == 0 {
 		fileID = uint32(time.Now().Unix())
 	}
 	fileName := dir + "/" + strconv.Itoa(int(fileID)) + ".hint"
-	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0755)
-	if err != nil {
-		panic(err)
-	}
-	return f
+	return fs.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0755)
 }
 
-func SetWriteableFile(fileID uint32, dir string) (*os.File, uint32) {
+func SetWriteableFile(fs FileSystem, fileID uint32, dir string) (File, uint32, error) {
 	if fileID == 0 {
 		fileID = uint32(time.Now().Unix())
 	}
 	fileName := dir + "/" + strconv.Itoa(int(fileID)) + ".data"
-	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0755)
-	if err != nil {
-		panic(err)
-	}
-	return f, fileID
+	f, err := fs.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0755)
+	return f, fileID, err
 }
 
-func LockFile(fileName string) (*os.File, error) {
-	return os.OpenFile(fileName, os.O_EXCL|os.O_CREATE|os.O_RDWR, os.ModePerm)
+func LockFile(fs FileSystem, fileName string) (File, error) {
+	return fs.OpenFile(fileName, os.O_EXCL|os.O_CREATE|os.O_RDWR, os.ModePerm)
 }
 
 func ListHintFiles(c *BitCask) ([]string, error) {
-	filterFileNames := []string{LockFileName, MergeDataSuffix, MergeHintSuffix, MergingDataSuffix, MergingHintSuffix}
-	dirFp, err := os.OpenFile(c.dir, os.O_RDONLY, os.ModeDir)
-	if err != nil {
-		return nil, err
-	}
-	defer dirFp.Close()
-
-	fileList, err := dirFp.Readdirnames(-1)
-	if err != nil {
-		return nil, err
-	}
-	var hintFiles []string
-	for _, v := range fileList {
-		if strings.Contains(v, ".hint") && !HasSuffixs(filterFileNames, v) {
-			hintFiles = append(hintFiles, v)
-		}
-	}
-	sort.Strings(hintFiles)
-	return hintFiles, nil
+	return listFiles(c.fs, c.dir, ".hint")
 }
 
 func ListDataFiles(c *BitCask) ([]string, error) {
-	filterFileNames := []string{LockFileName, MergeDataSuffix, MergeHintSuffix, MergingDataSuffix, MergingHintSuffix}
-	dirFp, err := os.OpenFile(c.dir, os.O_RDONLY, os.ModeDir)
-	if err != nil {
-		return nil, err
-	}
-	defer dirFp.Close()
+	return listFiles(c.fs, c.dir, ".data")
+}
 
-	fileList, err := dirFp.Readdirnames(-1)
+func listFiles(fs FileSystem, dir, ext string) ([]string, error) {
+	filterFileNames := []string{LockFileName, MergeDataSuffix, MergeHintSuffix, MergingDataSuffix, MergingHintSuffix}
+	fileList, err := fs.ReadDirNames(dir)
 	if err != nil {
 		return nil, err
 	}
-	var dataFiles []string
+	var files []string
 	for _, v := range fileList {
-		if strings.Contains(v, ".data") && !HasSuffixs(filterFileNames, v) {
-			dataFiles = append(dataFiles, v)
+		if strings.HasSuffix(v, ext) && !HasSuffixs(filterFileNames, v) {
+			files = append(files, v)
 		}
 	}
-	sort.Strings(dataFiles)
-	return dataFiles, nil
+	sort.Strings(files)
+	return files, nil
 }
 
 func HasSuffixs(suffixs []string, src string) bool {
@@ -129,7 +170,7 @@ func HasSuffixs(suffixs []string, src string) bool {
 	return false
 }
 
-func LastFileInfo(files []*os.File) (uint32, *os.File) {
+func LastFileInfo(files []File) (uint32, File) {
 	if files == nil {
 		return 0, nil
 	}
@@ -152,10 +193,20 @@ func LastFileInfo(files []*os.File) (uint32, *os.File) {
 	return uint32(lastID), lastFile
 }
 
-func CloseReadHintFile(files []*os.File, fileID uint32) {
+func CloseReadHintFile(files []File, fileID uint32) {
 	for _, fp := range files {
 		if !strings.Contains(fp.Name(), strconv.Itoa(int(fileID))) {
 			fp.Close()
 		}
 	}
 }
+
+// FileIDOf returns the file ID encoded in a data or hint file name.
+func FileIDOf(fileName string) uint32 {
+	fileName = filepath.Base(fileName)
+	if i := strings.Index(fileName, "."); i >= 0 {
+		fileName = fileName[:i]
+	}
+	id, _ := strconv.Atoi(fileName)
+	return uint32(id)
+}
@@ -0,0 +1,231 @@
+package Bitcask
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Problem kinds reported by Verify.
+const (
+	ProblemCRC          = "crc_mismatch"
+	ProblemTruncated    = "truncated_record"
+	ProblemHintTrunc    = "truncated_hint"
+	ProblemHintMismatch = "hint_mismatch"
+	ProblemHintMissing  = "hint_missing"
+	ProblemOrphanHint   = "orphan_hint"
+	ProblemOrphanData   = "orphan_data"
+	ProblemStrayFile    = "stray_file"
+	ProblemLockFile     = "lock_file"
+)
+
+type Problem struct {
+	Kind     string `json:"kind"`
+	Severity string `json:"severity"`
+	File     string `json:"file"`
+	Offset   int64  `json:"offset"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+type FileReport struct {
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	Records    int    `json:"records"`
+	Tombstones int    `json:"tombstones"`
+	ValidBytes int64  `json:"valid_bytes"`
+	Hints      int    `json:"hints"`
+}
+
+// VerifyReport is the result of checking a store directory. OK is false as
+// soon as one problem has error severity.
+type VerifyReport struct {
+	Dir      string        `json:"dir"`
+	OK       bool          `json:"ok"`
+	Files    []*FileReport `json:"files"`
+	Problems []*Problem    `json:"problems"`
+}
+
+func (r *VerifyReport) add(kind, severity, file string, offset int64, detail string) {
+	r.Problems = append(r.Problems, &Problem{
+		Kind:     kind,
+		Severity: severity,
+		File:     file,
+		Offset:   offset,
+		Detail:   detail,
+	})
+	if severity == SeverityError {
+		r.OK = false
+	}
+}
+
+type recordSummary struct {
+	tStamp    uint32
+	flags     uint8
+	keySize   uint32
+	valueSize uint32
+	hinted    bool
+}
+
+// Verify checks every data file in dir record by record and cross-checks the
+// hint files against them. It only reads the directory, so it can run on a
+// store that is not open, and returns an error only if dir can't be read.
+func Verify(dir string) (*VerifyReport, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{Dir: dir, OK: true, Problems: []*Problem{}}
+	names := make(map[string]bool)
+	for _, fi := range infos {
+		names[fi.Name()] = true
+	}
+
+	for _, fi := range infos {
+		name := fi.Name()
+		switch {
+		case name == LockFileName:
+			detail := "store is open or was not closed cleanly"
+			if buf, _ := ioutil.ReadFile(dir + "/" + name); len(bytes.TrimSpace(buf)) > 0 {
+				detail += ", owner: " + string(bytes.TrimSpace(buf))
+			}
+			report.add(ProblemLockFile, SeverityWarning, name, 0, detail)
+		case HasSuffixs([]string{MergeDataSuffix, MergeHintSuffix, ".tmp"}, name):
+			report.add(ProblemStrayFile, SeverityWarning, name, 0, "left over from an interrupted merge or rewrite")
+		case strings.HasSuffix(name, ".data"):
+			if !names[strings.TrimSuffix(name, ".data")+".hint"] {
+				report.add(ProblemOrphanData, SeverityWarning, name, 0, "no hint file, keys are not loaded by Open")
+			}
+		case strings.HasSuffix(name, ".hint"):
+			if !names[strings.TrimSuffix(name, ".hint")+".data"] {
+				report.add(ProblemOrphanHint, SeverityError, name, 0, "no data file")
+			}
+		}
+	}
+
+	for _, fi := range infos {
+		if !strings.HasSuffix(fi.Name(), ".data") || HasSuffixs([]string{MergeDataSuffix}, fi.Name()) {
+			continue
+		}
+		fr, err := verifyFile(dir, fi.Name(), names, report)
+		if err != nil {
+			return nil, err
+		}
+		report.Files = append(report.Files, fr)
+	}
+	sort.Slice(report.Files, func(i, j int) bool {
+		return report.Files[i].Name < report.Files[j].Name
+	})
+	return report, nil
+}
+
+func verifyFile(dir, name string, names map[string]bool, report *VerifyReport) (*FileReport, error) {
+	fp, err := os.Open(dir + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	stat, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fr := &FileReport{Name: name, Size: stat.Size()}
+
+	records := make(map[int64]*recordSummary)
+	damaged := stat.Size()
+	err = ReadRecords(fp, stat.Size(), func(rec *Record) error {
+		fr.Records++
+		if rec.IsTombstone() {
+			fr.Tombstones++
+		}
+		fr.ValidBytes += rec.Size()
+		records[rec.Offset] = &recordSummary{
+			tStamp:    rec.TimeStamp,
+			flags:     rec.Flags,
+			keySize:   uint32(len(rec.Key)),
+			valueSize: uint32(len(rec.Value)),
+		}
+		return nil
+	})
+	if re, ok := err.(*RecordError); ok {
+		kind := ProblemTruncated
+		if re.Err == CRC32Error {
+			kind = ProblemCRC
+		}
+		damaged = re.Offset
+		report.add(kind, SeverityError, name, re.Offset,
+			fmt.Sprintf("%d bytes after this offset are unreadable", stat.Size()-re.Offset))
+	} else if err != nil {
+		return nil, err
+	}
+
+	hintName := strings.TrimSuffix(name, ".data") + ".hint"
+	if !names[hintName] {
+		return fr, nil
+	}
+	hp, err := os.Open(dir + "/" + hintName)
+	if err != nil {
+		return nil, err
+	}
+	defer hp.Close()
+	hintStat, err := hp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	err = ReadHints(hp, hintStat.Size(), func(h *Hint) error {
+		fr.Hints++
+		offset := int64(h.ValuePos) - HeaderSize - int64(len(h.Key))
+		rs, ok := records[offset]
+		if !ok && offset >= damaged {
+			report.add(ProblemHintMismatch, SeverityError, hintName, h.Offset,
+				fmt.Sprintf("valuePos %d points past damaged data at offset %d", h.ValuePos, damaged))
+			return nil
+		}
+		if !ok {
+			report.add(ProblemHintMismatch, SeverityError, hintName, h.Offset,
+				fmt.Sprintf("valuePos %d does not start a valid record value", h.ValuePos))
+			return nil
+		}
+		rs.hinted = true
+		if rs.valueSize != h.ValueSize || rs.keySize != uint32(len(h.Key)) ||
+			rs.tStamp != h.TimeStamp || rs.flags&FlagTombstone != h.Flags&FlagTombstone {
+			report.add(ProblemHintMismatch, SeverityError, hintName, h.Offset,
+				fmt.Sprintf("hint disagrees with record at offset %d", offset))
+			return nil
+		}
+		key := make([]byte, len(h.Key))
+		if _, err := fp.ReadAt(key, offset+HeaderSize); err != nil && err != io.EOF {
+			return err
+		}
+		if !bytes.Equal(key, h.Key) {
+			report.add(ProblemHintMismatch, SeverityError, hintName, h.Offset,
+				fmt.Sprintf("hint key %q differs from record key %q", h.Key, key))
+		}
+		return nil
+	})
+	if re, ok := err.(*RecordError); ok {
+		report.add(ProblemHintTrunc, SeverityError, hintName, re.Offset, re.Err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+
+	offsets := make([]int64, 0, len(records))
+	for offset, rs := range records {
+		if !rs.hinted && rs.keySize > 0 {
+			offsets = append(offsets, offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for _, offset := range offsets {
+		report.add(ProblemHintMissing, SeverityError, name, offset, "record has no hint entry, Open will not see it")
+	}
+	return fr, nil
+}
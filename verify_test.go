@@ -0,0 +1,89 @@
+package Bitcask
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func dataFile(t *testing.T, dir string) string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range infos {
+		if strings.HasSuffix(fi.Name(), ".data") && fi.Size() > 0 {
+			return dir + "/" + fi.Name()
+		}
+	}
+	t.Fatalf("no data file in %s", dir)
+	return ""
+}
+
+func TestVerifyFlippedByte(t *testing.T) {
+	dir := t.TempDir()
+	bc := openTest(t, dir)
+	putTest(t, bc, "a", "1", "b", "2", "c", "3")
+	bc.Close()
+
+	report, err := Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK || len(report.Problems) != 0 {
+		t.Fatalf("clean store reported %+v", report.Problems)
+	}
+	if len(report.Files) != 1 || report.Files[0].Records != 3 {
+		t.Fatalf("clean store files %+v", report.Files)
+	}
+
+	// flip the value byte of the second record
+	path := dataFile(t, dir)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := int64(HeaderSize + 2)
+	buf[second+HeaderSize+1] ^= 0x40
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK {
+		t.Fatal("store with a flipped byte reported OK")
+	}
+	var found bool
+	for _, p := range report.Problems {
+		if p.Kind == ProblemCRC && p.Offset == second && p.Severity == SeverityError {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("no crc mismatch at offset %d in %+v", second, report.Problems)
+	}
+}
+
+func TestVerifyMissingHint(t *testing.T) {
+	dir := t.TempDir()
+	bc := openTest(t, dir)
+	putTest(t, bc, "a", "1")
+	bc.Close()
+
+	path := dataFile(t, dir)
+	if err := os.Remove(strings.TrimSuffix(path, ".data") + ".hint"); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != ProblemOrphanData {
+		t.Fatalf("data file without hints reported %+v", report.Problems)
+	}
+}
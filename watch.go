@@ -0,0 +1,256 @@
+package Bitcask
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+const (
+	// defaultWatchHistory is how many recent events are kept for resuming.
+	defaultWatchHistory = 4096
+	defaultWatchBuffer  = 256
+)
+
+var (
+	HistoryUnavailableErr = fmt.Errorf("Changes since this sequence are no longer available ")
+	WatcherLaggedErr      = fmt.Errorf("Watcher fell too far behind ")
+	WatcherClosedErr      = fmt.Errorf("Watcher closed ")
+)
+
+type EventType uint8
+
+const (
+	EventPut EventType = iota + 1
+	EventDel
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDel:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// Event is a committed put or delete. Seq is the position of its record in
+// the log, see SeqOf, so later changes always have a greater Seq.
+type Event struct {
+	Seq   uint64
+	Type  EventType
+	Key   []byte
+	Value []byte
+	Meta  *Meta
+	// bucket is set for changes within a Bucket, which only watchers of
+	// every change get
+	bucket bool
+}
+
+// SeqOf returns the sequence number of the record starting at offset in the
+// given data file.
+func SeqOf(fileID uint32, offset uint64) uint64 {
+	return uint64(fileID)<<32 | offset
+}
+
+// SplitSeq is the inverse of SeqOf.
+func SplitSeq(seq uint64) (uint32, uint64) {
+	return uint32(seq >> 32), seq & (1<<32 - 1)
+}
+
+// Watcher receives the events of keys under its prefix on C, in commit
+// order. C is closed when the watcher is closed, the store is closed or the
+// watcher falls behind by more than its buffer; Err tells which.
+type Watcher struct {
+	C      <-chan *Event
+	c      chan *Event
+	prefix []byte
+	all    bool
+	hub    *watchHub
+	err    error
+}
+
+func (w *Watcher) Err() error {
+	w.hub.lock.Lock()
+	defer w.hub.lock.Unlock()
+
+	return w.err
+}
+
+func (w *Watcher) Close() {
+	w.hub.lock.Lock()
+	defer w.hub.lock.Unlock()
+
+	w.hub.remove(w, WatcherClosedErr)
+}
+
+// watchHub fans events out to watchers and keeps the most recent ones so a
+// watcher can resume where a previous one stopped.
+type watchHub struct {
+	lock     *sync.Mutex
+	watchers map[*Watcher]bool
+	history  []*Event
+	next     int
+	size     int
+	// floor is the Seq before which history is incomplete
+	floor uint64
+}
+
+func newWatchHub(floor uint64) *watchHub {
+	return &watchHub{
+		lock:     &sync.Mutex{},
+		watchers: make(map[*Watcher]bool),
+		history:  make([]*Event, defaultWatchHistory),
+		floor:    floor,
+	}
+}
+
+// publish must be called in commit order, that is under the store lock.
+func (h *watchHub) publish(e *Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if old := h.history[h.next]; old != nil {
+		h.floor = old.Seq + 1
+	}
+	h.history[h.next] = e
+	h.next = (h.next + 1) % len(h.history)
+	if h.size < len(h.history) {
+		h.size++
+	}
+	for w := range h.watchers {
+		if !w.all && (e.bucket || !bytes.HasPrefix(e.Key, w.prefix)) {
+			continue
+		}
+		select {
+		case w.c <- e:
+		default:
+			h.remove(w, WatcherLaggedErr)
+		}
+	}
+}
+
+// since returns the kept events after seq, or HistoryUnavailableErr when
+// some of them were already dropped.
+func (h *watchHub) since(seq uint64) ([]*Event, error) {
+	if seq+1 < h.floor {
+		return nil, HistoryUnavailableErr
+	}
+	var events []*Event
+	start := (h.next - h.size + len(h.history)) % len(h.history)
+	for i := 0; i < h.size; i++ {
+		e := h.history[(start+i)%len(h.history)]
+		if e.Seq > seq {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (h *watchHub) remove(w *Watcher, err error) {
+	if !h.watchers[w] {
+		return
+	}
+	delete(h.watchers, w)
+	w.err = err
+	close(w.c)
+}
+
+func (h *watchHub) closeAll() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for w := range h.watchers {
+		h.remove(w, WatcherClosedErr)
+	}
+}
+
+// Watch subscribes to changes of keys starting with prefix. With since > 0
+// the watcher first receives the changes committed after since; if those
+// are no longer kept in memory Watch fails with HistoryUnavailableErr.
+// buffer is how many events may be pending before the watcher is dropped.
+func (c *BitCask) Watch(prefix []byte, since uint64, buffer int) (*Watcher, error) {
+	if buffer <= 0 {
+		buffer = defaultWatchBuffer
+	}
+	h := c.watch
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var backlog []*Event
+	if since > 0 {
+		events, err := h.since(since)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range events {
+			if !e.bucket && bytes.HasPrefix(e.Key, prefix) {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+	ch := make(chan *Event, buffer+len(backlog))
+	for _, e := range backlog {
+		ch <- e
+	}
+	w := &Watcher{
+		C:      ch,
+		c:      ch,
+		prefix: append([]byte{}, prefix...),
+		hub:    h,
+	}
+	h.watchers[w] = true
+	return w, nil
+}
+
+// LastSeq returns the sequence number of the last committed change, or of
+// the end of the log when nothing was written since Open.
+func (c *BitCask) LastSeq() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	h := c.watch
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.size == 0 {
+		return h.floor - 1
+	}
+	return h.history[(h.next-1+len(h.history))%len(h.history)].Seq
+}
+
+// watchAll is Watch of every change, including those within buckets, from
+// now on.
+func (c *BitCask) watchAll(buffer int) *Watcher {
+	w, _ := c.Watch(nil, 0, buffer)
+	w.hub.lock.Lock()
+	w.all = true
+	w.hub.lock.Unlock()
+	return w
+}
+
+// publish reports a record written at e, keyed key, to the watchers.
+func (c *BitCask) publish(t EventType, key, value []byte, meta *Meta, e *Entry) {
+	event := &Event{
+		Seq:  e.seq(key),
+		Type: t,
+		Key:  append([]byte{}, key...),
+		Meta: meta,
+	}
+	if t == EventPut {
+		event.Value = append([]byte{}, value...)
+	}
+	c.watch.publish(event)
+}
+
+// publishBucket reports a record of a bucket written at e, keyed key as
+// stored, to the watchers of every change.
+func (c *BitCask) publishBucket(t EventType, key []byte, e *Entry) {
+	c.watch.publish(&Event{
+		Seq:    e.seq(key),
+		Type:   t,
+		Key:    append([]byte{}, key...),
+		bucket: true,
+	})
+}
@@ -0,0 +1,165 @@
+package Bitcask
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func changesSince(t *testing.T, bc *BitCask, seq uint64) ([]*Event, error) {
+	t.Helper()
+	var events []*Event
+	err := bc.ChangesSince(seq, func(e *Event) error {
+		events = append(events, e)
+		return nil
+	})
+	return events, err
+}
+
+// drain returns the events pending on w.
+func drain(w *Watcher) []*Event {
+	var events []*Event
+	for {
+		select {
+		case e := <-w.C:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func describe(events []*Event) string {
+	s := ""
+	for _, e := range events {
+		s += fmt.Sprintf("%s %s=%s;", e.Type, e.Key, e.Value)
+	}
+	return s
+}
+
+func TestWatchAndChangesAcrossMerge(t *testing.T) {
+	opt := testOptions()
+	opt.MaxFileSize = 256
+	opt.FileSystem = NewMemFS()
+	bc, err := Open("/db", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := bc.Watch([]byte("k"), 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var all, watched string
+	for i := 0; i < 30; i++ {
+		key, value := fmt.Sprintf("k%02d", i%10), fmt.Sprintf("v%d", i)
+		putTest(t, bc, key, value, "x", value)
+		all += fmt.Sprintf("put %s=%s;put x=%s;", key, value, value)
+		watched += fmt.Sprintf("put %s=%s;", key, value)
+		if i%7 == 6 {
+			if err := bc.Del([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			all += fmt.Sprintf("delete %s=;", key)
+			watched += fmt.Sprintf("delete %s=;", key)
+		}
+	}
+	events, err := changesSince(t, bc, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := describe(events); got != all {
+		t.Fatalf("changes since 0:\n%s\nwant\n%s", got, all)
+	}
+	pending := drain(w)
+	if got := describe(pending); got != watched {
+		t.Fatalf("watched:\n%s\nwant\n%s", got, watched)
+	}
+	// both number a change with the same Seq
+	i := 0
+	for _, e := range events {
+		if e.Key[0] != 'k' {
+			continue
+		}
+		if pending[i].Seq != e.Seq {
+			t.Fatalf("watched %s with seq %d, changes have %d", pending[i].Key, pending[i].Seq, e.Seq)
+		}
+		i++
+	}
+	last := bc.LastSeq()
+	if events[len(events)-1].Seq != last {
+		t.Fatalf("last seq %d, changes end at %d", last, events[len(events)-1].Seq)
+	}
+
+	if err := NewMerge(bc, 0).Run(); err != nil {
+		t.Fatal(err)
+	}
+	// moving records is no change
+	if e := drain(w); len(e) != 0 {
+		t.Fatalf("merge published %s", describe(e))
+	}
+	if _, err := changesSince(t, bc, 0); err != HistoryUnavailableErr {
+		t.Fatalf("changes since 0 after merge: %v", err)
+	}
+	if events, err := changesSince(t, bc, last); err != nil || len(events) != 0 {
+		t.Fatalf("changes since the last one after merge: %s, %v", describe(events), err)
+	}
+
+	putTest(t, bc, "k99", "new")
+	if e := drain(w); describe(e) != "put k99=new;" {
+		t.Fatalf("watched after merge: %s", describe(e))
+	}
+	if events, err := changesSince(t, bc, last); err != nil || describe(events) != "put k99=new;" {
+		t.Fatalf("changes after merge: %s, %v", describe(events), err)
+	}
+	bc.Close()
+	if _, ok := <-w.C; ok || w.Err() != WatcherClosedErr {
+		t.Fatalf("watcher after Close: %v", w.Err())
+	}
+
+	// the history lost to merge stays lost across restarts
+	bc, err = Open("/db", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	if _, err := changesSince(t, bc, 0); err != HistoryUnavailableErr {
+		t.Fatalf("changes since 0 after reopen: %v", err)
+	}
+	if events, err := changesSince(t, bc, last); err != nil || describe(events) != "put k99=new;" {
+		t.Fatalf("changes after reopen: %s, %v", describe(events), err)
+	}
+}
+
+func TestChangesOfExpiredKeys(t *testing.T) {
+	opt := testOptions()
+	opt.FileSystem = NewMemFS()
+	bc, err := Open("/db", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	putTest(t, bc, "kept", "1")
+	if err := bc.PutWithMeta([]byte("gone"), []byte("2"), &Meta{ExpiresAt: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	last := bc.LastSeq()
+	w, err := bc.Watch(nil, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	rotateTest(t, bc)
+	if err := NewMerge(bc, 0).Run(); err != nil {
+		t.Fatal(err)
+	}
+	// the copy of kept is no change, the tombstone of gone is
+	if e := drain(w); describe(e) != "delete gone=;" {
+		t.Fatalf("merge published %s", describe(e))
+	}
+	if events, err := changesSince(t, bc, last); err != nil || describe(events) != "delete gone=;" {
+		t.Fatalf("changes after merge: %s, %v", describe(events), err)
+	}
+}